@@ -26,58 +26,87 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
-	"sync"
+	"reflect"
 	"syscall"
 	"telemetruum/agent/modules"
 	"time"
 
 	"github.com/alecthomas/kingpin/v2"
-	prom_client "github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog"
-	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/exporters/prometheus"
-	metric2 "go.opentelemetry.io/otel/metric"
 	"go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
 )
 
+// set at build time with -ldflags "-X main.version=... -X main.commit=...", see the cli-compile job of .gitlab-ci.yml
 var (
-	bindAddress          = kingpin.Flag("bind", "Bind address").Default(":2545").String()
-	dockerEnabled        = kingpin.Flag("docker", "Enable Docker Provider").Default("true").Bool()
-	kubernetesEnabled    = kingpin.Flag("kubernetes", "Enable Kubernetes Provider").Default("true").Bool()
-	systemEnabled        = kingpin.Flag("system", "Enable System Provider").Default("true").Bool()
-	hostInfoInterval     = kingpin.Flag("host-info-interval", "Interval for Host Info Metrics").Default("5m").String()
-	orchInfoInterval     = kingpin.Flag("orch-info-interval", "Interval for Orchestrator Info Metrics").Default("2m").String()
-	workloadInfoInterval = kingpin.Flag("workload-info-interval", "Interval for Workload Info Metrics").Default("1m").String()
-	nodeMountedInterval  = kingpin.Flag("node-mount-interval", "Interval for Node Mounted Metrics").Default("1m").String()
+	version = "dev"
+	commit  = "unknown"
 )
 
-func serveMetrics(logger zerolog.Logger) {
-	logger.Info().Msgf("serving metrics at %s/metrics", *bindAddress)
-	http.Handle("/metrics", promhttp.Handler())
-	err := http.ListenAndServe(*bindAddress, nil) //nolint:gosec // Ignoring G114: Use of net/http serve function that has no support for setting timeouts.
+func serveMetrics(cfg *modules.Config, supervisor *modules.Supervisor, logger zerolog.Logger) (*modules.Server, error) {
+	server, err := modules.NewServer(cfg.Bind, cfg.Server, logger)
 	if err != nil {
-		fmt.Printf("error serving http: %v", err)
-		return
+		return nil, err
 	}
+
+	mux := http.NewServeMux()
+	if cfg.Prometheus.Enabled {
+		logger.Info().Msgf("serving metrics at %s/metrics", cfg.Bind)
+		mux.Handle("/metrics", server.Protect(promhttp.Handler()))
+	}
+	inventory := server.Protect(modules.InventoryHandler(supervisor))
+	mux.Handle(modules.InventoryPath, inventory)
+	mux.Handle(modules.InventoryPath+"/", inventory)
+	// not protected, so that they can be used as probes
+	mux.Handle("/healthz", modules.HealthHandler(supervisor, false))
+	mux.Handle("/readyz", modules.HealthHandler(supervisor, true))
+
+	server.Handler = mux
+	if err := server.Start(); err != nil {
+		return nil, err
+	}
+	return server, nil
 }
 
-func setupOtel() metric2.Meter {
+// setupOtel creates the meter provider, with a reader for every enabled exporter. Readers can't be changed
+// afterwards, so changes of the exporters settings need a restart
+func setupOtel(ctx context.Context, cfg *modules.Config, logger zerolog.Logger) (*metric.MeterProvider, error) {
+	opts := []metric.Option{
+		metric.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", "telemetruum-agent"),
+			attribute.String("service.version", version))),
+	}
 
-	prom_client.Unregister(collectors.NewGoCollector())
-	prom_client.Unregister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	if cfg.Prometheus.Enabled {
+		exporter, err := prometheus.New(
+			prometheus.WithoutTargetInfo(),
+			prometheus.WithoutScopeInfo())
+		if err != nil {
+			return nil, fmt.Errorf("error creating the prometheus exporter: %w", err)
+		}
+		opts = append(opts, metric.WithReader(exporter))
+	}
 
-	exporter, err := prometheus.New(
-		prometheus.WithoutTargetInfo(),
-		prometheus.WithoutScopeInfo())
-	if err != nil {
-		log.Fatal()
+	if cfg.OTLP.Enabled {
+		reader, err := modules.NewOTLPReader(ctx, cfg.OTLP, cfg.Buffer, logger)
+		if err != nil {
+			return nil, fmt.Errorf("error creating the otlp exporter: %w", err)
+		}
+		opts = append(opts, metric.WithReader(reader))
 	}
-	provider := metric.NewMeterProvider(metric.WithReader(exporter))
-	meter := provider.Meter("telemetruum-agent")
 
-	return meter
+	if cfg.RemoteWrite.Enabled {
+		reader, err := modules.NewRemoteWriteReader(cfg.RemoteWrite, cfg.Buffer, logger)
+		if err != nil {
+			return nil, fmt.Errorf("error creating the remote write exporter: %w", err)
+		}
+		opts = append(opts, metric.WithReader(reader))
+	}
+
+	return metric.NewMeterProvider(opts...), nil
 }
 
 func main() {
@@ -87,107 +116,103 @@ func main() {
 		zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: time.RFC822},
 	).Level(zerolog.TraceLevel).With().Timestamp().Logger()
 
-	wg := &sync.WaitGroup{}
+	cfg, err := modules.LoadConfig(modules.ConfigFile())
+	if err != nil {
+		logger.Fatal().Msgf("%s", err)
+	}
+	for _, w := range cfg.Deprecations() {
+		logger.Warn().Msg(w)
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	ch := make(chan os.Signal, 1)
-	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
-
-	meter := setupOtel()
-
-	// Setup Metric Collectors
-	hicr_interval, _ := time.ParseDuration(*hostInfoInterval)
-	hicr := &modules.AsyncCollectorRunner[*modules.HostInfoCollector]{
-		Collector: &modules.HostInfoCollector{},
-		Interval:  hicr_interval,
-		Logger:    logger.With().Str("Collector", "HostInfo").Logger()}
-
-	oicr_interval, _ := time.ParseDuration(*orchInfoInterval)
-	oicr := &modules.AsyncCollectorRunner[*modules.OrchInfoCollector]{
-		Collector: &modules.OrchInfoCollector{},
-		Interval:  oicr_interval,
-		Logger:    logger.With().Str("Collector", "OrchInfo").Logger()}
-
-	wicr_interval, _ := time.ParseDuration(*workloadInfoInterval)
-	wicr := &modules.AsyncCollectorRunner[*modules.WorkloadInfoCollector]{
-		Collector: &modules.WorkloadInfoCollector{},
-		Interval:  wicr_interval,
-		Logger:    logger.With().Str("Collector", "WorkloadInfo").Logger()}
-
-	pecr_interval, _ := time.ParseDuration(*nodeMountedInterval)
-	pecr := &modules.AsyncCollectorRunner[*modules.NodeMountedCollector]{
-		Collector: &modules.NodeMountedCollector{},
-		Interval:  pecr_interval,
-		Logger:    logger.With().Str("Collector", "NodeMounted").Logger()}
-	// Setup Providers
-
-	var kubernetesProvider *modules.KubernetesProvider
-	var systemProvider *modules.SystemProvider
-	var dockerProvider *modules.DockerProvider
-	var providerErr error
-
-	if *kubernetesEnabled {
-		kubernetesProvider, providerErr = modules.InizializeKubernetesProvider(logger.With().Str("Provider", "Kubernetes").Logger())
-		if providerErr != nil {
-			logger.Warn().Msgf("Error initializing Kubernetes (\"%s\"). The Kubernetes provider will not be used", providerErr)
-		} else {
-
-			kubernetesProvider.Start(ctx, wg)
-			logger.Info().Msg("Kubernetes Provider successfully started")
-
-			oicr.AppendAsyncDataProvider(kubernetesProvider.ProvideOCMOrchInfo)
-			wicr.AppendAsyncDataProvider(kubernetesProvider.ProvideWorkloadInfo)
-			oicr.AppendAsyncDataProvider(kubernetesProvider.ProvideNuvlaOrchestratorInfo)
-		}
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
 
-	} else {
-		logger.Debug().Msg("Kubernetes Provider disabled")
+	provider, err := setupOtel(ctx, cfg, logger)
+	if err != nil {
+		logger.Fatal().Msgf("%s", err)
+	}
+	if cfg.OTLP.Enabled {
+		logger.Info().Msgf("pushing metrics with OTLP/%s to %s every %s", cfg.OTLP.Protocol, cfg.OTLP.Endpoint, time.Duration(cfg.OTLP.Interval))
+	}
+	if cfg.RemoteWrite.Enabled {
+		logger.Info().Msgf("pushing metrics with remote write to %s every %s", cfg.RemoteWrite.URL, time.Duration(cfg.RemoteWrite.Interval))
 	}
 
-	if *systemEnabled {
-		systemProvider = &modules.SystemProvider{
-			BaseProvider: modules.BaseProvider{Logger: logger.With().Str("Provider", "System").Logger()}}
-
-		systemProvider.Start(ctx, wg)
-		logger.Info().Msg("System Provider successfully started")
+	meter := provider.Meter("telemetruum-agent")
+	if err := modules.InitAgentMetrics(meter, version, commit); err != nil {
+		logger.Fatal().Msgf("Error initializing the agent metrics: %s", err)
+	}
+	if err := modules.SetRuntimeMetrics(cfg.RuntimeMetrics); err != nil {
+		logger.Warn().Msgf("Error setting up the runtime metrics: %s", err)
+	}
 
-		hicr.AppendAsyncDataProvider(systemProvider.ProvideHostInfo)
-		wicr.AppendAsyncDataProvider(systemProvider.ProvideWorkloadInfoLabels)
+	// Setup Providers and Metric Collectors
+	supervisor := modules.NewSupervisor(meter, logger)
+	supervisor.Apply(ctx, cfg)
 
-	} else {
-		logger.Debug().Msg("System Provider disabled")
+	server, err := serveMetrics(cfg, supervisor, logger)
+	if err != nil {
+		logger.Fatal().Msgf("%s", err)
 	}
 
-	if *dockerEnabled {
-		dockerProvider, providerErr = modules.InizializeDockerProvider(logger.With().Str("Provider", "Docker").Logger())
-		if providerErr != nil {
-			logger.Warn().Msgf("Error initializing Docker (\"%s\"). The Docker provider will not be used", providerErr)
-		} else {
-			dockerProvider.Start(ctx, wg)
-			logger.Info().Msg("Docker Provider successfully started")
+	for sig := range ch {
+		if sig != syscall.SIGHUP {
+			break
+		}
 
-			wicr.AppendAsyncDataProvider(dockerProvider.ProvideWorkloadInfo)
-			oicr.AppendAsyncDataProvider(dockerProvider.ProvideNuvlaOrchestratorInfo)
-			pecr.AppendAsyncDataProvider(dockerProvider.ProvideNuvlaAttachedPeripherals)
+		logger.Info().Msg("SIGHUP received, reloading the configuration")
+		newCfg, err := modules.LoadConfig(modules.ConfigFile())
+		if err != nil {
+			logger.Error().Msgf("Configuration not reloaded: %s", err)
+			continue
 		}
-	} else {
-		logger.Debug().Msg("Docker Provider disabled")
-	}
+		for _, w := range newCfg.Deprecations() {
+			logger.Warn().Msg(w)
+		}
+
+		if !reflect.DeepEqual(newCfg.Prometheus, cfg.Prometheus) || !reflect.DeepEqual(newCfg.OTLP, cfg.OTLP) ||
+			!reflect.DeepEqual(newCfg.RemoteWrite, cfg.RemoteWrite) || !reflect.DeepEqual(newCfg.Buffer, cfg.Buffer) {
+			logger.Warn().Msg("The exporters settings changed, restart the agent to apply them")
+			newCfg.Prometheus = cfg.Prometheus
+			newCfg.OTLP = cfg.OTLP
+			newCfg.RemoteWrite = cfg.RemoteWrite
+			newCfg.Buffer = cfg.Buffer
+		}
+
+		supervisor.Apply(ctx, newCfg)
 
-	// Start Metrics Collectors
+		if err := modules.SetRuntimeMetrics(newCfg.RuntimeMetrics); err != nil {
+			logger.Warn().Msgf("Error setting up the runtime metrics: %s", err)
+		}
 
-	hicr.Init(meter)
-	hicr.Start(context.TODO())
-	oicr.Init(meter)
-	oicr.Start(context.TODO())
-	wicr.Init(meter)
-	wicr.Start(context.TODO())
-	pecr.Init(meter)
-	pecr.Start(context.TODO())
+		if newCfg.Bind != cfg.Bind || !reflect.DeepEqual(newCfg.Server, cfg.Server) {
+			// a stuck request must not block the reload
+			stopCtx, stopCancel := context.WithTimeout(ctx, 10*time.Second)
+			if err := server.Shutdown(stopCtx); err != nil {
+				logger.Warn().Msgf("Error stopping the metrics server: %s", err)
+			}
+			stopCancel()
+			server, err = serveMetrics(newCfg, supervisor, logger)
+			if err != nil {
+				logger.Error().Msgf("Error restarting the metrics server, keeping the previous settings: %s", err)
+				newCfg.Bind, newCfg.Server = cfg.Bind, cfg.Server
+				if server, err = serveMetrics(newCfg, supervisor, logger); err != nil {
+					logger.Fatal().Msgf("%s", err)
+				}
+			}
+		}
 
-	go serveMetrics(logger)
+		cfg = newCfg
+	}
 
-	<-ch
 	cancel()
+	supervisor.Stop()
 
-	wg.Wait()
+	// flush the last push of the OTLP and remote write exporters
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer shutdownCancel()
+	if err := provider.Shutdown(shutdownCtx); err != nil {
+		logger.Warn().Msgf("Error shutting down the exporters: %s", err)
+	}
 }
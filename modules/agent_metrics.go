@@ -0,0 +1,213 @@
+/*
+ICOS Telemetruum Agent
+Copyright © 2022-2024 Engineering Ingegneria Informatica S.p.A.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+This work has received funding from the European Union's HORIZON research
+and innovation programme under grant agreement No. 101070177.
+*/
+
+package modules
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	prom_client "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	api "go.opentelemetry.io/otel/metric"
+)
+
+var (
+	runtimeMetrics = kingpin.Flag("runtime-metrics", "Export the Go runtime and process metrics of the agent. They are served only at /metrics, not pushed with OTLP or remote write").Default("false").Bool()
+)
+
+type agentInstruments struct {
+	callDuration metric.Float64Histogram
+	callErrors   metric.Int64Counter
+}
+
+var (
+	agentMetrics atomic.Pointer[agentInstruments]
+
+	seriesMu        sync.Mutex
+	collectorSeries = map[string]int64{}
+)
+
+// InitAgentMetrics registers the tlum_agent_* metrics, that describe the agent itself
+func InitAgentMetrics(meter metric.Meter, version string, commit string) error {
+	callDuration, err := meter.Float64Histogram("tlum_agent_provider_call_duration",
+		api.WithUnit("s"),
+		api.WithDescription("duration of the calls of the provider methods"),
+		api.WithExplicitBucketBoundaries(0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30))
+	if err != nil {
+		return err
+	}
+
+	callErrors, err := meter.Int64Counter("tlum_agent_provider_errors",
+		api.WithDescription("number of failed calls of the provider methods"))
+	if err != nil {
+		return err
+	}
+
+	lastSuccess, err := meter.Float64ObservableGauge("tlum_agent_provider_last_success_timestamp",
+		api.WithUnit("s"),
+		api.WithDescription("unix time of the last successful call of the provider methods"))
+	if err != nil {
+		return err
+	}
+
+	series, err := meter.Int64ObservableGauge("tlum_agent_collector_series",
+		api.WithDescription("number of series exported by the collectors in the last collection"))
+	if err != nil {
+		return err
+	}
+
+	buildInfo, err := meter.Int64ObservableGauge("tlum_agent_build_info",
+		api.WithDescription("info about the agent build"))
+	if err != nil {
+		return err
+	}
+
+	queueBatches, err := meter.Int64ObservableGauge("tlum_agent_export_queue_batches",
+		api.WithDescription("number of batches waiting in the on-disk queue of the push exporters"))
+	if err != nil {
+		return err
+	}
+
+	queueSize, err := meter.Int64ObservableGauge("tlum_agent_export_queue_size",
+		api.WithUnit("By"),
+		api.WithDescription("size of the on-disk queue of the push exporters"))
+	if err != nil {
+		return err
+	}
+
+	queueDropped, err := meter.Int64ObservableCounter("tlum_agent_export_queue_dropped_batches",
+		api.WithDescription("number of batches dropped from the on-disk queue of the push exporters, because it was full (size), they expired (age) or the receiver rejected them (rejected)"))
+	if err != nil {
+		return err
+	}
+
+	buildInfoOpt := api.WithAttributes(
+		attribute.Key("version").String(version),
+		attribute.Key("commit").String(commit),
+		attribute.Key("goversion").String(runtime.Version()))
+
+	_, err = meter.RegisterCallback(func(ctx context.Context, o api.Observer) error {
+		o.ObserveInt64(buildInfo, 1, buildInfoOpt)
+
+		forEachProviderCall(func(provider string, call string, t time.Time) {
+			o.ObserveFloat64(lastSuccess, float64(t.UnixNano())/1e9, api.WithAttributes(
+				attribute.Key("provider").String(provider),
+				attribute.Key("call").String(call)))
+		})
+
+		forEachExportQueue(func(exporter string, batches int64, bytes int64, dropped map[string]int64) {
+			exporterAttr := attribute.Key("exporter").String(exporter)
+			o.ObserveInt64(queueBatches, batches, api.WithAttributes(exporterAttr))
+			o.ObserveInt64(queueSize, bytes, api.WithAttributes(exporterAttr))
+			for reason, n := range dropped {
+				o.ObserveInt64(queueDropped, n, api.WithAttributes(exporterAttr, attribute.Key("reason").String(reason)))
+			}
+		})
+
+		seriesMu.Lock()
+		defer seriesMu.Unlock()
+		for name, n := range collectorSeries {
+			o.ObserveInt64(series, n, api.WithAttributes(attribute.Key("collector").String(name)))
+		}
+
+		return nil
+	}, lastSuccess, series, buildInfo, queueBatches, queueSize, queueDropped)
+	if err != nil {
+		return err
+	}
+
+	agentMetrics.Store(&agentInstruments{callDuration: callDuration, callErrors: callErrors})
+
+	return nil
+}
+
+// SetRuntimeMetrics adds or removes the Go runtime and process collectors from the Prometheus registry
+func SetRuntimeMetrics(enabled bool) error {
+	goCollector := collectors.NewGoCollector()
+	processCollector := collectors.NewProcessCollector(collectors.ProcessCollectorOpts{})
+
+	if !enabled {
+		prom_client.Unregister(goCollector)
+		prom_client.Unregister(processCollector)
+		return nil
+	}
+
+	for _, c := range []prom_client.Collector{goCollector, processCollector} {
+		if err := prom_client.Register(c); err != nil {
+			if _, ok := err.(prom_client.AlreadyRegisteredError); !ok {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func recordProviderCallMetrics(ctx context.Context, collector string, provider string, call string, duration time.Duration, err error) {
+	instruments := agentMetrics.Load()
+	if instruments == nil {
+		return
+	}
+
+	instruments.callDuration.Record(ctx, duration.Seconds(), api.WithAttributes(
+		attribute.Key("collector").String(collector),
+		attribute.Key("provider").String(provider),
+		attribute.Key("call").String(call)))
+
+	if err != nil {
+		instruments.callErrors.Add(ctx, 1, api.WithAttributes(
+			attribute.Key("provider").String(provider),
+			attribute.Key("call").String(call)))
+	}
+}
+
+func setCollectorSeries(collector string, n int64) {
+	seriesMu.Lock()
+	defer seriesMu.Unlock()
+	collectorSeries[collector] = n
+}
+
+func forgetCollectorSeries(collector string) {
+	seriesMu.Lock()
+	defer seriesMu.Unlock()
+	delete(collectorSeries, collector)
+}
+
+// countingObserver counts the observations made by a collector
+type countingObserver struct {
+	api.Observer
+	count int64
+}
+
+func (o *countingObserver) ObserveFloat64(obsrv api.Float64Observable, value float64, opts ...api.ObserveOption) {
+	o.count++
+	o.Observer.ObserveFloat64(obsrv, value, opts...)
+}
+
+func (o *countingObserver) ObserveInt64(obsrv api.Int64Observable, value int64, opts ...api.ObserveOption) {
+	o.count++
+	o.Observer.ObserveInt64(obsrv, value, opts...)
+}
@@ -0,0 +1,126 @@
+/*
+ICOS Telemetruum Agent
+Copyright © 2022-2024 Engineering Ingegneria Informatica S.p.A.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+This work has received funding from the European Union's HORIZON research
+and innovation programme under grant agreement No. 101070177.
+*/
+
+package modules
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	prom_client "github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+// findMetric returns the data of the metric with the given name, nil if it was not collected
+func findMetric(t *testing.T, reader sdkmetric.Reader, name string) metricdata.Aggregation {
+	rm := metricdata.ResourceMetrics{}
+	require.NoError(t, reader.Collect(context.Background(), &rm))
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name == name {
+				return m.Data
+			}
+		}
+	}
+	return nil
+}
+
+func attrValue(set attribute.Set, key string) string {
+	v, _ := set.Value(attribute.Key(key))
+	return v.Emit()
+}
+
+func TestAgentMetrics(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	meter := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)).Meter("test")
+	require.NoError(t, InitAgentMetrics(meter, "v1.2.3", "abc"))
+	defer agentMetrics.Store(nil)
+
+	setProviderState("AgentGood", ProviderHealthy, nil)
+	setProviderState("AgentBad", ProviderHealthy, nil)
+	runner := &AsyncCollectorRunner[*WorkloadInfoCollector]{Name: "agent-test", Schedule: Schedule{Interval: time.Hour}, Collector: &WorkloadInfoCollector{}, Logger: zerolog.Nop()}
+	runner.AppendAsyncDataProvider(DataProvider[*WorkloadInfoCollector]{Provider: "AgentGood", Name: "ProvideWorkloadInfo", Provide: func(ctx context.Context, c *WorkloadInfoCollector) error {
+		c.RunningWorkloads = []*WorkloadInfo{{Name: "web"}, {Name: "db"}}
+		return nil
+	}})
+	runner.AppendAsyncDataProvider(DataProvider[*WorkloadInfoCollector]{Provider: "AgentBad", Name: "ProvideWorkloadInfo", Provide: func(ctx context.Context, c *WorkloadInfoCollector) error {
+		return errors.New("not responding")
+	}})
+	runner.Init(meter)
+	defer runner.Close()
+	before := time.Now()
+	runner.collect(context.Background())
+
+	errorsSum := findMetric(t, reader, "tlum_agent_provider_errors").(metricdata.Sum[int64])
+	require.Len(t, errorsSum.DataPoints, 1)
+	assert.Equal(t, "AgentBad", attrValue(errorsSum.DataPoints[0].Attributes, "provider"))
+	assert.Equal(t, int64(1), errorsSum.DataPoints[0].Value)
+
+	durations := findMetric(t, reader, "tlum_agent_provider_call_duration").(metricdata.Histogram[float64])
+	require.Len(t, durations.DataPoints, 2)
+	for _, dp := range durations.DataPoints {
+		assert.Equal(t, "agent-test", attrValue(dp.Attributes, "collector"))
+		assert.Equal(t, uint64(1), dp.Count)
+	}
+
+	lastSuccess := map[string]float64{}
+	for _, dp := range findMetric(t, reader, "tlum_agent_provider_last_success_timestamp").(metricdata.Gauge[float64]).DataPoints {
+		lastSuccess[attrValue(dp.Attributes, "provider")] = dp.Value
+	}
+	assert.InDelta(t, float64(before.UnixNano())/1e9, lastSuccess["AgentGood"], 5)
+	assert.NotContains(t, lastSuccess, "AgentBad", "a provider that never succeeded has no timestamp")
+
+	series := map[string]int64{}
+	for _, dp := range findMetric(t, reader, "tlum_agent_collector_series").(metricdata.Gauge[int64]).DataPoints {
+		series[attrValue(dp.Attributes, "collector")] = dp.Value
+	}
+	assert.Equal(t, int64(2), series["agent-test"], "one series for each workload")
+
+	build := findMetric(t, reader, "tlum_agent_build_info").(metricdata.Gauge[int64]).DataPoints
+	require.Len(t, build, 1)
+	assert.Equal(t, "v1.2.3", attrValue(build[0].Attributes, "version"))
+	assert.Equal(t, "abc", attrValue(build[0].Attributes, "commit"))
+}
+
+func TestSetRuntimeMetrics(t *testing.T) {
+	registered := func() bool {
+		families, err := prom_client.DefaultGatherer.Gather()
+		require.NoError(t, err)
+		for _, f := range families {
+			if f.GetName() == "go_goroutines" {
+				return true
+			}
+		}
+		return false
+	}
+
+	require.NoError(t, SetRuntimeMetrics(true))
+	assert.True(t, registered())
+	require.NoError(t, SetRuntimeMetrics(true), "enabling twice is not an error")
+	require.NoError(t, SetRuntimeMetrics(false))
+	assert.False(t, registered())
+}
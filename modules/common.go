@@ -23,9 +23,12 @@ package modules
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"log"
 	"os"
+	"reflect"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rs/zerolog"
@@ -33,17 +36,153 @@ import (
 	api "go.opentelemetry.io/otel/metric"
 )
 
-type AsyncCollectorRunner[T AsyncCollector] struct {
+// DataProvider is a provider method feeding a collector
+type DataProvider[T any] struct {
+	// Name of the provider, used to track its status
+	Provider string
+	// Name of the method (e.g. "ProvideWorkloadInfo")
+	Name    string
+	Timeout time.Duration
+	Provide func(context.Context, T) error
+}
+
+// call runs the provider method with its deadline, turning panics into errors. If the deadline expires the
+// method is abandoned, and c must not be used anymore
+func (dp DataProvider[T]) call(ctx context.Context, c T) error {
+	if dp.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, dp.Timeout)
+		defer cancel()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- fmt.Errorf("panic: %v", r)
+			}
+		}()
+		done <- dp.Provide(ctx, c)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("not completed in %s: %w", dp.Timeout, ctx.Err())
+	}
+}
+
+// AsyncCollectorRunner periodically runs the providers of a collector. Every run starts from a clone of
+// Collector, is filled by all the providers and then atomically replaces the snapshot that is observed by
+// the OTel callback, so that a scrape never sees a partially updated collector. Each provider works on its
+// own clone, which is discarded if the provider fails: what its last successful call set is used instead,
+// unless another provider already set it in this run, so a failure leaves stale values rather than gaps in
+// the series
+type AsyncCollectorRunner[T AsyncCollector[T]] struct {
+	Schedule
+	// Name of the collector, used in the agent metrics
+	Name      string
 	Collector T
-	Interval  time.Duration
-	Providers []func(context.Context, T)
+	Providers []DataProvider[T]
 	Logger    zerolog.Logger
+
+	mu           sync.Mutex
+	snapshot     atomic.Value
+	registration metric.Registration
+	// unix nano time of the end of the last collection, 0 until the first one
+	lastCollection atomic.Int64
+	// fields set by the last successful call of each provider, only used by collect
+	contributions map[string]contribution
+}
+
+// contribution is what a provider changed in a collector: the exported fields, by index, and the peripherals of
+// each source it set, which are merged with the ones of the other providers instead of replacing them
+type contribution struct {
+	fields      map[int]reflect.Value
+	peripherals map[string][]*Peripheral
+}
+
+// peripheralCollector is implemented by the collectors whose peripherals are set by source
+type peripheralCollector interface {
+	setPeripherals(source string, peripherals []*Peripheral)
+}
+
+var peripheralsType = reflect.TypeOf([]*Peripheral(nil))
+
+func peripheralsBySource(peripherals []*Peripheral) map[string][]*Peripheral {
+	res := map[string][]*Peripheral{}
+	for _, p := range peripherals {
+		res[p.Source] = append(res[p.Source], p)
+	}
+	return res
+}
+
+// diffContribution returns what changed between two collectors
+func diffContribution(before any, after any) contribution {
+	b, a := reflect.ValueOf(before).Elem(), reflect.ValueOf(after).Elem()
+	_, bySource := after.(peripheralCollector)
+	res := contribution{fields: map[int]reflect.Value{}, peripherals: map[string][]*Peripheral{}}
+	for i := 0; i < a.NumField(); i++ {
+		if !a.Type().Field(i).IsExported() || reflect.DeepEqual(b.Field(i).Interface(), a.Field(i).Interface()) {
+			continue
+		}
+		if bySource && a.Field(i).Type() == peripheralsType {
+			old, changed := peripheralsBySource(b.Field(i).Interface().([]*Peripheral)), peripheralsBySource(a.Field(i).Interface().([]*Peripheral))
+			for source := range old {
+				if _, ok := changed[source]; !ok {
+					res.peripherals[source] = nil
+				}
+			}
+			for source, peripherals := range changed {
+				if !reflect.DeepEqual(old[source], peripherals) {
+					res.peripherals[source] = peripherals
+				}
+			}
+			continue
+		}
+		res.fields[i] = a.Field(i)
+	}
+	return res
+}
+
+// apply sets the contribution on a collector, except the fields already written in the current run, which are
+// more recent
+func (c contribution) apply(collector any, written map[int]bool) {
+	v := reflect.ValueOf(collector).Elem()
+	for i, f := range c.fields {
+		if !written[i] {
+			v.Field(i).Set(f)
+		}
+	}
+	if pc, ok := collector.(peripheralCollector); ok {
+		for source, peripherals := range c.peripherals {
+			pc.setPeripherals(source, peripherals)
+		}
+	}
 }
 
-func (c *AsyncCollectorRunner[T]) AppendAsyncDataProvider(dp func(context.Context, T)) {
+func (c *AsyncCollectorRunner[T]) AppendAsyncDataProvider(dp DataProvider[T]) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	c.Providers = append(c.Providers, dp)
 }
 
+// SetAsyncDataProviders keeps the feeds of this collector type. The list is built before being swapped, so a
+// concurrent collection sees either the old providers or the new ones
+func (c *AsyncCollectorRunner[T]) SetAsyncDataProviders(feeds []any) {
+	providers := []DataProvider[T]{}
+	for _, f := range feeds {
+		if dp, ok := f.(DataProvider[T]); ok {
+			providers = append(providers, dp)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Providers = providers
+}
+
 func (c *AsyncCollectorRunner[T]) Init(meter metric.Meter) {
 
 	if c.Interval == 0 {
@@ -51,32 +190,108 @@ func (c *AsyncCollectorRunner[T]) Init(meter metric.Meter) {
 		c.Logger.Warn().Msg("Interval was 0: set to 60s")
 	}
 
-	_, err := meter.RegisterCallback(func(ctx context.Context, o api.Observer) error {
-		c.Collector.CreateObservations(ctx, o, c.Logger)
+	instruments := c.Collector.GetMetrics(meter)
+	c.snapshot.Store(c.Collector.Clone())
+
+	registration, err := meter.RegisterCallback(func(ctx context.Context, o api.Observer) error {
+		counter := &countingObserver{Observer: o}
+		c.Snapshot().CreateObservations(ctx, counter, c.Logger)
+		setCollectorSeries(c.Name, counter.count)
 
 		return nil
-	}, c.Collector.GetMetrics(meter)...)
+	}, instruments...)
 
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	c.registration = registration
 }
 
-func (c *AsyncCollectorRunner[T]) Start(ctx context.Context) {
+// Close unregisters the collector callback, so that its metrics are no longer exported
+func (c *AsyncCollectorRunner[T]) Close() {
+	if c.registration != nil {
+		if err := c.registration.Unregister(); err != nil {
+			c.Logger.Warn().Msgf("Error unregistering collector: %s", err)
+		}
+	}
+	forgetCollectorSeries(c.Name)
+}
+
+func (c *AsyncCollectorRunner[T]) Start(ctx context.Context, wg *sync.WaitGroup) {
+	wg.Add(1)
 	go func() {
-		for {
-			for _, exec := range c.Providers {
-				exec(ctx, c.Collector)
+		defer wg.Done()
+		c.Run(ctx, c.collect)
+	}()
+}
+
+// LastCollection returns when the last collection completed, or the zero time if none did yet
+func (c *AsyncCollectorRunner[T]) LastCollection() time.Time {
+	if t := c.lastCollection.Load(); t != 0 {
+		return time.Unix(0, t)
+	}
+	return time.Time{}
+}
+
+// Snapshot returns the last complete snapshot of the collector. It must not be modified
+func (c *AsyncCollectorRunner[T]) Snapshot() T {
+	return c.snapshot.Load().(T)
+}
+
+func (c *AsyncCollectorRunner[T]) Current() any {
+	return c.Snapshot()
+}
+
+func (c *AsyncCollectorRunner[T]) collect(ctx context.Context) {
+	c.mu.Lock()
+	providers := c.Providers
+	c.mu.Unlock()
+
+	if c.contributions == nil {
+		c.contributions = map[string]contribution{}
+	}
+
+	next := c.Collector.Clone()
+	// the fields set by the providers in this run
+	written := map[int]bool{}
+	for _, dp := range providers {
+		key := dp.Provider + "." + dp.Name
+		attempt := next.Clone()
+		start := time.Now()
+		err := dp.call(ctx, attempt)
+		recordProviderCall(dp.Provider, dp.Name, err)
+		recordProviderCallMetrics(ctx, c.Name, dp.Provider, dp.Name, time.Since(start), err)
+		if err != nil {
+			c.Logger.Warn().Str("Provider", dp.Provider).Msgf("%s failed: %s", dp.Name, err)
+			if last, ok := c.contributions[key]; ok {
+				// the attempt may still be in use by an abandoned call
+				attempt = next.Clone()
+				last.apply(attempt, written)
+				next = attempt
+				for i := range last.fields {
+					written[i] = true
+				}
 			}
-			time.Sleep(c.Interval)
+			continue
 		}
-	}()
+		c.contributions[key] = diffContribution(next, attempt)
+		for i := range c.contributions[key].fields {
+			written[i] = true
+		}
+		next = attempt
+	}
+
+	c.snapshot.Store(next)
+	c.lastCollection.Store(time.Now().UnixNano())
 }
 
-type AsyncCollector interface {
+// AsyncCollector is implemented by the collectors. Clone returns a copy, sharing the instruments, that the
+// providers can fill without affecting the original
+type AsyncCollector[T any] interface {
 	CreateObservations(context.Context, api.Observer, zerolog.Logger)
 	GetMetrics(metric.Meter) []metric.Observable
+	Clone() T
 }
 
 type Provider interface {
@@ -84,7 +299,8 @@ type Provider interface {
 }
 
 type BaseProvider struct {
-	Logger zerolog.Logger
+	Logger     zerolog.Logger
+	PathRootFs string
 }
 
 type NuvlaContext struct {
@@ -92,22 +308,22 @@ type NuvlaContext struct {
 	State string `json:"state"`
 }
 
-func CommonProvideNuvlaOrchestratorInfo(ctx context.Context, nuvlaContextFile string, oic *OrchInfoCollector, logger zerolog.Logger) {
+func CommonProvideNuvlaOrchestratorInfo(ctx context.Context, nuvlaContextFile string, oic *OrchInfoCollector, logger zerolog.Logger) error {
 
 	nuvlaFile, err := os.ReadFile(nuvlaContextFile) // just pass the file name
-	if err != nil {
+	if os.IsNotExist(err) {
 		logger.Warn().Msgf("Error reading Nuvla context file at %s: %s\n", nuvlaContextFile, err)
-		return
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading Nuvla context file at %s: %w", nuvlaContextFile, err)
 	}
-
-	oic.Type = "nuvla"
 
 	nuvlaObj := &NuvlaContext{}
 	err = json.Unmarshal(nuvlaFile, &nuvlaObj)
 
 	if err != nil {
-		logger.Warn().Msgf("Error unmarshalling Nuvla context file: %s", err)
-		return
+		return fmt.Errorf("error unmarshalling Nuvla context file: %w", err)
 	}
 
 	oic.Type = "nuvla"
@@ -115,4 +331,5 @@ func CommonProvideNuvlaOrchestratorInfo(ctx context.Context, nuvlaContextFile st
 	oic.AgentName = nuvlaObj.Id
 	oic.ClusterId = nuvlaObj.Id
 
+	return nil
 }
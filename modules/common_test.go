@@ -0,0 +1,249 @@
+/*
+ICOS Telemetruum Agent
+Copyright © 2022-2024 Engineering Ingegneria Informatica S.p.A.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+This work has received funding from the European Union's HORIZON research
+and innovation programme under grant agreement No. 101070177.
+*/
+
+package modules
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+// collectDataPoints returns the data points of the given gauge
+func collectDataPoints(t *testing.T, reader sdkmetric.Reader, name string) []metricdata.DataPoint[int64] {
+	rm := metricdata.ResourceMetrics{}
+	require.NoError(t, reader.Collect(context.Background(), &rm))
+
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name == name {
+				return m.Data.(metricdata.Gauge[int64]).DataPoints
+			}
+		}
+	}
+	return nil
+}
+
+// TestRunnerSnapshots checks that scrapes only see complete snapshots. Run it with -race
+func TestRunnerSnapshots(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	meter := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)).Meter("test")
+
+	runner := &AsyncCollectorRunner[*WorkloadInfoCollector]{
+		Schedule:  Schedule{Interval: time.Millisecond, Immediate: true},
+		Collector: &WorkloadInfoCollector{},
+		Logger:    zerolog.Nop()}
+
+	run := 0
+	runner.AppendAsyncDataProvider(DataProvider[*WorkloadInfoCollector]{Provide: func(ctx context.Context, c *WorkloadInfoCollector) error {
+		run++
+		for i := 0; i < 10; i++ {
+			c.RunningWorkloads = append(c.RunningWorkloads, &WorkloadInfo{Name: fmt.Sprintf("w%d", i)})
+		}
+		c.ClusterId = fmt.Sprint(run)
+		return nil
+	}})
+	runner.AppendAsyncDataProvider(DataProvider[*WorkloadInfoCollector]{Provide: func(ctx context.Context, c *WorkloadInfoCollector) error {
+		c.HostId = c.ClusterId
+		return nil
+	}})
+	runner.Init(meter)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	runner.Start(ctx, wg)
+
+	deadline := time.Now().Add(200 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		points := collectDataPoints(t, reader, "tlum_workload_info")
+		if len(points) == 0 {
+			continue
+		}
+
+		assert.Len(t, points, 10)
+		clusterId, _ := points[0].Attributes.Value(attribute.Key("cluster_id"))
+		for _, p := range points {
+			c, _ := p.Attributes.Value(attribute.Key("cluster_id"))
+			h, _ := p.Attributes.Value(attribute.Key("host_id"))
+			assert.Equal(t, clusterId, c, "all the series should come from the same run")
+			assert.Equal(t, c, h, "all the providers should have completed the run")
+		}
+	}
+
+	cancel()
+	wg.Wait()
+}
+
+func TestRunnerProviderFailures(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	meter := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)).Meter("test")
+
+	runner := &AsyncCollectorRunner[*OrchInfoCollector]{
+		Schedule:  Schedule{Interval: time.Hour},
+		Collector: &OrchInfoCollector{},
+		Logger:    zerolog.Nop()}
+
+	setProviderState("Good", ProviderHealthy, nil)
+	setProviderState("Bad", ProviderHealthy, nil)
+
+	runner.AppendAsyncDataProvider(DataProvider[*OrchInfoCollector]{Provider: "Good", Name: "ProvideOrchInfo", Provide: func(ctx context.Context, c *OrchInfoCollector) error {
+		c.Type = "ocm"
+		c.AgentId = "agent"
+		return nil
+	}})
+	runner.AppendAsyncDataProvider(DataProvider[*OrchInfoCollector]{Provider: "Bad", Name: "ProvidePanic", Provide: func(ctx context.Context, c *OrchInfoCollector) error {
+		c.Type = "nuvla"
+		panic("boom")
+	}})
+	runner.AppendAsyncDataProvider(DataProvider[*OrchInfoCollector]{Provider: "Bad", Name: "ProvideSlowly", Timeout: 10 * time.Millisecond, Provide: func(ctx context.Context, c *OrchInfoCollector) error {
+		c.Type = "nuvla"
+		time.Sleep(time.Second)
+		return nil
+	}})
+	runner.Init(meter)
+	runner.collect(context.Background())
+
+	snapshot := runner.Snapshot()
+	assert.Equal(t, "ocm", snapshot.Type, "changes of failed providers should be discarded")
+	assert.Equal(t, "agent", snapshot.AgentId)
+
+	for _, s := range ProviderStatuses() {
+		switch s.Name {
+		case "Good":
+			assert.Equal(t, ProviderHealthy, s.State)
+		case "Bad":
+			assert.Equal(t, ProviderDegraded, s.State)
+			assert.Contains(t, s.LastError, "not completed in 10ms")
+		}
+	}
+}
+
+// TestRunnerRewire checks that the collections running during a reload never miss the providers
+func TestRunnerRewire(t *testing.T) {
+	meter := sdkmetric.NewMeterProvider(sdkmetric.WithReader(sdkmetric.NewManualReader())).Meter("test")
+	runner := &AsyncCollectorRunner[*OrchInfoCollector]{Schedule: Schedule{Interval: time.Hour}, Collector: &OrchInfoCollector{}, Logger: zerolog.Nop()}
+	runner.Init(meter)
+
+	feeds := []any{
+		DataProvider[*HostInfoCollector]{Provider: "Other", Provide: func(ctx context.Context, c *HostInfoCollector) error { return nil }},
+		DataProvider[*OrchInfoCollector]{Provider: "Good", Provide: func(ctx context.Context, c *OrchInfoCollector) error {
+			c.Type = "ocm"
+			return nil
+		}},
+	}
+	runner.SetAsyncDataProviders(feeds)
+	require.Len(t, runner.Providers, 1, "only the feeds of the collector type are kept")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		for ctx.Err() == nil {
+			runner.SetAsyncDataProviders(feeds)
+		}
+	}()
+	for i := 0; i < 1000; i++ {
+		runner.collect(context.Background())
+		require.Equal(t, "ocm", runner.Snapshot().Type)
+	}
+}
+
+// TestRunnerKeepsLastContribution checks that a failing provider leaves its last values rather than a gap
+func TestRunnerKeepsLastContribution(t *testing.T) {
+	meter := sdkmetric.NewMeterProvider(sdkmetric.WithReader(sdkmetric.NewManualReader())).Meter("test")
+	runner := &AsyncCollectorRunner[*WorkloadInfoCollector]{Schedule: Schedule{Interval: time.Hour}, Collector: &WorkloadInfoCollector{}, Logger: zerolog.Nop()}
+
+	run := 0
+	runner.AppendAsyncDataProvider(DataProvider[*WorkloadInfoCollector]{Provider: "Good", Name: "ProvideClusterId", Provide: func(ctx context.Context, c *WorkloadInfoCollector) error {
+		run++
+		c.ClusterId = fmt.Sprint(run)
+		return nil
+	}})
+	runner.AppendAsyncDataProvider(DataProvider[*WorkloadInfoCollector]{Provider: "Flaky", Name: "ProvideWorkloads", Provide: func(ctx context.Context, c *WorkloadInfoCollector) error {
+		if run > 1 {
+			c.RunningWorkloads = []*WorkloadInfo{{Name: "partial"}}
+			return errors.New("docker is not responding")
+		}
+		c.HostId = "h1"
+		c.RunningWorkloads = []*WorkloadInfo{{Name: "web"}}
+		return nil
+	}})
+	runner.Init(meter)
+
+	runner.collect(context.Background())
+	runner.collect(context.Background())
+	snapshot := runner.Snapshot()
+	assert.Equal(t, "2", snapshot.ClusterId, "the other providers are up to date")
+	assert.Equal(t, "h1", snapshot.HostId)
+	assert.Equal(t, []*WorkloadInfo{{Name: "web"}}, snapshot.RunningWorkloads, "the failed provider keeps its last values")
+}
+
+func TestRunnerKeepsOnlyTheFailedContribution(t *testing.T) {
+	meter := sdkmetric.NewMeterProvider(sdkmetric.WithReader(sdkmetric.NewManualReader())).Meter("test")
+
+	workloads := &AsyncCollectorRunner[*WorkloadInfoCollector]{Schedule: Schedule{Interval: time.Hour}, Collector: &WorkloadInfoCollector{}, Logger: zerolog.Nop()}
+	run := 0
+	workloads.AppendAsyncDataProvider(DataProvider[*WorkloadInfoCollector]{Provider: "System", Name: "ProvideHostId", Provide: func(ctx context.Context, c *WorkloadInfoCollector) error {
+		run++
+		c.HostId = fmt.Sprintf("h%d", run)
+		return nil
+	}})
+	workloads.AppendAsyncDataProvider(DataProvider[*WorkloadInfoCollector]{Provider: "Docker", Name: "ProvideWorkloadInfo", Provide: func(ctx context.Context, c *WorkloadInfoCollector) error {
+		if run > 1 {
+			return errors.New("docker is not responding")
+		}
+		c.HostId = "docker-host"
+		c.RunningWorkloads = []*WorkloadInfo{{Name: "web"}}
+		return nil
+	}})
+	workloads.Init(meter)
+	workloads.collect(context.Background())
+	workloads.collect(context.Background())
+	assert.Equal(t, "h2", workloads.Snapshot().HostId, "a field set in this run is not overwritten")
+	assert.Equal(t, []*WorkloadInfo{{Name: "web"}}, workloads.Snapshot().RunningWorkloads)
+
+	peripherals := &AsyncCollectorRunner[*NodeMountedCollector]{Schedule: Schedule{Interval: time.Hour}, Collector: &NodeMountedCollector{}, Logger: zerolog.Nop()}
+	peripherals.AppendAsyncDataProvider(DataProvider[*NodeMountedCollector]{Provider: "System", Name: "ProvideUSBPeripherals", Provide: func(ctx context.Context, c *NodeMountedCollector) error {
+		run++
+		c.setPeripherals("usb", []*Peripheral{{Device: fmt.Sprintf("usb%d", run)}})
+		return nil
+	}})
+	peripherals.AppendAsyncDataProvider(DataProvider[*NodeMountedCollector]{Provider: "Docker", Name: "ProvideNuvlaAttachedPeripherals", Provide: func(ctx context.Context, c *NodeMountedCollector) error {
+		if run > 3 {
+			return errors.New("nuvla is not responding")
+		}
+		c.setPeripherals("nuvla", []*Peripheral{{Device: "camera"}})
+		return nil
+	}})
+	peripherals.Init(meter)
+	peripherals.collect(context.Background())
+	peripherals.collect(context.Background())
+	assert.Equal(t, []*Peripheral{{Device: "usb4", Source: "usb"}, {Device: "camera", Source: "nuvla"}}, peripherals.Snapshot().AttachedPeripherals,
+		"the peripherals of the other sources are up to date")
+}
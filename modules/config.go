@@ -0,0 +1,325 @@
+/*
+ICOS Telemetruum Agent
+Copyright © 2022-2024 Engineering Ingegneria Informatica S.p.A.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+This work has received funding from the European Union's HORIZON research
+and innovation programme under grant agreement No. 101070177.
+*/
+
+package modules
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	configFile      = kingpin.Flag("config", "Path of the YAML configuration file. Values in the file take precedence over the command line flags").String()
+	bindAddress     = kingpin.Flag("bind", "Bind address").Default(":2545").String()
+	providerTimeout = kingpin.Flag("provider-timeout", "Deadline of every call of a provider. A provider that fails or exceeds it is marked as degraded").Default("30s").Duration()
+	prometheusOn    = kingpin.Flag("prometheus", "Serve the metrics at /metrics").Default("true").Bool()
+)
+
+// Duration is a time.Duration that is read from YAML as a string (e.g. "5m")
+type Duration time.Duration
+
+func (d *Duration) UnmarshalYAML(node *yaml.Node) error {
+	v, err := time.ParseDuration(node.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: invalid duration %q", node.Line, node.Value)
+	}
+	if v < 0 {
+		return fmt.Errorf("line %d: duration %q must not be negative", node.Line, node.Value)
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return time.Duration(d).String(), nil
+}
+
+// ProviderConfig holds the settings of a single provider. Unset values are taken from the command line flags
+type ProviderConfig struct {
+	Enabled *bool `yaml:"enabled"`
+	// Deadline of every call of the provider methods
+	Timeout *Duration `yaml:"timeout"`
+}
+
+// CollectorConfig holds the settings of a single collector. Unset values are taken from the command line flags
+type CollectorConfig struct {
+	Enabled     *bool     `yaml:"enabled"`
+	Interval    *Duration `yaml:"interval"`
+	StartJitter *Duration `yaml:"start_jitter"`
+	Jitter      *Duration `yaml:"jitter"`
+	Immediate   *bool     `yaml:"immediate"`
+}
+
+func (c CollectorConfig) schedule() Schedule {
+	return Schedule{
+		Interval:    time.Duration(*c.Interval),
+		StartJitter: time.Duration(*c.StartJitter),
+		Jitter:      time.Duration(*c.Jitter),
+		Immediate:   *c.Immediate,
+	}
+}
+
+// PrometheusConfig holds the settings of the Prometheus pull endpoint
+type PrometheusConfig struct {
+	Enabled bool `yaml:"enabled"`
+}
+
+// Config is the whole agent configuration. Providers and collectors are keyed by the name of their flag
+// (e.g. "docker", "host-info")
+type Config struct {
+	Bind       string         `yaml:"bind"`
+	Server     ServerConfig   `yaml:"server"`
+	PathRootFs string         `yaml:"path_rootfs"`
+	KubeConfig string         `yaml:"kube_config"`
+	HostIP     HostIPConfig   `yaml:"host_ip"`
+	Kubelet    KubeletConfig  `yaml:"kubelet"`
+	Storage    StorageConfig  `yaml:"storage"`
+	Location   LocationConfig `yaml:"location"`
+	// Instruction set extensions reported by tlum_host_cpu_flag
+	CPUFlags []string `yaml:"cpu_flags"`
+	// Interfaces of the peripherals reported by node_mounted, all if empty
+	PeripheralInterfaces []string `yaml:"peripheral_interfaces"`
+	// Interval of the full container list that reconciles the Docker events
+	DockerReconcileInterval Duration `yaml:"docker_reconcile_interval"`
+	// Export the Go runtime and process metrics of the agent
+	RuntimeMetrics bool                       `yaml:"runtime_metrics"`
+	Prometheus     PrometheusConfig           `yaml:"prometheus"`
+	OTLP           OTLPConfig                 `yaml:"otlp"`
+	RemoteWrite    RemoteWriteConfig          `yaml:"remote_write"`
+	Buffer         BufferConfig               `yaml:"buffer"`
+	Providers      map[string]ProviderConfig  `yaml:"providers"`
+	Collectors     map[string]CollectorConfig `yaml:"collectors"`
+	// Deprecated: ignored, the host ip is selected with HostIP
+	IpHint string `yaml:"ip_hint"`
+}
+
+// ConfigFile returns the path of the configuration file set with --config
+func ConfigFile() string {
+	return *configFile
+}
+
+// LoadConfig builds the configuration from the command line flags and, if path is not empty, the YAML file
+// at path. The resulting configuration is validated
+func LoadConfig(path string) (*Config, error) {
+	cfg := &Config{
+		Bind:                    *bindAddress,
+		Server:                  defaultServerConfig(),
+		PathRootFs:              *pathRootFs,
+		KubeConfig:              *kubeConfig,
+		HostIP:                  defaultHostIPConfig(),
+		IpHint:                  *ipHint,
+		Kubelet:                 defaultKubeletConfig(),
+		Storage:                 defaultStorageConfig(),
+		Location:                defaultLocationConfig(),
+		CPUFlags:                *cpuFlags,
+		PeripheralInterfaces:    *peripheralInterfaces,
+		DockerReconcileInterval: Duration(*dockerReconcileInterval),
+		RuntimeMetrics:          *runtimeMetrics,
+		Prometheus:              PrometheusConfig{Enabled: *prometheusOn},
+		OTLP:                    defaultOTLPConfig(),
+		RemoteWrite:             defaultRemoteWriteConfig(),
+		Buffer:                  defaultBufferConfig(),
+		Providers:               map[string]ProviderConfig{},
+		Collectors:              map[string]CollectorConfig{},
+	}
+
+	if path != "" {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading configuration file: %w", err)
+		}
+
+		dec := yaml.NewDecoder(bytes.NewReader(content))
+		dec.KnownFields(true)
+		if err := dec.Decode(cfg); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("error parsing configuration file %s: %w", path, err)
+		}
+	}
+
+	cfg.applyDefaults()
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// Deprecations returns a warning for each deprecated setting that is set
+func (c *Config) Deprecations() []string {
+	var warnings []string
+	if c.IpHint != "" {
+		warnings = append(warnings, "ip_hint (--ip-hint) is deprecated and ignored, the host ip is selected with host_ip (--host-ip-interface and --host-ip-cidr)")
+	}
+	return warnings
+}
+
+// ProviderEnabled tells if the provider with the given flag name is enabled
+func (c *Config) ProviderEnabled(name string) bool {
+	p := c.Providers[name]
+	return p.Enabled != nil && *p.Enabled
+}
+
+// Collector returns the settings of the collector with the given flag name
+func (c *Config) Collector(name string) CollectorConfig {
+	return c.Collectors[name]
+}
+
+func (c *Config) applyDefaults() {
+	for _, reg := range registeredProviders {
+		p := c.Providers[reg.Flag]
+		if p.Enabled == nil {
+			p.Enabled = reg.enabled
+		}
+		if p.Timeout == nil {
+			p.Timeout = (*Duration)(providerTimeout)
+		}
+		c.Providers[reg.Flag] = p
+	}
+
+	for _, reg := range registeredCollectors {
+		cc := c.Collectors[reg.flag]
+		if cc.Enabled == nil {
+			cc.Enabled = reg.enabled
+		}
+		if cc.Interval == nil {
+			cc.Interval = (*Duration)(reg.interval)
+		}
+		if cc.StartJitter == nil {
+			cc.StartJitter = (*Duration)(startJitter)
+		}
+		if cc.Jitter == nil {
+			cc.Jitter = (*Duration)(intervalJitter)
+		}
+		if cc.Immediate == nil {
+			cc.Immediate = immediateRun
+		}
+		c.Collectors[reg.flag] = cc
+	}
+}
+
+func (c *Config) validate() error {
+	var errs []error
+
+	if _, _, err := net.SplitHostPort(c.Bind); err != nil {
+		errs = append(errs, fmt.Errorf("bind: %w", err))
+	}
+
+	if err := c.Server.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("server: %w", err))
+	}
+
+	if err := c.HostIP.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("host_ip: %w", err))
+	}
+
+	if fi, err := os.Stat(c.PathRootFs); err != nil {
+		errs = append(errs, fmt.Errorf("path_rootfs: %w", err))
+	} else if !fi.IsDir() {
+		errs = append(errs, fmt.Errorf("path_rootfs: %s is not a directory", c.PathRootFs))
+	}
+
+	if c.KubeConfig != "" {
+		if _, err := os.Stat(c.KubeConfig); err != nil {
+			errs = append(errs, fmt.Errorf("kube_config: %w", err))
+		}
+	}
+
+	if err := c.Kubelet.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("kubelet: %w", err))
+	}
+
+	if err := c.Storage.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("storage: %w", err))
+	}
+
+	if err := c.Location.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("location: %w", err))
+	}
+
+	if c.DockerReconcileInterval <= 0 {
+		errs = append(errs, errors.New("docker_reconcile_interval: must be positive"))
+	}
+
+	if !c.Prometheus.Enabled && !c.OTLP.Enabled && !c.RemoteWrite.Enabled {
+		errs = append(errs, errors.New("at least one of prometheus, otlp and remote_write must be enabled"))
+	}
+
+	if err := c.OTLP.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("otlp: %w", err))
+	}
+
+	if err := c.RemoteWrite.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("remote_write: %w", err))
+	}
+
+	if err := c.Buffer.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("buffer: %w", err))
+	}
+
+	for _, name := range sortedKeys(c.Providers) {
+		if findProvider(name) == nil {
+			errs = append(errs, fmt.Errorf("providers: unknown provider %q", name))
+			continue
+		}
+
+		if *c.Providers[name].Timeout <= 0 {
+			errs = append(errs, fmt.Errorf("providers.%s.timeout: must be positive", name))
+		}
+	}
+
+	for _, name := range sortedKeys(c.Collectors) {
+		if findCollector(name) == nil {
+			errs = append(errs, fmt.Errorf("collectors: unknown collector %q", name))
+			continue
+		}
+
+		cc := c.Collectors[name]
+		if *cc.Interval <= 0 {
+			errs = append(errs, fmt.Errorf("collectors.%s.interval: must be positive", name))
+		} else if *cc.Jitter >= *cc.Interval {
+			errs = append(errs, fmt.Errorf("collectors.%s.jitter: must be lower than the interval (%s)", name, time.Duration(*cc.Interval)))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+func sortedKeys[K cmp.Ordered, V any](m map[K]V) []K {
+	keys := make([]K, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
@@ -0,0 +1,81 @@
+/*
+ICOS Telemetruum Agent
+Copyright © 2022-2024 Engineering Ingegneria Informatica S.p.A.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+This work has received funding from the European Union's HORIZON research
+and innovation programme under grant agreement No. 101070177.
+*/
+
+package modules
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	_, err := kingpin.CommandLine.Parse([]string{})
+	require.NoError(t, err)
+
+	cfg, err := LoadConfig(writeTestConfig(t, `
+bind: ":9000"
+ip_hint: 8.8.8.8:80
+providers:
+  docker:
+    enabled: false
+collectors:
+  host-info:
+    interval: 10s
+`))
+	require.NoError(t, err)
+
+	assert.Equal(t, ":9000", cfg.Bind)
+	assert.False(t, cfg.ProviderEnabled("docker"))
+	assert.True(t, cfg.ProviderEnabled("system"), "unset values should come from the flags")
+	assert.Equal(t, 10*time.Second, time.Duration(*cfg.Collector("host-info").Interval))
+	assert.Equal(t, 2*time.Minute, time.Duration(*cfg.Collector("orch-info").Interval))
+	assert.Len(t, cfg.Deprecations(), 1, "the removed ip_hint is accepted with a warning")
+}
+
+func TestLoadConfigValidation(t *testing.T) {
+	_, err := kingpin.CommandLine.Parse([]string{})
+	require.NoError(t, err)
+
+	for name, content := range map[string]string{
+		"unknown field":     "bnd: \":9000\"\n",
+		"unknown provider":  "providers:\n  podman: {enabled: true}\n",
+		"unknown collector": "collectors:\n  cpu-info: {interval: 1m}\n",
+		"invalid interval":  "collectors:\n  host-info: {interval: soon}\n",
+		"zero interval":     "collectors:\n  host-info: {interval: 0s}\n",
+		"jitter too large":  "collectors:\n  host-info: {interval: 1m, jitter: 2m}\n",
+		"invalid bind":      "bind: localhost\n",
+		"missing rootfs":    "path_rootfs: /does/not/exist\n",
+	} {
+		_, err := LoadConfig(writeTestConfig(t, content))
+		assert.Error(t, err, name)
+	}
+}
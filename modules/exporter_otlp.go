@@ -0,0 +1,159 @@
+/*
+ICOS Telemetruum Agent
+Copyright © 2022-2024 Engineering Ingegneria Informatica S.p.A.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+This work has received funding from the European Union's HORIZON research
+and innovation programme under grant agreement No. 101070177.
+*/
+
+package modules
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/sdk/metric"
+	"google.golang.org/grpc/credentials"
+	_ "google.golang.org/grpc/encoding/gzip" // registers the gzip compressor used by otlpmetricgrpc
+)
+
+var (
+	otlpEnabled     = kingpin.Flag("otlp", "Push the metrics with OTLP").Default("false").Bool()
+	otlpProtocol    = kingpin.Flag("otlp-protocol", "OTLP protocol (http or grpc)").Default("http").Enum("http", "grpc")
+	otlpEndpoint    = kingpin.Flag("otlp-endpoint", "OTLP receiver host:port").String()
+	otlpURLPath     = kingpin.Flag("otlp-url-path", "OTLP/HTTP URL path").Default("/v1/metrics").String()
+	otlpHeaders     = kingpin.Flag("otlp-header", "Header sent with every OTLP request (e.g. Authorization=Bearer ...). Can be repeated").StringMap()
+	otlpInterval    = kingpin.Flag("otlp-interval", "Interval between two OTLP pushes").Default("1m").Duration()
+	otlpCompression = kingpin.Flag("otlp-compression", "OTLP compression (none or gzip)").Default("gzip").Enum("none", "gzip")
+	otlpInsecure    = kingpin.Flag("otlp-insecure", "Use plain text connections to the OTLP receiver").Default("false").Bool()
+	otlpCAFile      = kingpin.Flag("otlp-ca-file", "CA bundle used to verify the OTLP receiver certificate").String()
+	otlpCertFile    = kingpin.Flag("otlp-cert-file", "Client certificate used to authenticate with the OTLP receiver").String()
+	otlpKeyFile     = kingpin.Flag("otlp-key-file", "Key of the client certificate used to authenticate with the OTLP receiver").String()
+)
+
+// OTLPConfig holds the settings of the OTLP push exporter
+type OTLPConfig struct {
+	Enabled     bool              `yaml:"enabled"`
+	Protocol    string            `yaml:"protocol"`
+	Endpoint    string            `yaml:"endpoint"`
+	URLPath     string            `yaml:"url_path"`
+	Headers     map[string]string `yaml:"headers"`
+	Interval    Duration          `yaml:"interval"`
+	Compression string            `yaml:"compression"`
+	Insecure    bool              `yaml:"insecure"`
+	TLS         TLSClientConfig   `yaml:"tls"`
+}
+
+func defaultOTLPConfig() OTLPConfig {
+	return OTLPConfig{
+		Enabled:     *otlpEnabled,
+		Protocol:    *otlpProtocol,
+		Endpoint:    *otlpEndpoint,
+		URLPath:     *otlpURLPath,
+		Headers:     maps.Clone(*otlpHeaders),
+		Interval:    Duration(*otlpInterval),
+		Compression: *otlpCompression,
+		Insecure:    *otlpInsecure,
+		TLS:         TLSClientConfig{CAFile: *otlpCAFile, CertFile: *otlpCertFile, KeyFile: *otlpKeyFile},
+	}
+}
+
+func (c OTLPConfig) validate() error {
+	if !c.Enabled {
+		return nil
+	}
+
+	var errs []error
+
+	if c.Protocol != "http" && c.Protocol != "grpc" {
+		errs = append(errs, fmt.Errorf("protocol: must be http or grpc, not %q", c.Protocol))
+	}
+	if c.Compression != "none" && c.Compression != "gzip" {
+		errs = append(errs, fmt.Errorf("compression: must be none or gzip, not %q", c.Compression))
+	}
+	if c.Endpoint == "" {
+		errs = append(errs, errors.New("endpoint: must be set"))
+	}
+	if c.Interval <= 0 {
+		errs = append(errs, errors.New("interval: must be positive"))
+	}
+	if err := c.TLS.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("tls: %w", err))
+	}
+
+	return errors.Join(errs...)
+}
+
+// NewOTLPReader returns a reader that periodically pushes the metrics to an OTLP receiver. If the buffer is
+// enabled, the batches are queued on disk and sent in order as soon as the receiver is reachable
+func NewOTLPReader(ctx context.Context, c OTLPConfig, buffer BufferConfig, logger zerolog.Logger) (metric.Reader, error) {
+	var exporter metric.Exporter
+	var err error
+	if buffer.Enabled() {
+		exporter, err = newOTLPBufferedExporter(ctx, c, buffer, logger)
+	} else {
+		exporter, err = newOTLPExporter(ctx, c)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return metric.NewPeriodicReader(exporter, metric.WithInterval(time.Duration(c.Interval))), nil
+}
+
+func newOTLPExporter(ctx context.Context, c OTLPConfig) (metric.Exporter, error) {
+	tlsCfg, err := c.TLS.Build()
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Protocol == "grpc" {
+		opts := []otlpmetricgrpc.Option{
+			otlpmetricgrpc.WithEndpoint(c.Endpoint),
+			otlpmetricgrpc.WithHeaders(c.Headers),
+		}
+		if c.Compression == "gzip" {
+			opts = append(opts, otlpmetricgrpc.WithCompressor("gzip"))
+		}
+		if c.Insecure {
+			opts = append(opts, otlpmetricgrpc.WithInsecure())
+		} else {
+			opts = append(opts, otlpmetricgrpc.WithTLSCredentials(credentials.NewTLS(tlsCfg)))
+		}
+		return otlpmetricgrpc.New(ctx, opts...)
+	}
+
+	opts := []otlpmetrichttp.Option{
+		otlpmetrichttp.WithEndpoint(c.Endpoint),
+		otlpmetrichttp.WithURLPath(c.URLPath),
+		otlpmetrichttp.WithHeaders(c.Headers),
+	}
+	if c.Compression == "gzip" {
+		opts = append(opts, otlpmetrichttp.WithCompression(otlpmetrichttp.GzipCompression))
+	}
+	if c.Insecure {
+		opts = append(opts, otlpmetrichttp.WithInsecure())
+	} else {
+		opts = append(opts, otlpmetrichttp.WithTLSClientConfig(tlsCfg))
+	}
+	return otlpmetrichttp.New(ctx, opts...)
+}
@@ -0,0 +1,214 @@
+/*
+ICOS Telemetruum Agent
+Copyright © 2022-2024 Engineering Ingegneria Informatica S.p.A.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+This work has received funding from the European Union's HORIZON research
+and innovation programme under grant agreement No. 101070177.
+*/
+
+package modules
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/sdk/metric"
+	colmetricpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// otlpBufferedExporter is the stock OTLP/gRPC exporter with the disk queue in front of the wire: the requests
+// it encodes are captured on a connection that never dials, queued on disk as ExportMetricsServiceRequest
+// protobufs and sent in order to the receiver with the configured protocol
+type otlpBufferedExporter struct {
+	metric.Exporter
+	queue   *diskQueue
+	capture *grpc.ClientConn
+	close   func() error
+}
+
+func newOTLPBufferedExporter(ctx context.Context, c OTLPConfig, buffer BufferConfig, logger zerolog.Logger) (*otlpBufferedExporter, error) {
+	tlsCfg, err := c.TLS.Build()
+	if err != nil {
+		return nil, err
+	}
+
+	e := &otlpBufferedExporter{}
+	var send func(ctx context.Context, batch []byte) error
+
+	if c.Protocol == "grpc" {
+		creds := credentials.NewTLS(tlsCfg)
+		if c.Insecure {
+			creds = insecure.NewCredentials()
+		}
+		conn, err := grpc.Dial(c.Endpoint, grpc.WithTransportCredentials(creds))
+		if err != nil {
+			return nil, fmt.Errorf("error connecting to the otlp receiver: %w", err)
+		}
+		send = otlpGRPCSender(c, colmetricpb.NewMetricsServiceClient(conn))
+		e.close = conn.Close
+	} else {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsCfg
+		client := &http.Client{Transport: transport, Timeout: 30 * time.Second}
+		send = otlpHTTPSender(c, client)
+		e.close = func() error {
+			client.CloseIdleConnections()
+			return nil
+		}
+	}
+
+	e.queue, err = newDiskQueue("otlp", buffer, defaultMinBackoff, defaultMaxBackoff, send, logger)
+	if err != nil {
+		_ = e.close()
+		return nil, err
+	}
+
+	// the connection is lazy and the interceptor never invokes it, so nothing is dialed
+	e.capture, err = grpc.Dial("passthrough:///otlp-buffer",
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithUnaryInterceptor(e.enqueue))
+	if err == nil {
+		e.Exporter, err = otlpmetricgrpc.New(ctx,
+			otlpmetricgrpc.WithGRPCConn(e.capture),
+			otlpmetricgrpc.WithRetry(otlpmetricgrpc.RetryConfig{Enabled: false}))
+	}
+	if err != nil {
+		_ = e.Shutdown(ctx)
+		return nil, err
+	}
+	return e, nil
+}
+
+// enqueue replaces the export call of the stock exporter with a push of the encoded request to the queue
+func (e *otlpBufferedExporter) enqueue(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	msg, ok := req.(proto.Message)
+	if !ok {
+		return fmt.Errorf("unexpected otlp request %T", req)
+	}
+	batch, err := proto.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return e.queue.Push(batch)
+}
+
+func (e *otlpBufferedExporter) Shutdown(ctx context.Context) error {
+	var errs []error
+	if e.Exporter != nil {
+		errs = append(errs, e.Exporter.Shutdown(ctx))
+	}
+	if e.capture != nil {
+		errs = append(errs, e.capture.Close())
+	}
+	e.queue.Close()
+	errs = append(errs, e.close())
+	return errors.Join(errs...)
+}
+
+func otlpHTTPSender(c OTLPConfig, client *http.Client) func(ctx context.Context, batch []byte) error {
+	scheme := "https"
+	if c.Insecure {
+		scheme = "http"
+	}
+	url := scheme + "://" + c.Endpoint + c.URLPath
+
+	return func(ctx context.Context, batch []byte) error {
+		body := batch
+		if c.Compression == "gzip" {
+			var buf bytes.Buffer
+			gz := gzip.NewWriter(&buf)
+			if _, err := gz.Write(batch); err != nil {
+				return err
+			}
+			if err := gz.Close(); err != nil {
+				return err
+			}
+			body = buf.Bytes()
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return permanentError{err}
+		}
+		for k, v := range c.Headers {
+			req.Header.Set(k, v)
+		}
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		req.Header.Set("User-Agent", "telemetruum-agent")
+		if c.Compression == "gzip" {
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode/100 == 2 {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			return nil
+		}
+
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+		err = fmt.Errorf("otlp receiver returned %s: %s", resp.Status, bytes.TrimSpace(respBody))
+		if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusTooManyRequests {
+			return permanentError{err}
+		}
+		return err
+	}
+}
+
+func otlpGRPCSender(c OTLPConfig, client colmetricpb.MetricsServiceClient) func(ctx context.Context, batch []byte) error {
+	var opts []grpc.CallOption
+	if c.Compression == "gzip" {
+		opts = append(opts, grpc.UseCompressor("gzip"))
+	}
+
+	return func(ctx context.Context, batch []byte) error {
+		req := &colmetricpb.ExportMetricsServiceRequest{}
+		if err := proto.Unmarshal(batch, req); err != nil {
+			return permanentError{err}
+		}
+
+		ctx, cancel := context.WithTimeout(metadata.NewOutgoingContext(ctx, metadata.New(c.Headers)), 30*time.Second)
+		defer cancel()
+
+		_, err := client.Export(ctx, req, opts...)
+		switch status.Code(err) {
+		case codes.OK:
+			return nil
+		case codes.InvalidArgument, codes.Unauthenticated, codes.PermissionDenied, codes.Unimplemented:
+			return permanentError{err}
+		default:
+			return err
+		}
+	}
+}
@@ -0,0 +1,165 @@
+/*
+ICOS Telemetruum Agent
+Copyright © 2022-2024 Engineering Ingegneria Informatica S.p.A.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+This work has received funding from the European Union's HORIZON research
+and innovation programme under grant agreement No. 101070177.
+*/
+
+package modules
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	colmetricpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+// otlpRequest is what the receiver stubs got
+type otlpRequest struct {
+	header  string
+	metrics []string
+}
+
+func metricNames(req *colmetricpb.ExportMetricsServiceRequest) []string {
+	names := []string{}
+	for _, rm := range req.ResourceMetrics {
+		for _, sm := range rm.ScopeMetrics {
+			for _, m := range sm.Metrics {
+				names = append(names, m.Name)
+			}
+		}
+	}
+	return names
+}
+
+// startHTTPReceiver starts an OTLP/HTTP receiver stub and returns its host:port
+func startHTTPReceiver(t *testing.T, received chan<- otlpRequest) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/custom/v1/metrics", r.URL.Path)
+
+		body := r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(r.Body)
+			require.NoError(t, err)
+			body = gz
+		}
+		content, err := io.ReadAll(body)
+		require.NoError(t, err)
+
+		req := &colmetricpb.ExportMetricsServiceRequest{}
+		require.NoError(t, proto.Unmarshal(content, req))
+		received <- otlpRequest{header: r.Header.Get("X-Tenant"), metrics: metricNames(req)}
+
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		_, _ = w.Write([]byte{})
+	}))
+	t.Cleanup(server.Close)
+
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+type grpcReceiver struct {
+	colmetricpb.UnimplementedMetricsServiceServer
+	received chan<- otlpRequest
+}
+
+func (g *grpcReceiver) Export(ctx context.Context, req *colmetricpb.ExportMetricsServiceRequest) (*colmetricpb.ExportMetricsServiceResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	header := ""
+	if v := md.Get("x-tenant"); len(v) > 0 {
+		header = v[0]
+	}
+	g.received <- otlpRequest{header: header, metrics: metricNames(req)}
+	return &colmetricpb.ExportMetricsServiceResponse{}, nil
+}
+
+// startGRPCReceiver starts an OTLP/gRPC receiver stub and returns its host:port
+func startGRPCReceiver(t *testing.T, received chan<- otlpRequest) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	server := grpc.NewServer()
+	colmetricpb.RegisterMetricsServiceServer(server, &grpcReceiver{received: received})
+	go func() { _ = server.Serve(lis) }()
+	t.Cleanup(server.Stop)
+
+	return lis.Addr().String()
+}
+
+func TestOTLPReader(t *testing.T) {
+	for _, name := range []string{"http", "grpc", "http-buffered", "grpc-buffered"} {
+		t.Run(name, func(t *testing.T) {
+			protocol, buffered, _ := strings.Cut(name, "-")
+
+			received := make(chan otlpRequest, 10)
+
+			var endpoint string
+			if protocol == "http" {
+				endpoint = startHTTPReceiver(t, received)
+			} else {
+				endpoint = startGRPCReceiver(t, received)
+			}
+
+			cfg := OTLPConfig{
+				Enabled:     true,
+				Protocol:    protocol,
+				Endpoint:    endpoint,
+				URLPath:     "/custom/v1/metrics",
+				Headers:     map[string]string{"X-Tenant": "edge"},
+				Interval:    Duration(50 * time.Millisecond),
+				Compression: "gzip",
+				Insecure:    true,
+			}
+			require.NoError(t, cfg.validate())
+
+			buffer := BufferConfig{}
+			if buffered != "" {
+				buffer = BufferConfig{Directory: t.TempDir(), MaxSizeMB: 1, MaxAge: Duration(time.Hour)}
+			}
+
+			reader, err := NewOTLPReader(context.Background(), cfg, buffer, zerolog.Nop())
+			require.NoError(t, err)
+			provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+			defer func() { _ = provider.Shutdown(context.Background()) }()
+
+			counter, err := provider.Meter("test").Int64Counter("tlum_test_pushes")
+			require.NoError(t, err)
+			counter.Add(context.Background(), 1)
+
+			select {
+			case req := <-received:
+				assert.Equal(t, "edge", req.header)
+				assert.Contains(t, req.metrics, "tlum_test_pushes")
+			case <-time.After(5 * time.Second):
+				t.Fatal("no metrics pushed to the receiver")
+			}
+		})
+	}
+}
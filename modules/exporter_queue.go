@@ -0,0 +1,400 @@
+/*
+ICOS Telemetruum Agent
+Copyright © 2022-2024 Engineering Ingegneria Informatica S.p.A.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+This work has received funding from the European Union's HORIZON research
+and innovation programme under grant agreement No. 101070177.
+*/
+
+package modules
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/rs/zerolog"
+)
+
+var (
+	bufferDir     = kingpin.Flag("buffer-dir", "Directory where the push exporters queue the batches that could not be sent yet. Batches are sent directly if empty").PlaceHolder("DIR").String()
+	bufferMaxSize = kingpin.Flag("buffer-max-size-mb", "Maximum size of the queue of every push exporter. The oldest batches are dropped when it is exceeded").Default("256").Int64()
+	bufferMaxAge  = kingpin.Flag("buffer-max-age", "Maximum age of the queued batches. Older batches are dropped").Default("24h").Duration()
+)
+
+const batchSuffix = ".batch"
+
+// BufferConfig holds the settings of the on-disk queues of the push exporters. Every exporter has its own
+// queue, in a subdirectory of Directory
+type BufferConfig struct {
+	Directory string   `yaml:"directory"`
+	MaxSizeMB int64    `yaml:"max_size_mb"`
+	MaxAge    Duration `yaml:"max_age"`
+}
+
+func defaultBufferConfig() BufferConfig {
+	return BufferConfig{
+		Directory: *bufferDir,
+		MaxSizeMB: *bufferMaxSize,
+		MaxAge:    Duration(*bufferMaxAge),
+	}
+}
+
+// Enabled tells if the batches are queued on disk
+func (c BufferConfig) Enabled() bool {
+	return c.Directory != ""
+}
+
+func (c BufferConfig) validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+
+	var errs []error
+	if c.MaxSizeMB <= 0 {
+		errs = append(errs, errors.New("max_size_mb: must be positive"))
+	}
+	if c.MaxAge <= 0 {
+		errs = append(errs, errors.New("max_age: must be positive"))
+	}
+	return errors.Join(errs...)
+}
+
+var (
+	queuesMu     sync.Mutex
+	exportQueues = map[string]*diskQueue{}
+)
+
+// forEachExportQueue calls fn with the state of every on-disk queue
+func forEachExportQueue(fn func(exporter string, batches int64, bytes int64, dropped map[string]int64)) {
+	queuesMu.Lock()
+	defer queuesMu.Unlock()
+
+	for name, q := range exportQueues {
+		batches, bytes := q.depth()
+		fn(name, batches, bytes, map[string]int64{
+			"size":     q.droppedSize.Load(),
+			"age":      q.droppedAge.Load(),
+			"rejected": q.droppedRejected.Load(),
+		})
+	}
+}
+
+type queuedBatch struct {
+	seq     uint64
+	created time.Time
+	size    int64
+}
+
+// diskQueue is a bounded write-ahead queue of outgoing batches. Every batch is a file named after its sequence
+// number and creation time, so that the queue survives restarts and is always replayed in order
+type diskQueue struct {
+	name       string
+	dir        string
+	maxSize    int64
+	maxAge     time.Duration
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	send       func(ctx context.Context, batch []byte) error
+	logger     zerolog.Logger
+
+	mu      sync.Mutex
+	nextSeq uint64
+	size    int64
+	batches []queuedBatch
+	notify  chan struct{}
+
+	droppedSize     atomic.Int64
+	droppedAge      atomic.Int64
+	droppedRejected atomic.Int64
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// newDiskQueue opens the queue of the given exporter, loading the batches left by a previous run, and starts
+// sending them with send. An error of type permanentError drops the batch, other errors are retried
+func newDiskQueue(name string, cfg BufferConfig, minBackoff time.Duration, maxBackoff time.Duration,
+	send func(ctx context.Context, batch []byte) error, logger zerolog.Logger) (*diskQueue, error) {
+
+	q := &diskQueue{
+		name:       name,
+		dir:        filepath.Join(cfg.Directory, name),
+		maxSize:    cfg.MaxSizeMB << 20,
+		maxAge:     time.Duration(cfg.MaxAge),
+		minBackoff: minBackoff,
+		maxBackoff: maxBackoff,
+		send:       send,
+		logger:     logger.With().Str("queue", name).Logger(),
+		notify:     make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+
+	if err := os.MkdirAll(q.dir, 0o750); err != nil {
+		return nil, fmt.Errorf("error creating the queue directory: %w", err)
+	}
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+	if len(q.batches) > 0 {
+		q.logger.Info().Msgf("%d batches (%d bytes) left by a previous run will be replayed", len(q.batches), q.size)
+	}
+
+	queuesMu.Lock()
+	exportQueues[name] = q
+	queuesMu.Unlock()
+
+	var ctx context.Context
+	ctx, q.cancel = context.WithCancel(context.Background())
+	go q.run(ctx)
+
+	return q, nil
+}
+
+func (q *diskQueue) load() error {
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		return fmt.Errorf("error reading the queue directory: %w", err)
+	}
+
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		if strings.HasSuffix(e.Name(), ".tmp") {
+			// left by a crash while writing
+			_ = os.Remove(filepath.Join(q.dir, e.Name()))
+			continue
+		}
+
+		b, ok := parseBatchName(e.Name())
+		if !ok {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		b.size = info.Size()
+		if b.size == 0 {
+			// left by a power loss before the batches were synced
+			_ = os.Remove(filepath.Join(q.dir, e.Name()))
+			continue
+		}
+
+		q.batches = append(q.batches, b)
+		q.size += b.size
+	}
+
+	sort.Slice(q.batches, func(i, j int) bool { return q.batches[i].seq < q.batches[j].seq })
+	if len(q.batches) > 0 {
+		q.nextSeq = q.batches[len(q.batches)-1].seq + 1
+	}
+	return nil
+}
+
+// parseBatchName parses the <seq>-<unix nano>.batch name of a batch file
+func parseBatchName(name string) (queuedBatch, bool) {
+	seq, created, ok := strings.Cut(strings.TrimSuffix(name, batchSuffix), "-")
+	if !ok || !strings.HasSuffix(name, batchSuffix) {
+		return queuedBatch{}, false
+	}
+
+	s, err := strconv.ParseUint(seq, 10, 64)
+	if err != nil {
+		return queuedBatch{}, false
+	}
+	c, err := strconv.ParseInt(created, 10, 64)
+	if err != nil {
+		return queuedBatch{}, false
+	}
+	return queuedBatch{seq: s, created: time.Unix(0, c)}, true
+}
+
+func (q *diskQueue) path(b queuedBatch) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d-%d"+batchSuffix, b.seq, b.created.UnixNano()))
+}
+
+// Push writes a batch at the end of the queue, dropping the oldest ones if the queue is full
+func (q *diskQueue) Push(batch []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	b := queuedBatch{seq: q.nextSeq, created: time.Now(), size: int64(len(batch))}
+	path := q.path(b)
+
+	if err := writeFileSync(path+".tmp", batch); err != nil {
+		_ = os.Remove(path + ".tmp")
+		return fmt.Errorf("error queueing the batch: %w", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("error queueing the batch: %w", err)
+	}
+	// the rename is only durable once the directory is synced
+	if err := syncDir(q.dir); err != nil {
+		return fmt.Errorf("error queueing the batch: %w", err)
+	}
+
+	q.nextSeq++
+	q.batches = append(q.batches, b)
+	q.size += b.size
+
+	for q.size > q.maxSize && len(q.batches) > 0 {
+		q.logger.Warn().Msgf("queue is full, dropping the oldest batch (%d bytes)", q.batches[0].size)
+		q.removeLocked()
+		q.droppedSize.Add(1)
+	}
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// writeFileSync writes a file and flushes it to the disk, so that a power loss after the rename can't leave an
+// empty or truncated batch
+func writeFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// removeLocked removes the oldest batch
+func (q *diskQueue) removeLocked() {
+	b := q.batches[0]
+	if err := os.Remove(q.path(b)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		q.logger.Warn().Msgf("error removing batch %d: %s", b.seq, err)
+	}
+	q.batches = q.batches[1:]
+	q.size -= b.size
+}
+
+func (q *diskQueue) depth() (int64, int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return int64(len(q.batches)), q.size
+}
+
+// oldest returns the oldest batch that is not expired, dropping the expired ones
+func (q *diskQueue) oldest() (queuedBatch, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.batches) > 0 && time.Since(q.batches[0].created) > q.maxAge {
+		q.logger.Warn().Msgf("dropping batch %d, queued at %s", q.batches[0].seq, q.batches[0].created.Format(time.RFC3339))
+		q.removeLocked()
+		q.droppedAge.Add(1)
+	}
+
+	if len(q.batches) == 0 {
+		return queuedBatch{}, false
+	}
+	return q.batches[0], true
+}
+
+// sent removes b if it is still the oldest batch, i.e. it was not dropped while it was being sent
+func (q *diskQueue) sent(b queuedBatch) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.batches) > 0 && q.batches[0].seq == b.seq {
+		q.removeLocked()
+	}
+}
+
+func (q *diskQueue) run(ctx context.Context) {
+	defer close(q.done)
+
+	backoff := q.minBackoff
+	for {
+		b, ok := q.oldest()
+		if !ok {
+			select {
+			case <-ctx.Done():
+				return
+			case <-q.notify:
+				continue
+			}
+		}
+
+		batch, err := os.ReadFile(q.path(b))
+		if err == nil {
+			err = q.send(ctx, batch)
+		} else {
+			err = permanentError{err}
+		}
+
+		var perm permanentError
+		switch {
+		case err == nil:
+			q.sent(b)
+			backoff = q.minBackoff
+		case errors.As(err, &perm):
+			q.logger.Warn().Msgf("dropping batch %d: %s", b.seq, err)
+			q.sent(b)
+			q.droppedRejected.Add(1)
+		default:
+			if ctx.Err() != nil {
+				return
+			}
+			q.logger.Debug().Msgf("error sending batch %d, retrying in %s: %s", b.seq, backoff, err)
+			if !sleepContext(ctx, backoff) {
+				return
+			}
+			backoff = min(backoff*2, q.maxBackoff)
+		}
+	}
+}
+
+// Close stops sending the batches. The queued ones are kept on disk for the next run
+func (q *diskQueue) Close() {
+	q.cancel()
+	<-q.done
+
+	queuesMu.Lock()
+	defer queuesMu.Unlock()
+	if exportQueues[q.name] == q {
+		delete(exportQueues, q.name)
+	}
+}
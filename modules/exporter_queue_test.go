@@ -0,0 +1,116 @@
+/*
+ICOS Telemetruum Agent
+Copyright © 2022-2024 Engineering Ingegneria Informatica S.p.A.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+This work has received funding from the European Union's HORIZON research
+and innovation programme under grant agreement No. 101070177.
+*/
+
+package modules
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiskQueueReplay(t *testing.T) {
+	cfg := BufferConfig{Directory: t.TempDir(), MaxSizeMB: 1, MaxAge: Duration(time.Hour)}
+
+	offline := func(ctx context.Context, batch []byte) error {
+		return errors.New("connection refused")
+	}
+	q, err := newDiskQueue("test", cfg, time.Hour, time.Hour, offline, zerolog.Nop())
+	require.NoError(t, err)
+	for _, b := range []string{"b0", "b1", "b2"} {
+		require.NoError(t, q.Push([]byte(b)))
+	}
+	q.Close()
+	require.NoError(t, os.WriteFile(filepath.Join(q.dir, "00000000000000000009-1"+batchSuffix), nil, 0o600))
+
+	// the batches are replayed in order by the next run, empty ones are discarded
+	mu := sync.Mutex{}
+	received := []string{}
+	online := func(ctx context.Context, batch []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, string(batch))
+		return nil
+	}
+	q, err = newDiskQueue("test", cfg, time.Millisecond, time.Millisecond, online, zerolog.Nop())
+	require.NoError(t, err)
+	defer q.Close()
+	require.NoError(t, q.Push([]byte("b3")))
+
+	assert.Eventually(t, func() bool {
+		batches, _ := q.depth()
+		return batches == 0
+	}, 5*time.Second, time.Millisecond)
+
+	mu.Lock()
+	assert.Equal(t, []string{"b0", "b1", "b2", "b3"}, received)
+	mu.Unlock()
+
+	entries, err := os.ReadDir(q.dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries, "sent batches should be removed from disk")
+}
+
+func TestDiskQueueLimits(t *testing.T) {
+	cfg := BufferConfig{Directory: t.TempDir(), MaxSizeMB: 1, MaxAge: Duration(50 * time.Millisecond)}
+
+	rejected := func(ctx context.Context, batch []byte) error {
+		if bytes.Equal(batch, []byte("bad")) {
+			return permanentError{errors.New("400 Bad Request")}
+		}
+		return errors.New("connection refused")
+	}
+	q, err := newDiskQueue("test", cfg, time.Millisecond, time.Millisecond, rejected, zerolog.Nop())
+	require.NoError(t, err)
+	defer q.Close()
+
+	// the oldest batch is dropped when the queue exceeds 1MB
+	big := bytes.Repeat([]byte{'x'}, 400<<10)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, q.Push(big))
+	}
+	batches, size := q.depth()
+	assert.Equal(t, int64(2), batches)
+	assert.Equal(t, int64(800<<10), size)
+	assert.Equal(t, int64(1), q.droppedSize.Load())
+
+	// expired batches are dropped before being sent
+	time.Sleep(60 * time.Millisecond)
+	_, ok := q.oldest()
+	assert.False(t, ok)
+	assert.Equal(t, int64(2), q.droppedAge.Load())
+
+	// rejected batches are dropped
+	require.NoError(t, q.Push([]byte("bad")))
+	assert.Eventually(t, func() bool {
+		return q.droppedRejected.Load() == 1
+	}, 5*time.Second, time.Millisecond)
+	batches, _ = q.depth()
+	assert.Equal(t, int64(0), batches)
+}
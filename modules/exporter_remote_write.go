@@ -0,0 +1,528 @@
+/*
+ICOS Telemetruum Agent
+Copyright © 2022-2024 Engineering Ingegneria Informatica S.p.A.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+This work has received funding from the European Union's HORIZON research
+and innovation programme under grant agreement No. 101070177.
+*/
+
+package modules
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/golang/snappy"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var (
+	remoteWriteEnabled   = kingpin.Flag("remote-write", "Push the metrics with Prometheus remote write").Default("false").Bool()
+	remoteWriteURL       = kingpin.Flag("remote-write-url", "URL of the remote write receiver (e.g. https://aggregator/api/v1/write)").PlaceHolder("URL").String()
+	remoteWriteInterval  = kingpin.Flag("remote-write-interval", "Interval between two remote write pushes").Default("1m").Duration()
+	remoteWriteTimeout   = kingpin.Flag("remote-write-timeout", "Deadline of every remote write request").Default("30s").Duration()
+	remoteWriteRetries   = kingpin.Flag("remote-write-max-retries", "Retries of a failed remote write request. Requests rejected with a 4xx status are not retried").Default("5").Int()
+	remoteWriteLabels    = kingpin.Flag("remote-write-external-label", "Label added to every pushed series (e.g. node=edge-1). Can be repeated").PlaceHolder("NAME=VALUE").StringMap()
+	remoteWriteUsername  = kingpin.Flag("remote-write-username", "Username for the basic authentication with the remote write receiver").PlaceHolder("USER").String()
+	remoteWritePassword  = kingpin.Flag("remote-write-password-file", "File with the password for the basic authentication with the remote write receiver").PlaceHolder("FILE").String()
+	remoteWriteTokenFile = kingpin.Flag("remote-write-bearer-token-file", "File with the bearer token used to authenticate with the remote write receiver").PlaceHolder("FILE").String()
+	remoteWriteCAFile    = kingpin.Flag("remote-write-ca-file", "CA bundle used to verify the remote write receiver certificate").PlaceHolder("FILE").String()
+	remoteWriteCertFile  = kingpin.Flag("remote-write-cert-file", "Client certificate used to authenticate with the remote write receiver").PlaceHolder("FILE").String()
+	remoteWriteKeyFile   = kingpin.Flag("remote-write-key-file", "Key of the client certificate used to authenticate with the remote write receiver").PlaceHolder("FILE").String()
+)
+
+var (
+	invalidNameChars  = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
+	invalidLabelChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+	labelName         = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// BasicAuth holds the credentials for HTTP basic authentication. The password can be read from a file, that
+// is read again at every request
+type BasicAuth struct {
+	Username     string `yaml:"username"`
+	Password     string `yaml:"password"`
+	PasswordFile string `yaml:"password_file"`
+}
+
+// RemoteWriteConfig holds the settings of the Prometheus remote write exporter
+type RemoteWriteConfig struct {
+	Enabled  bool     `yaml:"enabled"`
+	URL      string   `yaml:"url"`
+	Interval Duration `yaml:"interval"`
+	// Deadline of every request
+	Timeout        Duration          `yaml:"timeout"`
+	ExternalLabels map[string]string `yaml:"external_labels"`
+	BasicAuth      BasicAuth         `yaml:"basic_auth"`
+	// The token file is read again at every request
+	BearerToken     string          `yaml:"bearer_token"`
+	BearerTokenFile string          `yaml:"bearer_token_file"`
+	MaxRetries      int             `yaml:"max_retries"`
+	MinBackoff      Duration        `yaml:"min_backoff"`
+	MaxBackoff      Duration        `yaml:"max_backoff"`
+	TLS             TLSClientConfig `yaml:"tls"`
+}
+
+func defaultRemoteWriteConfig() RemoteWriteConfig {
+	return RemoteWriteConfig{
+		Enabled:         *remoteWriteEnabled,
+		URL:             *remoteWriteURL,
+		Interval:        Duration(*remoteWriteInterval),
+		Timeout:         Duration(*remoteWriteTimeout),
+		ExternalLabels:  maps.Clone(*remoteWriteLabels),
+		BasicAuth:       BasicAuth{Username: *remoteWriteUsername, PasswordFile: *remoteWritePassword},
+		BearerTokenFile: *remoteWriteTokenFile,
+		MaxRetries:      *remoteWriteRetries,
+		MinBackoff:      Duration(defaultMinBackoff),
+		MaxBackoff:      Duration(defaultMaxBackoff),
+		TLS:             TLSClientConfig{CAFile: *remoteWriteCAFile, CertFile: *remoteWriteCertFile, KeyFile: *remoteWriteKeyFile},
+	}
+}
+
+func (c RemoteWriteConfig) validate() error {
+	if !c.Enabled {
+		return nil
+	}
+
+	var errs []error
+
+	if u, err := url.Parse(c.URL); err != nil {
+		errs = append(errs, fmt.Errorf("url: %w", err))
+	} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("url: %q is not an http(s) URL", c.URL))
+	}
+
+	if c.Interval <= 0 {
+		errs = append(errs, errors.New("interval: must be positive"))
+	}
+	if c.Timeout <= 0 {
+		errs = append(errs, errors.New("timeout: must be positive"))
+	}
+	if c.MaxRetries < 0 {
+		errs = append(errs, errors.New("max_retries: must not be negative"))
+	}
+	if c.MinBackoff <= 0 || c.MaxBackoff < c.MinBackoff {
+		errs = append(errs, errors.New("min_backoff: must be positive and not greater than max_backoff"))
+	}
+
+	for _, name := range sortedKeys(c.ExternalLabels) {
+		if !labelName.MatchString(name) || strings.HasPrefix(name, "__") {
+			errs = append(errs, fmt.Errorf("external_labels: invalid label name %q", name))
+		}
+	}
+
+	basic := c.BasicAuth.Username != "" || c.BasicAuth.Password != "" || c.BasicAuth.PasswordFile != ""
+	bearer := c.BearerToken != "" || c.BearerTokenFile != ""
+	if basic && bearer {
+		errs = append(errs, errors.New("basic_auth and bearer_token are mutually exclusive"))
+	}
+	if c.BasicAuth.Password != "" && c.BasicAuth.PasswordFile != "" {
+		errs = append(errs, errors.New("basic_auth: password and password_file are mutually exclusive"))
+	}
+	if c.BearerToken != "" && c.BearerTokenFile != "" {
+		errs = append(errs, errors.New("bearer_token and bearer_token_file are mutually exclusive"))
+	}
+	for _, f := range []string{c.BasicAuth.PasswordFile, c.BearerTokenFile} {
+		if f == "" {
+			continue
+		}
+		if _, err := os.Stat(f); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if err := c.TLS.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("tls: %w", err))
+	}
+
+	return errors.Join(errs...)
+}
+
+// NewRemoteWriteReader returns a reader that periodically pushes the metrics with Prometheus remote write. If
+// the buffer is enabled, the batches are queued on disk and sent in order as soon as the receiver is reachable
+func NewRemoteWriteReader(c RemoteWriteConfig, buffer BufferConfig, logger zerolog.Logger) (metric.Reader, error) {
+	exporter, err := newRemoteWriteExporter(c, buffer, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	// an export, retries included, must not outlast its interval
+	return metric.NewPeriodicReader(exporter,
+		metric.WithInterval(time.Duration(c.Interval)),
+		metric.WithTimeout(time.Duration(c.Interval))), nil
+}
+
+// remoteWriteExporter is a metric.Exporter that converts the metrics to Prometheus series, with the same
+// names exposed at /metrics, and pushes them as snappy compressed WriteRequest protobufs
+type remoteWriteExporter struct {
+	config         RemoteWriteConfig
+	client         *http.Client
+	externalLabels []promLabel
+	// nil if the buffer is disabled
+	queue *diskQueue
+}
+
+func newRemoteWriteExporter(c RemoteWriteConfig, buffer BufferConfig, logger zerolog.Logger) (*remoteWriteExporter, error) {
+	tlsCfg, err := c.TLS.Build()
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsCfg
+
+	e := &remoteWriteExporter{
+		config: c,
+		client: &http.Client{Transport: transport, Timeout: time.Duration(c.Timeout)},
+	}
+	for _, name := range sortedKeys(c.ExternalLabels) {
+		e.externalLabels = append(e.externalLabels, promLabel{name: name, value: c.ExternalLabels[name]})
+	}
+
+	if buffer.Enabled() {
+		// the queue retries until the batches expire, so every batch is sent once
+		e.queue, err = newDiskQueue("remote_write", buffer, time.Duration(c.MinBackoff), time.Duration(c.MaxBackoff), e.post, logger)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return e, nil
+}
+
+func (e *remoteWriteExporter) Temporality(k metric.InstrumentKind) metricdata.Temporality {
+	return metric.DefaultTemporalitySelector(k)
+}
+
+func (e *remoteWriteExporter) Aggregation(k metric.InstrumentKind) metric.Aggregation {
+	return metric.DefaultAggregationSelector(k)
+}
+
+func (e *remoteWriteExporter) Export(ctx context.Context, rm *metricdata.ResourceMetrics) error {
+	series := toPromSeries(rm, e.externalLabels)
+	if len(series) == 0 {
+		return nil
+	}
+
+	payload := snappy.Encode(nil, encodeWriteRequest(series))
+	if e.queue != nil {
+		return e.queue.Push(payload)
+	}
+	return e.send(ctx, payload)
+}
+
+func (e *remoteWriteExporter) ForceFlush(ctx context.Context) error {
+	return nil
+}
+
+func (e *remoteWriteExporter) Shutdown(ctx context.Context) error {
+	if e.queue != nil {
+		e.queue.Close()
+	}
+	e.client.CloseIdleConnections()
+	return nil
+}
+
+// permanentError is returned for the requests that must not be retried
+type permanentError struct {
+	error
+}
+
+// send pushes a compressed WriteRequest, retrying with an exponential backoff
+func (e *remoteWriteExporter) send(ctx context.Context, payload []byte) error {
+	backoff := time.Duration(e.config.MinBackoff)
+	for attempt := 0; ; attempt++ {
+		err := e.post(ctx, payload)
+		if err == nil {
+			return nil
+		}
+
+		var perm permanentError
+		if errors.As(err, &perm) || attempt >= e.config.MaxRetries {
+			return err
+		}
+		if !sleepContext(ctx, backoff) {
+			return fmt.Errorf("%w (last error: %w)", ctx.Err(), err)
+		}
+		backoff = min(backoff*2, time.Duration(e.config.MaxBackoff))
+	}
+}
+
+func (e *remoteWriteExporter) post(ctx context.Context, payload []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.config.URL, bytes.NewReader(payload))
+	if err != nil {
+		return permanentError{err}
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "telemetruum-agent")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	if err := e.authorize(req); err != nil {
+		return err
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+	err = fmt.Errorf("remote write returned %s: %s", resp.Status, bytes.TrimSpace(body))
+	if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusTooManyRequests {
+		return permanentError{err}
+	}
+	return err
+}
+
+func (e *remoteWriteExporter) authorize(req *http.Request) error {
+	auth := e.config.BasicAuth
+	if auth.Username != "" || auth.Password != "" || auth.PasswordFile != "" {
+		password := auth.Password
+		if auth.PasswordFile != "" {
+			content, err := os.ReadFile(auth.PasswordFile)
+			if err != nil {
+				return fmt.Errorf("error reading the password file: %w", err)
+			}
+			password = strings.TrimSpace(string(content))
+		}
+		req.SetBasicAuth(auth.Username, password)
+		return nil
+	}
+
+	token := e.config.BearerToken
+	if e.config.BearerTokenFile != "" {
+		content, err := os.ReadFile(e.config.BearerTokenFile)
+		if err != nil {
+			return fmt.Errorf("error reading the bearer token file: %w", err)
+		}
+		token = strings.TrimSpace(string(content))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return nil
+}
+
+type promLabel struct {
+	name  string
+	value string
+}
+
+type promSeries struct {
+	labels    []promLabel
+	value     float64
+	timestamp int64
+}
+
+// toPromSeries converts the metrics to Prometheus series, following the naming of the Prometheus exporter
+// (unit and _total suffixes, _bucket/_sum/_count for histograms)
+func toPromSeries(rm *metricdata.ResourceMetrics, externalLabels []promLabel) []promSeries {
+	var res []promSeries
+
+	add := func(name string, attrs attribute.Set, extra []promLabel, value float64, t time.Time) {
+		labels := append([]promLabel{{name: "__name__", value: name}}, extra...)
+		seen := map[string]int{}
+		for i, l := range labels {
+			seen[l.name] = i
+		}
+		for _, kv := range attrs.ToSlice() {
+			l := promLabel{name: promLabelName(string(kv.Key)), value: kv.Value.Emit()}
+			i, ok := seen[l.name]
+			switch {
+			case !ok:
+				seen[l.name] = len(labels)
+				labels = append(labels, l)
+			case i > len(extra):
+				// like the Prometheus exporter, the values of the keys sanitized to the same name (e.g. a.b and
+				// a_b) are joined, since a sample with duplicate labels is rejected
+				labels[i].value += ";" + l.value
+			}
+		}
+		for _, l := range externalLabels {
+			// like in Prometheus, the labels of the series take precedence over the external ones
+			if _, ok := seen[l.name]; !ok {
+				labels = append(labels, l)
+			}
+		}
+		sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+
+		res = append(res, promSeries{labels: labels, value: value, timestamp: t.UnixMilli()})
+	}
+
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			switch data := m.Data.(type) {
+			case metricdata.Gauge[int64]:
+				addNumberPoints(add, promMetricName(m.Name, m.Unit, false), data.DataPoints)
+			case metricdata.Gauge[float64]:
+				addNumberPoints(add, promMetricName(m.Name, m.Unit, false), data.DataPoints)
+			case metricdata.Sum[int64]:
+				addNumberPoints(add, promMetricName(m.Name, m.Unit, data.IsMonotonic), data.DataPoints)
+			case metricdata.Sum[float64]:
+				addNumberPoints(add, promMetricName(m.Name, m.Unit, data.IsMonotonic), data.DataPoints)
+			case metricdata.Histogram[int64]:
+				addHistogramPoints(add, promMetricName(m.Name, m.Unit, false), data.DataPoints)
+			case metricdata.Histogram[float64]:
+				addHistogramPoints(add, promMetricName(m.Name, m.Unit, false), data.DataPoints)
+			}
+		}
+	}
+
+	return res
+}
+
+type addSeriesFunc func(name string, attrs attribute.Set, extra []promLabel, value float64, t time.Time)
+
+func addNumberPoints[N int64 | float64](add addSeriesFunc, name string, points []metricdata.DataPoint[N]) {
+	for _, dp := range points {
+		add(name, dp.Attributes, nil, float64(dp.Value), dp.Time)
+	}
+}
+
+func addHistogramPoints[N int64 | float64](add addSeriesFunc, name string, points []metricdata.HistogramDataPoint[N]) {
+	for _, dp := range points {
+		var cumulative uint64
+		for i, bound := range dp.Bounds {
+			cumulative += dp.BucketCounts[i]
+			le := promLabel{name: "le", value: strconv.FormatFloat(bound, 'f', -1, 64)}
+			add(name+"_bucket", dp.Attributes, []promLabel{le}, float64(cumulative), dp.Time)
+		}
+		add(name+"_bucket", dp.Attributes, []promLabel{{name: "le", value: "+Inf"}}, float64(dp.Count), dp.Time)
+		add(name+"_sum", dp.Attributes, nil, float64(dp.Sum), dp.Time)
+		add(name+"_count", dp.Attributes, nil, float64(dp.Count), dp.Time)
+	}
+}
+
+// promUnitSuffixes is the unit table of the OpenTelemetry Prometheus exporter, so that the pushed series have
+// the same names served at /metrics. Units missing from the table, e.g. By/s, add no suffix
+var promUnitSuffixes = map[string]string{
+	// time
+	"d":   "_days",
+	"h":   "_hours",
+	"min": "_minutes",
+	"s":   "_seconds",
+	"ms":  "_milliseconds",
+	"us":  "_microseconds",
+	"ns":  "_nanoseconds",
+
+	// bytes
+	"By":   "_bytes",
+	"KiBy": "_kibibytes",
+	"MiBy": "_mebibytes",
+	"GiBy": "_gibibytes",
+	"TiBy": "_tibibytes",
+	"KBy":  "_kilobytes",
+	"MBy":  "_megabytes",
+	"GBy":  "_gigabytes",
+	"TBy":  "_terabytes",
+
+	// SI
+	"m": "_meters",
+	"V": "_volts",
+	"A": "_amperes",
+	"J": "_joules",
+	"W": "_watts",
+	"g": "_grams",
+
+	// misc
+	"Cel": "_celsius",
+	"Hz":  "_hertz",
+	"1":   "_ratio",
+	"%":   "_percent",
+}
+
+// promMetricName names a metric like the Prometheus exporter: the _total suffix of the counters always follows
+// the unit one, and a leading digit is prefixed with an underscore
+func promMetricName(name string, unit string, counter bool) string {
+	name = invalidNameChars.ReplaceAllString(name, "_")
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+
+	if counter {
+		name = strings.TrimSuffix(name, "_total")
+	}
+	if suffix, ok := promUnitSuffixes[unit]; ok && !strings.HasSuffix(name, suffix) {
+		name += suffix
+	}
+	if counter {
+		name += "_total"
+	}
+	return name
+}
+
+func promLabelName(name string) string {
+	name = invalidLabelChars.ReplaceAllString(name, "_")
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		name = "key_" + name
+	}
+	return name
+}
+
+// encodeWriteRequest encodes the series as a prometheus.WriteRequest protobuf
+func encodeWriteRequest(series []promSeries) []byte {
+	var req []byte
+	for _, s := range series {
+		var ts []byte
+		for _, l := range s.labels {
+			var label []byte
+			label = protowire.AppendTag(label, 1, protowire.BytesType)
+			label = protowire.AppendString(label, l.name)
+			label = protowire.AppendTag(label, 2, protowire.BytesType)
+			label = protowire.AppendString(label, l.value)
+
+			ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, label)
+		}
+
+		var sample []byte
+		sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+		sample = protowire.AppendFixed64(sample, math.Float64bits(s.value))
+		sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+		sample = protowire.AppendVarint(sample, uint64(s.timestamp))
+
+		ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+		ts = protowire.AppendBytes(ts, sample)
+
+		req = protowire.AppendTag(req, 1, protowire.BytesType)
+		req = protowire.AppendBytes(req, ts)
+	}
+	return req
+}
@@ -0,0 +1,267 @@
+/*
+ICOS Telemetruum Agent
+Copyright © 2022-2024 Engineering Ingegneria Informatica S.p.A.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+This work has received funding from the European Union's HORIZON research
+and innovation programme under grant agreement No. 101070177.
+*/
+
+package modules
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	otelprom "go.opentelemetry.io/otel/exporters/prometheus"
+	api "go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// forEachField calls fn with every field of the protobuf message b
+func forEachField(t *testing.T, b []byte, fn func(num protowire.Number, b []byte) int) {
+	for len(b) > 0 {
+		num, _, n := protowire.ConsumeTag(b)
+		require.GreaterOrEqual(t, n, 0)
+		b = b[n:]
+		n = fn(num, b)
+		require.GreaterOrEqual(t, n, 0)
+		b = b[n:]
+	}
+}
+
+// decodeWriteRequest decodes a WriteRequest into sorted `name{label="value",...} value` strings
+func decodeWriteRequest(t *testing.T, b []byte) []string {
+	var res []string
+
+	forEachField(t, b, func(_ protowire.Number, b []byte) int {
+		ts, n := protowire.ConsumeBytes(b)
+		name, labels, value := "", []string{}, 0.0
+
+		forEachField(t, ts, func(num protowire.Number, b []byte) int {
+			msg, n := protowire.ConsumeBytes(b)
+			if num == 1 {
+				var label [2]string
+				forEachField(t, msg, func(num protowire.Number, b []byte) int {
+					v, n := protowire.ConsumeString(b)
+					label[num-1] = v
+					return n
+				})
+				if label[0] == "__name__" {
+					name = label[1]
+				} else {
+					labels = append(labels, label[0]+"="+strconv.Quote(label[1]))
+				}
+				return n
+			}
+
+			forEachField(t, msg, func(num protowire.Number, b []byte) int {
+				if num == 1 {
+					v, n := protowire.ConsumeFixed64(b)
+					value = math.Float64frombits(v)
+					return n
+				}
+				_, n := protowire.ConsumeVarint(b)
+				return n
+			})
+			return n
+		})
+
+		res = append(res, name+"{"+strings.Join(labels, ",")+"} "+strconv.FormatFloat(value, 'f', -1, 64))
+		return n
+	})
+
+	sort.Strings(res)
+	return res
+}
+
+func testRemoteWriteConfig(url string) RemoteWriteConfig {
+	return RemoteWriteConfig{
+		Enabled:        true,
+		URL:            url,
+		Interval:       Duration(time.Minute),
+		Timeout:        Duration(time.Second),
+		ExternalLabels: map[string]string{"node": "edge-1", "host_id": "h0"},
+		BasicAuth:      BasicAuth{Username: "agent", Password: "secret"},
+		MaxRetries:     3,
+		MinBackoff:     Duration(time.Millisecond),
+		MaxBackoff:     Duration(10 * time.Millisecond),
+	}
+}
+
+func testResourceMetrics(t *testing.T) *metricdata.ResourceMetrics {
+	reader := sdkmetric.NewManualReader()
+	meter := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)).Meter("test")
+
+	counter, err := meter.Int64Counter("tlum_test_errors")
+	require.NoError(t, err)
+	counter.Add(context.Background(), 2, api.WithAttributes(attribute.Key("host_id").String("h1")))
+
+	histogram, err := meter.Float64Histogram("tlum_test_duration", api.WithUnit("s"), api.WithExplicitBucketBoundaries(0.1, 1))
+	require.NoError(t, err)
+	histogram.Record(context.Background(), 0.5)
+
+	rm := &metricdata.ResourceMetrics{}
+	require.NoError(t, reader.Collect(context.Background(), rm))
+	return rm
+}
+
+func TestRemoteWriteExporter(t *testing.T) {
+	var requests atomic.Int32
+	var received []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+
+		assert.Equal(t, "snappy", r.Header.Get("Content-Encoding"))
+		assert.Equal(t, "0.1.0", r.Header.Get("X-Prometheus-Remote-Write-Version"))
+		user, password, _ := r.BasicAuth()
+		assert.Equal(t, "agent", user)
+		assert.Equal(t, "secret", password)
+
+		compressed, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		content, err := snappy.Decode(nil, compressed)
+		require.NoError(t, err)
+		received = decodeWriteRequest(t, content)
+	}))
+	defer server.Close()
+
+	cfg := testRemoteWriteConfig(server.URL)
+	require.NoError(t, cfg.validate())
+	exporter, err := newRemoteWriteExporter(cfg, BufferConfig{}, zerolog.Nop())
+	require.NoError(t, err)
+
+	require.NoError(t, exporter.Export(context.Background(), testResourceMetrics(t)))
+	assert.Equal(t, int32(2), requests.Load(), "the first failed request should be retried")
+	assert.Equal(t, []string{
+		`tlum_test_duration_seconds_bucket{host_id="h0",le="+Inf",node="edge-1"} 1`,
+		`tlum_test_duration_seconds_bucket{host_id="h0",le="0.1",node="edge-1"} 0`,
+		`tlum_test_duration_seconds_bucket{host_id="h0",le="1",node="edge-1"} 1`,
+		`tlum_test_duration_seconds_count{host_id="h0",node="edge-1"} 1`,
+		`tlum_test_duration_seconds_sum{host_id="h0",node="edge-1"} 0.5`,
+		`tlum_test_errors_total{host_id="h1",node="edge-1"} 2`,
+	}, received)
+}
+
+func TestRemoteWriteExporterRejected(t *testing.T) {
+	var requests atomic.Int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.Error(w, "out of order sample", http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	exporter, err := newRemoteWriteExporter(testRemoteWriteConfig(server.URL), BufferConfig{}, zerolog.Nop())
+	require.NoError(t, err)
+
+	err = exporter.Export(context.Background(), testResourceMetrics(t))
+	assert.ErrorContains(t, err, "out of order sample")
+	assert.Equal(t, int32(1), requests.Load(), "rejected requests should not be retried")
+}
+
+func TestRemoteWriteNamesMatchPrometheus(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	promExporter, err := otelprom.New(otelprom.WithRegisterer(registry), otelprom.WithoutTargetInfo(), otelprom.WithoutScopeInfo())
+	require.NoError(t, err)
+	reader := sdkmetric.NewManualReader()
+	meter := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader), sdkmetric.WithReader(promExporter)).Meter("test")
+
+	ctx := context.Background()
+	opt := api.WithAttributes(attribute.Key("source").String("test"))
+	for _, unit := range []string{"", "s", "ms", "By", "By/s", "m", "Hz", "1", "%", "Cel"} {
+		gauge, err := meter.Float64ObservableGauge("tlum.test.gauge."+strings.NewReplacer("/", "_per_", "%", "pct").Replace(unit), api.WithUnit(unit))
+		require.NoError(t, err)
+		_, err = meter.RegisterCallback(func(_ context.Context, o api.Observer) error {
+			o.ObserveFloat64(gauge, 1, opt)
+			return nil
+		}, gauge)
+		require.NoError(t, err)
+	}
+	counter, err := meter.Int64Counter("tlum_test_io_total", api.WithUnit("By"))
+	require.NoError(t, err)
+	counter.Add(ctx, 3, opt)
+	upDown, err := meter.Int64UpDownCounter("tlum_test_queue", api.WithUnit("1"))
+	require.NoError(t, err)
+	upDown.Add(ctx, 2, opt)
+	histogram, err := meter.Float64Histogram("tlum_test_latency", api.WithUnit("ms"), api.WithExplicitBucketBoundaries(10))
+	require.NoError(t, err)
+	histogram.Record(ctx, 5, opt)
+
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	var exposed []string
+	for _, f := range families {
+		if f.GetType() == dto.MetricType_HISTOGRAM {
+			exposed = append(exposed, f.GetName()+"_bucket", f.GetName()+"_count", f.GetName()+"_sum")
+		} else {
+			exposed = append(exposed, f.GetName())
+		}
+	}
+
+	rm := &metricdata.ResourceMetrics{}
+	require.NoError(t, reader.Collect(ctx, rm))
+	pushed := map[string]bool{}
+	for _, s := range toPromSeries(rm, nil) {
+		pushed[s.labels[0].value] = true
+	}
+
+	assert.ElementsMatch(t, exposed, sortedKeys(pushed))
+	assert.Contains(t, exposed, "tlum_test_gauge_m_meters")
+	assert.Contains(t, exposed, "tlum_test_io_bytes_total")
+}
+
+func TestRemoteWriteLabelCollisions(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	meter := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)).Meter("test")
+
+	counter, err := meter.Int64Counter("tlum_test_errors")
+	require.NoError(t, err)
+	counter.Add(context.Background(), 1, api.WithAttributes(
+		attribute.Key("a.b").String("1"),
+		attribute.Key("a_b").String("2"),
+		attribute.Key("node").String("edge-2"),
+	))
+
+	rm := &metricdata.ResourceMetrics{}
+	require.NoError(t, reader.Collect(context.Background(), rm))
+	series := toPromSeries(rm, []promLabel{{name: "node", value: "edge-1"}})
+
+	// a.b and a_b are merged, the node attribute wins over the external label
+	assert.Equal(t, []string{
+		`tlum_test_errors_total{a_b="1;2",node="edge-2"} 1`,
+	}, decodeWriteRequest(t, encodeWriteRequest(series)))
+}
@@ -0,0 +1,82 @@
+/*
+ICOS Telemetruum Agent
+Copyright © 2022-2024 Engineering Ingegneria Informatica S.p.A.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+This work has received funding from the European Union's HORIZON research
+and innovation programme under grant agreement No. 101070177.
+*/
+
+package modules
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+type healthResponse struct {
+	Status     string            `json:"status"`
+	Providers  []providerHealth  `json:"providers"`
+	Collectors []collectorHealth `json:"collectors"`
+}
+
+type providerHealth struct {
+	Name        string     `json:"name"`
+	State       string     `json:"state"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+}
+
+type collectorHealth struct {
+	Name           string     `json:"name"`
+	LastCollection *time.Time `json:"last_collection,omitempty"`
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// HealthHandler serves the status of the providers and collectors as JSON. With readiness, it answers 503
+// until the agent is ready, otherwise it always answers 200 (liveness)
+func HealthHandler(s *Supervisor, readiness bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := s.Status()
+
+		res := healthResponse{Status: "ready", Providers: []providerHealth{}, Collectors: []collectorHealth{}}
+		if !status.Ready {
+			res.Status = "not ready"
+		}
+		for _, p := range status.Providers {
+			res.Providers = append(res.Providers, providerHealth{
+				Name:        p.Name,
+				State:       string(p.State),
+				LastError:   p.LastError,
+				LastSuccess: optionalTime(p.LastSuccess),
+			})
+		}
+		for _, c := range status.Collectors {
+			res.Collectors = append(res.Collectors, collectorHealth{Name: c.Name, LastCollection: optionalTime(c.LastCollection)})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if readiness && !status.Ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		_ = json.NewEncoder(w).Encode(res)
+	})
+}
@@ -0,0 +1,89 @@
+/*
+ICOS Telemetruum Agent
+Copyright © 2022-2024 Engineering Ingegneria Informatica S.p.A.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+This work has received funding from the European Union's HORIZON research
+and innovation programme under grant agreement No. 101070177.
+*/
+
+package modules
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+)
+
+func getHealth(t *testing.T, h http.Handler) (int, healthResponse) {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	res := healthResponse{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+	return rec.Code, res
+}
+
+func TestReadiness(t *testing.T) {
+	meter := sdkmetric.NewMeterProvider(sdkmetric.WithReader(sdkmetric.NewManualReader())).Meter("test")
+
+	runner := &AsyncCollectorRunner[*OrchInfoCollector]{
+		Schedule:  Schedule{Interval: time.Hour},
+		Collector: &OrchInfoCollector{},
+		Logger:    zerolog.Nop()}
+	runner.Init(meter)
+
+	s := NewSupervisor(meter, zerolog.Nop())
+	s.collectors["orch-info"] = &runningCollector{reg: &collectorRegistration{name: "Orchestrator Info Metrics"}, runner: runner}
+	s.applied = true
+
+	readyz := HealthHandler(s, true)
+	healthz := HealthHandler(s, false)
+
+	setProviderState("Starting", ProviderStarting, nil)
+	code, res := getHealth(t, readyz)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "not ready", res.Status)
+
+	code, _ = getHealth(t, healthz)
+	assert.Equal(t, http.StatusOK, code, "liveness should not depend on readiness")
+
+	// a provider that failed to initialize does not block the readiness
+	setProviderState("Starting", ProviderUnavailable, assert.AnError)
+	code, res = getHealth(t, readyz)
+	assert.Equal(t, http.StatusServiceUnavailable, code, "the collector did not run yet")
+	assert.Nil(t, res.Collectors[0].LastCollection)
+
+	runner.collect(context.Background())
+	code, res = getHealth(t, readyz)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ready", res.Status)
+	assert.Equal(t, "Orchestrator Info Metrics", res.Collectors[0].Name)
+	assert.NotNil(t, res.Collectors[0].LastCollection)
+
+	for _, p := range res.Providers {
+		if p.Name == "Starting" {
+			assert.Equal(t, "unavailable", p.State)
+			assert.Equal(t, assert.AnError.Error(), p.LastError)
+		}
+	}
+}
@@ -0,0 +1,319 @@
+/*
+ICOS Telemetruum Agent
+Copyright © 2022-2024 Engineering Ingegneria Informatica S.p.A.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+This work has received funding from the European Union's HORIZON research
+and innovation programme under grant agreement No. 101070177.
+*/
+
+package modules
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	InventoryAPIVersion = "v1"
+	InventoryPath       = "/api/v1/inventory"
+)
+
+// InventoryResponse is the envelope of all the inventory API responses. Data depends on Kind
+type InventoryResponse struct {
+	APIVersion  string    `json:"api_version"`
+	Kind        string    `json:"kind"`
+	GeneratedAt time.Time `json:"generated_at"`
+	Data        any       `json:"data"`
+}
+
+// Inventory is the whole inventory of the node. The sections of the disabled collectors are omitted
+type Inventory struct {
+	Host         *HostInventory         `json:"host,omitempty"`
+	Orchestrator *OrchestratorInventory `json:"orchestrator,omitempty"`
+	Workloads    *WorkloadsInventory    `json:"workloads,omitempty"`
+	Peripherals  *PeripheralsInventory  `json:"peripherals,omitempty"`
+	Network      *NetworkInventory      `json:"network,omitempty"`
+}
+
+type HostInventory struct {
+	// nil until the first collection
+	CollectedAt *time.Time `json:"collected_at,omitempty"`
+	Id          string     `json:"id"`
+	Hostname    string     `json:"hostname"`
+	Os          string     `json:"os"`
+	Arch        string     `json:"arch"`
+	Ip          string     `json:"ip"`
+	Latitude    string     `json:"latitude"`
+	Longitude   string     `json:"longitude"`
+	// omitted when no source knows the location
+	Location *LocationInventory `json:"location,omitempty"`
+}
+
+type LocationInventory struct {
+	Latitude  float64  `json:"latitude"`
+	Longitude float64  `json:"longitude"`
+	Altitude  *float64 `json:"altitude,omitempty"`
+	Accuracy  *float64 `json:"accuracy,omitempty"`
+	Source    string   `json:"source"`
+	Geohash   string   `json:"geohash,omitempty"`
+}
+
+type OrchestratorInventory struct {
+	CollectedAt *time.Time `json:"collected_at,omitempty"`
+	Type        string     `json:"type"`
+	AgentId     string     `json:"agent_id"`
+	AgentName   string     `json:"agent_name"`
+	ClusterId   string     `json:"cluster_id"`
+}
+
+type WorkloadsInventory struct {
+	CollectedAt *time.Time          `json:"collected_at,omitempty"`
+	HostId      string              `json:"host_id"`
+	ClusterId   string              `json:"cluster_id"`
+	Workloads   []WorkloadInventory `json:"workloads"`
+}
+
+type WorkloadInventory struct {
+	Name        string            `json:"name"`
+	Type        string            `json:"type"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+type PeripheralsInventory struct {
+	CollectedAt *time.Time            `json:"collected_at,omitempty"`
+	Peripherals []PeripheralInventory `json:"peripherals"`
+}
+
+type PeripheralInventory struct {
+	Device       string            `json:"device"`
+	ResourcePath string            `json:"resource_path"`
+	Available    bool              `json:"available"`
+	Source       string            `json:"source"`
+	Interface    string            `json:"interface"`
+	VendorID     string            `json:"vendor_id,omitempty"`
+	ProductID    string            `json:"product_id,omitempty"`
+	Manufacturer string            `json:"manufacturer,omitempty"`
+	Serial       string            `json:"serial,omitempty"`
+	Class        string            `json:"class,omitempty"`
+	Details      map[string]string `json:"details,omitempty"`
+}
+
+type NetworkInventory struct {
+	CollectedAt *time.Time                  `json:"collected_at,omitempty"`
+	Interfaces  []NetworkInterfaceInventory `json:"interfaces"`
+}
+
+type NetworkInterfaceInventory struct {
+	Name      string `json:"name"`
+	MAC       string `json:"mac"`
+	MTU       int64  `json:"mtu"`
+	OperState string `json:"operstate"`
+	// bytes per second, omitted when unknown
+	Speed     *int64   `json:"speed,omitempty"`
+	Addresses []string `json:"addresses"`
+}
+
+// annotationFilter matches the workloads having all the given annotations. An annotation without value
+// only needs to be present
+type annotationFilter map[string]*string
+
+func parseAnnotationFilter(values []string) annotationFilter {
+	f := annotationFilter{}
+	for _, v := range values {
+		if k, val, ok := strings.Cut(v, "="); ok {
+			f[k] = &val
+		} else {
+			f[v] = nil
+		}
+	}
+	return f
+}
+
+func (f annotationFilter) match(annotations map[string]string) bool {
+	for k, want := range f {
+		v, ok := annotations[k]
+		if !ok || (want != nil && v != *want) {
+			return false
+		}
+	}
+	return true
+}
+
+// InventoryHandler serves the last snapshot of the collectors as JSON at InventoryPath and its sub-resources
+// (host, orchestrator, workloads, peripherals and network). The workloads can be filtered with one or more
+// annotation=key[=value] query parameters
+func InventoryHandler(s *Supervisor) http.Handler {
+	sections := map[string]struct {
+		kind  string
+		build func(s *Supervisor, filter annotationFilter) (any, bool)
+	}{
+		"host":         {"Host", hostInventory},
+		"orchestrator": {"Orchestrator", orchestratorInventory},
+		"workloads":    {"Workloads", workloadsInventory},
+		"peripherals":  {"Peripherals", peripheralsInventory},
+		"network":      {"Network", networkInventory},
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		filter := parseAnnotationFilter(r.URL.Query()["annotation"])
+		res := InventoryResponse{APIVersion: InventoryAPIVersion, GeneratedAt: time.Now().UTC()}
+
+		section := strings.Trim(strings.TrimPrefix(r.URL.Path, InventoryPath), "/")
+		if section == "" {
+			inv := Inventory{}
+			if v, ok := hostInventory(s, filter); ok {
+				inv.Host = v.(*HostInventory)
+			}
+			if v, ok := orchestratorInventory(s, filter); ok {
+				inv.Orchestrator = v.(*OrchestratorInventory)
+			}
+			if v, ok := workloadsInventory(s, filter); ok {
+				inv.Workloads = v.(*WorkloadsInventory)
+			}
+			if v, ok := peripheralsInventory(s, filter); ok {
+				inv.Peripherals = v.(*PeripheralsInventory)
+			}
+			if v, ok := networkInventory(s, filter); ok {
+				inv.Network = v.(*NetworkInventory)
+			}
+			res.Kind, res.Data = "Inventory", inv
+		} else {
+			sec, ok := sections[section]
+			if !ok {
+				http.Error(w, "unknown inventory resource", http.StatusNotFound)
+				return
+			}
+			data, ok := sec.build(s, filter)
+			if !ok {
+				http.Error(w, "the collector of this resource is disabled", http.StatusNotFound)
+				return
+			}
+			res.Kind, res.Data = sec.kind, data
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(res)
+	})
+}
+
+func hostInventory(s *Supervisor, _ annotationFilter) (any, bool) {
+	snapshot, collectedAt, ok := s.collectorSnapshot("host-info")
+	if !ok {
+		return nil, false
+	}
+	c := snapshot.(*HostInfoCollector)
+	latitude, longitude := c.Location.labels()
+	var loc *LocationInventory
+	if l := c.Location; l != nil {
+		loc = &LocationInventory{Latitude: l.Latitude, Longitude: l.Longitude, Altitude: l.Altitude, Accuracy: l.Accuracy, Source: l.Source, Geohash: l.Geohash}
+	}
+	return &HostInventory{
+		CollectedAt: optionalTime(collectedAt),
+		Id:          c.Id,
+		Hostname:    c.Hostname,
+		Os:          c.Os,
+		Arch:        c.Arch,
+		Ip:          c.Ip,
+		Latitude:    latitude,
+		Longitude:   longitude,
+		Location:    loc,
+	}, true
+}
+
+func orchestratorInventory(s *Supervisor, _ annotationFilter) (any, bool) {
+	snapshot, collectedAt, ok := s.collectorSnapshot("orch-info")
+	if !ok {
+		return nil, false
+	}
+	c := snapshot.(*OrchInfoCollector)
+	return &OrchestratorInventory{
+		CollectedAt: optionalTime(collectedAt),
+		Type:        c.Type,
+		AgentId:     c.AgentId,
+		AgentName:   c.AgentName,
+		ClusterId:   c.ClusterId,
+	}, true
+}
+
+func workloadsInventory(s *Supervisor, filter annotationFilter) (any, bool) {
+	snapshot, collectedAt, ok := s.collectorSnapshot("workload-info")
+	if !ok {
+		return nil, false
+	}
+	c := snapshot.(*WorkloadInfoCollector)
+
+	inv := &WorkloadsInventory{CollectedAt: optionalTime(collectedAt), HostId: c.HostId, ClusterId: c.ClusterId, Workloads: []WorkloadInventory{}}
+	for _, wi := range c.RunningWorkloads {
+		if !filter.match(wi.Annotations) {
+			continue
+		}
+		inv.Workloads = append(inv.Workloads, WorkloadInventory{Name: wi.Name, Type: wi.Type, Annotations: wi.Annotations})
+	}
+	sort.Slice(inv.Workloads, func(i, j int) bool { return inv.Workloads[i].Name < inv.Workloads[j].Name })
+	return inv, true
+}
+
+func peripheralsInventory(s *Supervisor, _ annotationFilter) (any, bool) {
+	snapshot, collectedAt, ok := s.collectorSnapshot("node-mount")
+	if !ok {
+		return nil, false
+	}
+	c := snapshot.(*NodeMountedCollector)
+
+	inv := &PeripheralsInventory{CollectedAt: optionalTime(collectedAt), Peripherals: []PeripheralInventory{}}
+	for _, p := range c.AttachedPeripherals {
+		inv.Peripherals = append(inv.Peripherals, PeripheralInventory{
+			Device:       p.Device,
+			ResourcePath: p.ResourcePath,
+			Available:    p.Available,
+			Source:       p.Source,
+			Interface:    p.Interface,
+			VendorID:     p.VendorID,
+			ProductID:    p.ProductID,
+			Manufacturer: p.Manufacturer,
+			Serial:       p.Serial,
+			Class:        p.Class,
+			Details:      p.Details,
+		})
+	}
+	return inv, true
+}
+
+func networkInventory(s *Supervisor, _ annotationFilter) (any, bool) {
+	snapshot, collectedAt, ok := s.collectorSnapshot("host-network")
+	if !ok {
+		return nil, false
+	}
+	c := snapshot.(*HostNetworkCollector)
+
+	inv := &NetworkInventory{CollectedAt: optionalTime(collectedAt), Interfaces: []NetworkInterfaceInventory{}}
+	for _, i := range c.Interfaces {
+		addrs := i.Addresses
+		if addrs == nil {
+			addrs = []string{}
+		}
+		inv.Interfaces = append(inv.Interfaces, NetworkInterfaceInventory{Name: i.Name, MAC: i.MAC, MTU: i.MTU, OperState: i.OperState, Speed: i.Speed, Addresses: addrs})
+	}
+	return inv, true
+}
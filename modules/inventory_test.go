@@ -0,0 +1,125 @@
+/*
+ICOS Telemetruum Agent
+Copyright © 2022-2024 Engineering Ingegneria Informatica S.p.A.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+This work has received funding from the European Union's HORIZON research
+and innovation programme under grant agreement No. 101070177.
+*/
+
+package modules
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+)
+
+func getInventory(t *testing.T, h http.Handler, url string, data any) (int, InventoryResponse) {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+
+	res := InventoryResponse{Data: data}
+	if rec.Code == http.StatusOK {
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+	}
+	return rec.Code, res
+}
+
+func TestInventory(t *testing.T) {
+	meter := sdkmetric.NewMeterProvider(sdkmetric.WithReader(sdkmetric.NewManualReader())).Meter("test")
+	s := NewSupervisor(meter, zerolog.Nop())
+
+	host := &AsyncCollectorRunner[*HostInfoCollector]{Schedule: Schedule{Interval: time.Hour}, Collector: &HostInfoCollector{}, Logger: zerolog.Nop()}
+	host.AppendAsyncDataProvider(DataProvider[*HostInfoCollector]{Provide: func(ctx context.Context, c *HostInfoCollector) error {
+		c.Hostname = "edge-1"
+		c.Location = &Location{Latitude: 45.1, Longitude: 7.6, Source: "static"}
+		return nil
+	}})
+	workloads := &AsyncCollectorRunner[*WorkloadInfoCollector]{Schedule: Schedule{Interval: time.Hour}, Collector: &WorkloadInfoCollector{}, Logger: zerolog.Nop()}
+	workloads.AppendAsyncDataProvider(DataProvider[*WorkloadInfoCollector]{Provide: func(ctx context.Context, c *WorkloadInfoCollector) error {
+		c.ClusterId = "c1"
+		c.RunningWorkloads = []*WorkloadInfo{
+			{Name: "web", Annotations: map[string]string{"icos_app": "shop", "icos_tier": "front"}},
+			{Name: "db", Annotations: map[string]string{"icos_app": "shop"}},
+			{Name: "other", Annotations: map[string]string{}},
+		}
+		return nil
+	}})
+
+	network := &AsyncCollectorRunner[*HostNetworkCollector]{Schedule: Schedule{Interval: time.Hour}, Collector: &HostNetworkCollector{}, Logger: zerolog.Nop()}
+	network.AppendAsyncDataProvider(DataProvider[*HostNetworkCollector]{Provide: func(ctx context.Context, c *HostNetworkCollector) error {
+		c.Interfaces = []*NetworkInterface{
+			{Name: "eth0", MAC: "52:54:00:12:34:56", MTU: 1500, OperState: "up", Speed: int64Ptr(125000000), Addresses: []string{"192.168.1.10/24"}},
+			{Name: "lo", MTU: 65536, OperState: "unknown"},
+		}
+		return nil
+	}})
+
+	for flag, runner := range map[string]CollectorRunner{"host-info": host, "workload-info": workloads, "host-network": network} {
+		runner.Init(meter)
+		s.collectors[flag] = &runningCollector{reg: &collectorRegistration{name: flag}, runner: runner}
+	}
+	handler := InventoryHandler(s)
+
+	code, res := getInventory(t, handler, InventoryPath+"/workloads", &WorkloadsInventory{})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Nil(t, res.Data.(*WorkloadsInventory).CollectedAt, "no collection yet")
+
+	host.collect(context.Background())
+	workloads.collect(context.Background())
+	network.collect(context.Background())
+
+	inv := &Inventory{}
+	code, res = getInventory(t, handler, InventoryPath, inv)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "v1", res.APIVersion)
+	assert.Equal(t, "Inventory", res.Kind)
+	assert.Equal(t, "edge-1", inv.Host.Hostname)
+	assert.Equal(t, "45.1", inv.Host.Latitude)
+	assert.Equal(t, &LocationInventory{Latitude: 45.1, Longitude: 7.6, Source: "static"}, inv.Host.Location)
+	assert.NotNil(t, inv.Host.CollectedAt)
+	assert.Len(t, inv.Workloads.Workloads, 3)
+	assert.Nil(t, inv.Orchestrator, "disabled collectors are omitted")
+
+	wl := &WorkloadsInventory{}
+	code, res = getInventory(t, handler, InventoryPath+"/workloads?annotation=icos_app=shop&annotation=icos_tier", wl)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "Workloads", res.Kind)
+	assert.Equal(t, "c1", wl.ClusterId)
+	require.Len(t, wl.Workloads, 1)
+	assert.Equal(t, "web", wl.Workloads[0].Name)
+
+	nw := &NetworkInventory{}
+	code, res = getInventory(t, handler, InventoryPath+"/network", nw)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "Network", res.Kind)
+	require.Len(t, nw.Interfaces, 2)
+	assert.Equal(t, NetworkInterfaceInventory{Name: "eth0", MAC: "52:54:00:12:34:56", MTU: 1500, OperState: "up", Speed: int64Ptr(125000000), Addresses: []string{"192.168.1.10/24"}}, nw.Interfaces[0])
+	assert.Equal(t, []string{}, nw.Interfaces[1].Addresses)
+
+	code, _ = getInventory(t, handler, InventoryPath+"/peripherals", nil)
+	assert.Equal(t, http.StatusNotFound, code, "the collector is disabled")
+
+	code, _ = getInventory(t, handler, InventoryPath+"/unknown", nil)
+	assert.Equal(t, http.StatusNotFound, code)
+}
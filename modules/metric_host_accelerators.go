@@ -0,0 +1,100 @@
+/*
+ICOS Telemetruum Agent
+Copyright © 2022-2024 Engineering Ingegneria Informatica S.p.A.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+This work has received funding from the European Union's HORIZON research
+and innovation programme under grant agreement No. 101070177.
+*/
+
+package modules
+
+import (
+	"context"
+	"log"
+	"strconv"
+
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	api "go.opentelemetry.io/otel/metric"
+)
+
+// Accelerator is a PCI device that can run or serve workloads: a GPU, an NPU, an FPGA or a NIC
+type Accelerator struct {
+	// PCI address, e.g. 0000:01:00.0
+	Address string
+	// gpu, npu, fpga or nic
+	Type string
+	// PCI class code, e.g. 0x030200
+	Class    string
+	VendorID string
+	DeviceID string
+	// Names of the vendor and of the device, empty when unknown
+	Vendor string
+	Device string
+	// Kernel driver bound to the device, empty if none
+	Driver string
+	// -1 when the host has a single NUMA node
+	NUMANode int64
+}
+
+func init() {
+	RegisterCollector(CollectorRegistration[*HostAcceleratorsCollector]{
+		Name:            "HostAccelerators",
+		Flag:            "host-accelerators",
+		Description:     "Host Accelerators Metrics",
+		DefaultInterval: "5m",
+		New:             func() *HostAcceleratorsCollector { return &HostAcceleratorsCollector{} }})
+}
+
+type HostAcceleratorsCollector struct {
+	Accelerators []*Accelerator
+
+	info metric.Int64ObservableGauge
+}
+
+func (c *HostAcceleratorsCollector) Clone() *HostAcceleratorsCollector {
+	clone := *c
+	clone.Accelerators = append([]*Accelerator(nil), c.Accelerators...)
+	return &clone
+}
+
+func (c *HostAcceleratorsCollector) GetMetrics(meter metric.Meter) []metric.Observable {
+
+	if c.info == nil {
+		info, err := meter.Int64ObservableGauge("tlum_host_accelerator_info", api.WithDescription("info about the GPUs, NPUs, FPGAs and NICs of the host"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		c.info = info
+	}
+
+	return []metric.Observable{c.info}
+}
+
+func (c *HostAcceleratorsCollector) CreateObservations(ctx context.Context, o api.Observer, logger zerolog.Logger) {
+	for _, a := range c.Accelerators {
+		o.ObserveInt64(c.info, 1, api.WithAttributes(
+			attribute.Key("pci_address").String(a.Address),
+			attribute.Key("type").String(a.Type),
+			attribute.Key("class").String(a.Class),
+			attribute.Key("vendor_id").String(a.VendorID),
+			attribute.Key("device_id").String(a.DeviceID),
+			attribute.Key("vendor").String(a.Vendor),
+			attribute.Key("device").String(a.Device),
+			attribute.Key("driver").String(a.Driver),
+			attribute.Key("numa_node").String(strconv.FormatInt(a.NUMANode, 10))))
+	}
+}
@@ -0,0 +1,135 @@
+/*
+ICOS Telemetruum Agent
+Copyright © 2022-2024 Engineering Ingegneria Informatica S.p.A.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+This work has received funding from the European Union's HORIZON research
+and innovation programme under grant agreement No. 101070177.
+*/
+
+package modules
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	api "go.opentelemetry.io/otel/metric"
+)
+
+func init() {
+	RegisterCollector(CollectorRegistration[*HostCapabilitiesCollector]{
+		Name:            "HostCapabilities",
+		Flag:            "host-capabilities",
+		Description:     "Host Capabilities Metrics",
+		DefaultInterval: "5m",
+		New:             func() *HostCapabilitiesCollector { return &HostCapabilitiesCollector{} }})
+}
+
+// HostCapabilitiesCollector describes the hardware of the host, so that the workloads can be placed on the nodes
+// able to run them
+type HostCapabilitiesCollector struct {
+	Arch          string
+	CPUVendor     string
+	CPUModel      string
+	PhysicalCores int64
+	LogicalCores  int64
+	// Highest frequency of the CPUs in Hz, 0 when cpufreq is not available (e.g. in most VMs)
+	MaxFrequency int64
+	// Presence of each of the configured ISA flags
+	CPUFlags    map[string]bool
+	MemoryTotal int64
+	// Number of pages reserved for each of the supported huge page sizes, in bytes
+	HugePages map[int64]int64
+
+	info          metric.Int64ObservableGauge
+	cpuFlag       metric.Int64ObservableGauge
+	physicalCores metric.Int64ObservableGauge
+	logicalCores  metric.Int64ObservableGauge
+	maxFrequency  metric.Int64ObservableGauge
+	memoryTotal   metric.Int64ObservableGauge
+	hugePages     metric.Int64ObservableGauge
+}
+
+func (c *HostCapabilitiesCollector) Clone() *HostCapabilitiesCollector {
+	clone := *c
+	return &clone
+}
+
+func (c *HostCapabilitiesCollector) GetMetrics(meter metric.Meter) []metric.Observable {
+
+	if c.info == nil {
+		var errs [7]error
+		c.info, errs[0] = meter.Int64ObservableGauge("tlum_host_capabilities", api.WithDescription("hardware capabilities of the host"))
+		c.cpuFlag, errs[1] = meter.Int64ObservableGauge("tlum_host_cpu_flag", api.WithDescription("1 if the CPUs support the instruction set extension, 0 otherwise"))
+		c.physicalCores, errs[2] = meter.Int64ObservableGauge("tlum_host_cpu_physical_cores", api.WithDescription("number of physical cores"))
+		c.logicalCores, errs[3] = meter.Int64ObservableGauge("tlum_host_cpu_logical_cores", api.WithDescription("number of logical cores (hardware threads)"))
+		c.maxFrequency, errs[4] = meter.Int64ObservableGauge("tlum_host_cpu_max_frequency", api.WithUnit("Hz"), api.WithDescription("maximum frequency of the CPUs"))
+		c.memoryTotal, errs[5] = meter.Int64ObservableGauge("tlum_host_memory_total", api.WithUnit("By"), api.WithDescription("physical memory of the host"))
+		c.hugePages, errs[6] = meter.Int64ObservableGauge("tlum_host_hugepages", api.WithDescription("huge pages reserved for each supported page size"))
+		for _, err := range errs {
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	return []metric.Observable{c.info, c.cpuFlag, c.physicalCores, c.logicalCores, c.maxFrequency, c.memoryTotal, c.hugePages}
+}
+
+func (c *HostCapabilitiesCollector) CreateObservations(ctx context.Context, o api.Observer, logger zerolog.Logger) {
+	if c.LogicalCores == 0 {
+		// not collected yet
+		return
+	}
+
+	flags := []string{}
+	for _, f := range sortedKeys(c.CPUFlags) {
+		if c.CPUFlags[f] {
+			flags = append(flags, f)
+		}
+	}
+	pageSizes := []string{}
+	for _, size := range sortedKeys(c.HugePages) {
+		pageSizes = append(pageSizes, strconv.FormatInt(size, 10))
+	}
+
+	o.ObserveInt64(c.info, 1, api.WithAttributes(
+		attribute.Key("arch").String(c.Arch),
+		attribute.Key("cpu_vendor").String(c.CPUVendor),
+		attribute.Key("cpu_model").String(c.CPUModel),
+		attribute.Key("cpu_flags").String(strings.Join(flags, ",")),
+		attribute.Key("hugepage_sizes").String(strings.Join(pageSizes, ","))))
+
+	for f, present := range c.CPUFlags {
+		v := int64(0)
+		if present {
+			v = 1
+		}
+		o.ObserveInt64(c.cpuFlag, v, api.WithAttributes(attribute.Key("flag").String(f)))
+	}
+	o.ObserveInt64(c.physicalCores, c.PhysicalCores)
+	o.ObserveInt64(c.logicalCores, c.LogicalCores)
+	if c.MaxFrequency > 0 {
+		o.ObserveInt64(c.maxFrequency, c.MaxFrequency)
+	}
+	o.ObserveInt64(c.memoryTotal, c.MemoryTotal)
+	for size, pages := range c.HugePages {
+		o.ObserveInt64(c.hugePages, pages, api.WithAttributes(attribute.Key("page_size").String(strconv.FormatInt(size, 10))))
+	}
+}
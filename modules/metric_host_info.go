@@ -23,6 +23,7 @@ package modules
 import (
 	"context"
 	"log"
+	"strconv"
 
 	"github.com/alecthomas/kingpin/v2"
 	"github.com/rs/zerolog"
@@ -35,16 +36,55 @@ var (
 	pathRootFs = kingpin.Flag("path-rootfs", "Path of the root fs").Default("/").String()
 )
 
+func init() {
+	RegisterCollector(CollectorRegistration[*HostInfoCollector]{
+		Name:            "HostInfo",
+		Flag:            "host-info",
+		Description:     "Host Info Metrics",
+		DefaultInterval: "5m",
+		New:             func() *HostInfoCollector { return &HostInfoCollector{} }})
+}
+
+// Location is the position of the host in WGS84 degrees. Altitude (above the mean sea level) and Accuracy (the
+// horizontal error) are in meters, nil when the source does not know them
+type Location struct {
+	Latitude  float64
+	Longitude float64
+	Altitude  *float64
+	Accuracy  *float64
+	// file, gpsd, nmea or static
+	Source string
+	// empty if disabled
+	Geohash string
+}
+
+// labels returns the latitude and longitude labels of tlum_host_info, empty when the location is unknown
+func (l *Location) labels() (latitude, longitude string) {
+	if l == nil {
+		return "", ""
+	}
+	return strconv.FormatFloat(l.Latitude, 'f', -1, 64), strconv.FormatFloat(l.Longitude, 'f', -1, 64)
+}
+
 type HostInfoCollector struct {
-	Os        string
-	Ip        string
-	Arch      string
-	Latitutde string
-	Longitude string
-	Hostname  string
-	Id        string
-
-	gauge metric.Int64ObservableGauge
+	Os       string
+	Ip       string
+	Arch     string
+	Hostname string
+	Id       string
+	// nil when no source knows the location
+	Location *Location
+
+	gauge     metric.Int64ObservableGauge
+	latitude  metric.Float64ObservableGauge
+	longitude metric.Float64ObservableGauge
+	altitude  metric.Float64ObservableGauge
+	accuracy  metric.Float64ObservableGauge
+}
+
+func (c *HostInfoCollector) Clone() *HostInfoCollector {
+	clone := *c
+	return &clone
 }
 
 func (c *HostInfoCollector) GetMetrics(meter metric.Meter) []metric.Observable {
@@ -55,20 +95,50 @@ func (c *HostInfoCollector) GetMetrics(meter metric.Meter) []metric.Observable {
 			log.Fatal(err)
 		}
 		c.gauge = gauge
+
+		var errs [4]error
+		// the exporter has no suffix for degrees, so the names carry their unit
+		c.latitude, errs[0] = meter.Float64ObservableGauge("tlum_host_location_latitude_degrees", api.WithUnit("deg"), api.WithDescription("latitude of the host"))
+		c.longitude, errs[1] = meter.Float64ObservableGauge("tlum_host_location_longitude_degrees", api.WithUnit("deg"), api.WithDescription("longitude of the host"))
+		c.altitude, errs[2] = meter.Float64ObservableGauge("tlum_host_location_altitude_meters", api.WithUnit("m"), api.WithDescription("altitude of the host above the mean sea level"))
+		c.accuracy, errs[3] = meter.Float64ObservableGauge("tlum_host_location_accuracy_meters", api.WithUnit("m"), api.WithDescription("horizontal error of the location of the host"))
+		for _, err := range errs {
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
 	}
 
-	return []metric.Observable{c.gauge}
+	return []metric.Observable{c.gauge, c.latitude, c.longitude, c.altitude, c.accuracy}
 }
 
 func (c *HostInfoCollector) CreateObservations(ctx context.Context, o api.Observer, logger zerolog.Logger) {
+	latitude, longitude := c.Location.labels()
 	opt := api.WithAttributes(
 		attribute.Key("os").String(c.Os),
 		attribute.Key("ip").String(c.Ip),
 		attribute.Key("arch").String(c.Arch),
-		attribute.Key("latitude").String(c.Latitutde),
-		attribute.Key("longitude").String(c.Longitude),
+		attribute.Key("latitude").String(latitude),
+		attribute.Key("longitude").String(longitude),
 		attribute.Key("hostname").String(c.Hostname),
 		attribute.Key("id").String(c.Id))
 
 	o.ObserveInt64(c.gauge, 1, opt)
+
+	if c.Location == nil {
+		return
+	}
+	attrs := []attribute.KeyValue{attribute.Key("source").String(c.Location.Source)}
+	if c.Location.Geohash != "" {
+		attrs = append(attrs, attribute.Key("geohash").String(c.Location.Geohash))
+	}
+	opt = api.WithAttributes(attrs...)
+	o.ObserveFloat64(c.latitude, c.Location.Latitude, opt)
+	o.ObserveFloat64(c.longitude, c.Location.Longitude, opt)
+	if c.Location.Altitude != nil {
+		o.ObserveFloat64(c.altitude, *c.Location.Altitude, opt)
+	}
+	if c.Location.Accuracy != nil {
+		o.ObserveFloat64(c.accuracy, *c.Location.Accuracy, opt)
+	}
 }
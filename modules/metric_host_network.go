@@ -0,0 +1,131 @@
+/*
+ICOS Telemetruum Agent
+Copyright © 2022-2024 Engineering Ingegneria Informatica S.p.A.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+This work has received funding from the European Union's HORIZON research
+and innovation programme under grant agreement No. 101070177.
+*/
+
+package modules
+
+import (
+	"context"
+	"log"
+
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	api "go.opentelemetry.io/otel/metric"
+)
+
+// NetworkInterface is a network interface of the host with its traffic counters since boot
+type NetworkInterface struct {
+	Name      string
+	MAC       string
+	MTU       int64
+	OperState string
+	// Link speed in bytes per second, nil when the driver does not report it (e.g. virtual interfaces)
+	Speed *int64
+	// IPv4 and IPv6 addresses in CIDR notation
+	Addresses []string
+
+	ReceiveBytes    int64
+	TransmitBytes   int64
+	ReceivePackets  int64
+	TransmitPackets int64
+	ReceiveErrors   int64
+	TransmitErrors  int64
+	ReceiveDropped  int64
+	TransmitDropped int64
+}
+
+func init() {
+	RegisterCollector(CollectorRegistration[*HostNetworkCollector]{
+		Name:            "HostNetwork",
+		Flag:            "host-network",
+		Description:     "Host Network Metrics",
+		DefaultInterval: "1m",
+		New:             func() *HostNetworkCollector { return &HostNetworkCollector{} }})
+}
+
+type HostNetworkCollector struct {
+	Interfaces []*NetworkInterface
+
+	info    metric.Int64ObservableGauge
+	address metric.Int64ObservableGauge
+	mtu     metric.Int64ObservableGauge
+	speed   metric.Int64ObservableGauge
+	io      metric.Int64ObservableCounter
+	packets metric.Int64ObservableCounter
+	errors  metric.Int64ObservableCounter
+	dropped metric.Int64ObservableCounter
+}
+
+func (c *HostNetworkCollector) Clone() *HostNetworkCollector {
+	clone := *c
+	clone.Interfaces = append([]*NetworkInterface(nil), c.Interfaces...)
+	return &clone
+}
+
+func (c *HostNetworkCollector) GetMetrics(meter metric.Meter) []metric.Observable {
+
+	if c.info == nil {
+		var errs [8]error
+		c.info, errs[0] = meter.Int64ObservableGauge("tlum_host_network_interface_info", api.WithDescription("info about the network interfaces of the host"))
+		c.address, errs[1] = meter.Int64ObservableGauge("tlum_host_network_address_info", api.WithDescription("addresses of the network interfaces of the host"))
+		c.mtu, errs[2] = meter.Int64ObservableGauge("tlum_host_network_interface_mtu", api.WithUnit("By"), api.WithDescription("MTU of the network interface"))
+		c.speed, errs[3] = meter.Int64ObservableGauge("tlum_host_network_interface_speed", api.WithUnit("By/s"), api.WithDescription("link speed of the network interface"))
+		c.io, errs[4] = meter.Int64ObservableCounter("system.network.io", api.WithUnit("By"), api.WithDescription("bytes received and transmitted"))
+		c.packets, errs[5] = meter.Int64ObservableCounter("system.network.packets", api.WithUnit("{packet}"), api.WithDescription("packets received and transmitted"))
+		c.errors, errs[6] = meter.Int64ObservableCounter("system.network.errors", api.WithUnit("{error}"), api.WithDescription("receive and transmit errors"))
+		c.dropped, errs[7] = meter.Int64ObservableCounter("system.network.dropped", api.WithUnit("{packet}"), api.WithDescription("packets dropped while receiving and transmitting"))
+		for _, err := range errs {
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	return []metric.Observable{c.info, c.address, c.mtu, c.speed, c.io, c.packets, c.errors, c.dropped}
+}
+
+func (c *HostNetworkCollector) CreateObservations(ctx context.Context, o api.Observer, logger zerolog.Logger) {
+
+	for _, i := range c.Interfaces {
+		name := attribute.Key("interface").String(i.Name)
+		o.ObserveInt64(c.info, 1, api.WithAttributes(name,
+			attribute.Key("mac").String(i.MAC),
+			attribute.Key("operstate").String(i.OperState)))
+		for _, a := range i.Addresses {
+			o.ObserveInt64(c.address, 1, api.WithAttributes(name, attribute.Key("address").String(a), attribute.Key("family").String(addressFamily(a))))
+		}
+		o.ObserveInt64(c.mtu, i.MTU, api.WithAttributes(name))
+		if i.Speed != nil {
+			o.ObserveInt64(c.speed, *i.Speed, api.WithAttributes(name))
+		}
+
+		iface := attribute.Key("network.interface.name").String(i.Name)
+		receive := api.WithAttributes(iface, attribute.Key("network.io.direction").String("receive"))
+		transmit := api.WithAttributes(iface, attribute.Key("network.io.direction").String("transmit"))
+		o.ObserveInt64(c.io, i.ReceiveBytes, receive)
+		o.ObserveInt64(c.io, i.TransmitBytes, transmit)
+		o.ObserveInt64(c.packets, i.ReceivePackets, receive)
+		o.ObserveInt64(c.packets, i.TransmitPackets, transmit)
+		o.ObserveInt64(c.errors, i.ReceiveErrors, receive)
+		o.ObserveInt64(c.errors, i.TransmitErrors, transmit)
+		o.ObserveInt64(c.dropped, i.ReceiveDropped, receive)
+		o.ObserveInt64(c.dropped, i.TransmitDropped, transmit)
+	}
+}
@@ -0,0 +1,162 @@
+/*
+ICOS Telemetruum Agent
+Copyright © 2022-2024 Engineering Ingegneria Informatica S.p.A.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+This work has received funding from the European Union's HORIZON research
+and innovation programme under grant agreement No. 101070177.
+*/
+
+package modules
+
+import (
+	"context"
+	"log"
+
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	api "go.opentelemetry.io/otel/metric"
+)
+
+// CPUTimes are the seconds spent by all the CPUs in each mode since boot
+type CPUTimes struct {
+	User      float64
+	Nice      float64
+	System    float64
+	Idle      float64
+	Iowait    float64
+	Interrupt float64
+	SoftIRQ   float64
+	Steal     float64
+}
+
+func init() {
+	RegisterCollector(CollectorRegistration[*HostResourcesCollector]{
+		Name:            "HostResources",
+		Flag:            "host-resources",
+		Description:     "Host Resources Metrics",
+		DefaultInterval: "30s",
+		New:             func() *HostResourcesCollector { return &HostResourcesCollector{} }})
+}
+
+// HostResourcesCollector reports the utilization of the host, with the names of the OpenTelemetry system.*
+// semantic conventions. Memory values are in bytes
+type HostResourcesCollector struct {
+	// false until the first successful collection
+	Collected        bool
+	CPUTime          CPUTimes
+	LogicalCPUs      int64
+	Load1            float64
+	Load5            float64
+	Load15           float64
+	MemoryTotal      int64
+	MemoryAvailable  int64
+	MemoryUsed       int64
+	MemoryFree       int64
+	MemoryBuffers    int64
+	MemoryCached     int64
+	SwapUsed         int64
+	SwapFree         int64
+	UptimeSeconds    float64
+	ContextSwitches  int64
+	ProcessesCreated int64
+	ProcessesRunning int64
+	ProcessesBlocked int64
+
+	cpuTime          metric.Float64ObservableCounter
+	logicalCPUs      metric.Int64ObservableGauge
+	load1            metric.Float64ObservableGauge
+	load5            metric.Float64ObservableGauge
+	load15           metric.Float64ObservableGauge
+	memoryLimit      metric.Int64ObservableGauge
+	memoryAvailable  metric.Int64ObservableGauge
+	memoryUsage      metric.Int64ObservableGauge
+	pagingUsage      metric.Int64ObservableGauge
+	uptime           metric.Float64ObservableGauge
+	contextSwitches  metric.Int64ObservableCounter
+	processesCreated metric.Int64ObservableCounter
+	processes        metric.Int64ObservableGauge
+}
+
+func (c *HostResourcesCollector) Clone() *HostResourcesCollector {
+	clone := *c
+	return &clone
+}
+
+func (c *HostResourcesCollector) GetMetrics(meter metric.Meter) []metric.Observable {
+
+	if c.cpuTime == nil {
+		var errs [13]error
+		c.cpuTime, errs[0] = meter.Float64ObservableCounter("system.cpu.time", api.WithUnit("s"), api.WithDescription("seconds spent by all the CPUs in each mode"))
+		c.logicalCPUs, errs[1] = meter.Int64ObservableGauge("system.cpu.logical.count", api.WithDescription("number of logical CPUs"))
+		c.load1, errs[2] = meter.Float64ObservableGauge("system.cpu.load_average.1m", api.WithDescription("load average over 1 minute"))
+		c.load5, errs[3] = meter.Float64ObservableGauge("system.cpu.load_average.5m", api.WithDescription("load average over 5 minutes"))
+		c.load15, errs[4] = meter.Float64ObservableGauge("system.cpu.load_average.15m", api.WithDescription("load average over 15 minutes"))
+		c.memoryLimit, errs[5] = meter.Int64ObservableGauge("system.memory.limit", api.WithUnit("By"), api.WithDescription("total memory"))
+		c.memoryAvailable, errs[6] = meter.Int64ObservableGauge("system.linux.memory.available", api.WithUnit("By"), api.WithDescription("memory available for new workloads without swapping"))
+		c.memoryUsage, errs[7] = meter.Int64ObservableGauge("system.memory.usage", api.WithUnit("By"), api.WithDescription("memory in each state"))
+		c.pagingUsage, errs[8] = meter.Int64ObservableGauge("system.paging.usage", api.WithUnit("By"), api.WithDescription("swap space in each state"))
+		c.uptime, errs[9] = meter.Float64ObservableGauge("system.uptime", api.WithUnit("s"), api.WithDescription("time since the host booted"))
+		c.contextSwitches, errs[10] = meter.Int64ObservableCounter("system.context_switches", api.WithDescription("context switches since boot"))
+		c.processesCreated, errs[11] = meter.Int64ObservableCounter("system.processes.created", api.WithDescription("processes created since boot"))
+		c.processes, errs[12] = meter.Int64ObservableGauge("system.processes.count", api.WithDescription("number of processes in each status"))
+		for _, err := range errs {
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	return []metric.Observable{c.cpuTime, c.logicalCPUs, c.load1, c.load5, c.load15, c.memoryLimit, c.memoryAvailable,
+		c.memoryUsage, c.pagingUsage, c.uptime, c.contextSwitches, c.processesCreated, c.processes}
+}
+
+func (c *HostResourcesCollector) CreateObservations(ctx context.Context, o api.Observer, logger zerolog.Logger) {
+	if !c.Collected {
+		return
+	}
+
+	for mode, v := range map[string]float64{
+		"user":      c.CPUTime.User,
+		"nice":      c.CPUTime.Nice,
+		"system":    c.CPUTime.System,
+		"idle":      c.CPUTime.Idle,
+		"iowait":    c.CPUTime.Iowait,
+		"interrupt": c.CPUTime.Interrupt,
+		"softirq":   c.CPUTime.SoftIRQ,
+		"steal":     c.CPUTime.Steal,
+	} {
+		o.ObserveFloat64(c.cpuTime, v, api.WithAttributes(attribute.Key("cpu.mode").String(mode)))
+	}
+	o.ObserveInt64(c.logicalCPUs, c.LogicalCPUs)
+	o.ObserveFloat64(c.load1, c.Load1)
+	o.ObserveFloat64(c.load5, c.Load5)
+	o.ObserveFloat64(c.load15, c.Load15)
+
+	o.ObserveInt64(c.memoryLimit, c.MemoryTotal)
+	o.ObserveInt64(c.memoryAvailable, c.MemoryAvailable)
+	for state, v := range map[string]int64{"used": c.MemoryUsed, "free": c.MemoryFree, "buffers": c.MemoryBuffers, "cached": c.MemoryCached} {
+		o.ObserveInt64(c.memoryUsage, v, api.WithAttributes(attribute.Key("system.memory.state").String(state)))
+	}
+	for state, v := range map[string]int64{"used": c.SwapUsed, "free": c.SwapFree} {
+		o.ObserveInt64(c.pagingUsage, v, api.WithAttributes(attribute.Key("system.paging.state").String(state)))
+	}
+
+	o.ObserveFloat64(c.uptime, c.UptimeSeconds)
+	o.ObserveInt64(c.contextSwitches, c.ContextSwitches)
+	o.ObserveInt64(c.processesCreated, c.ProcessesCreated)
+	o.ObserveInt64(c.processes, c.ProcessesRunning, api.WithAttributes(attribute.Key("status").String("running")))
+	o.ObserveInt64(c.processes, c.ProcessesBlocked, api.WithAttributes(attribute.Key("status").String("blocked")))
+}
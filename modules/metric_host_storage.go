@@ -0,0 +1,150 @@
+/*
+ICOS Telemetruum Agent
+Copyright © 2022-2024 Engineering Ingegneria Informatica S.p.A.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+This work has received funding from the European Union's HORIZON research
+and innovation programme under grant agreement No. 101070177.
+*/
+
+package modules
+
+import (
+	"context"
+	"log"
+
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	api "go.opentelemetry.io/otel/metric"
+)
+
+// Filesystem is a mounted filesystem of the host. Sizes are in bytes
+type Filesystem struct {
+	Device     string
+	MountPoint string
+	Type       string
+	ReadOnly   bool
+	Size       int64
+	// Free space, including the blocks reserved to root
+	Free int64
+	// Free space available to unprivileged users
+	Available  int64
+	Inodes     int64
+	InodesFree int64
+}
+
+// BlockDevice holds the I/O counters of a block device since boot
+type BlockDevice struct {
+	Name       string
+	ReadBytes  int64
+	WriteBytes int64
+	ReadOps    int64
+	WriteOps   int64
+	// Seconds spent by all the reads and writes, divide by the operations to get the average latency
+	ReadTime  float64
+	WriteTime float64
+	// Seconds spent with at least one operation in progress
+	IOTime float64
+}
+
+func init() {
+	RegisterCollector(CollectorRegistration[*HostStorageCollector]{
+		Name:            "HostStorage",
+		Flag:            "host-storage",
+		Description:     "Host Storage Metrics",
+		DefaultInterval: "1m",
+		New:             func() *HostStorageCollector { return &HostStorageCollector{} }})
+}
+
+type HostStorageCollector struct {
+	Filesystems  []*Filesystem
+	BlockDevices []*BlockDevice
+
+	fsLimit     metric.Int64ObservableGauge
+	fsUsage     metric.Int64ObservableGauge
+	inodesUsage metric.Int64ObservableGauge
+	diskIO      metric.Int64ObservableCounter
+	diskOps     metric.Int64ObservableCounter
+	diskOpTime  metric.Float64ObservableCounter
+	diskIOTime  metric.Float64ObservableCounter
+}
+
+func (c *HostStorageCollector) Clone() *HostStorageCollector {
+	clone := *c
+	clone.Filesystems = append([]*Filesystem(nil), c.Filesystems...)
+	clone.BlockDevices = append([]*BlockDevice(nil), c.BlockDevices...)
+	return &clone
+}
+
+func (c *HostStorageCollector) GetMetrics(meter metric.Meter) []metric.Observable {
+
+	if c.fsLimit == nil {
+		var errs [7]error
+		c.fsLimit, errs[0] = meter.Int64ObservableGauge("system.filesystem.limit", api.WithUnit("By"), api.WithDescription("size of the filesystem"))
+		c.fsUsage, errs[1] = meter.Int64ObservableGauge("system.filesystem.usage", api.WithUnit("By"), api.WithDescription("filesystem space used, free and reserved to root"))
+		c.inodesUsage, errs[2] = meter.Int64ObservableGauge("system.filesystem.inodes.usage", api.WithDescription("inodes used and free"))
+		c.diskIO, errs[3] = meter.Int64ObservableCounter("system.disk.io", api.WithUnit("By"), api.WithDescription("bytes read and written"))
+		c.diskOps, errs[4] = meter.Int64ObservableCounter("system.disk.operations", api.WithDescription("reads and writes completed"))
+		c.diskOpTime, errs[5] = meter.Float64ObservableCounter("system.disk.operation_time", api.WithUnit("s"), api.WithDescription("time spent by the reads and writes"))
+		c.diskIOTime, errs[6] = meter.Float64ObservableCounter("system.disk.io_time", api.WithUnit("s"), api.WithDescription("time the device was busy"))
+		for _, err := range errs {
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	return []metric.Observable{c.fsLimit, c.fsUsage, c.inodesUsage, c.diskIO, c.diskOps, c.diskOpTime, c.diskIOTime}
+}
+
+func (c *HostStorageCollector) CreateObservations(ctx context.Context, o api.Observer, logger zerolog.Logger) {
+
+	for _, fs := range c.Filesystems {
+		mode := "rw"
+		if fs.ReadOnly {
+			mode = "ro"
+		}
+		attrs := []attribute.KeyValue{
+			attribute.Key("system.device").String(fs.Device),
+			attribute.Key("system.filesystem.mountpoint").String(fs.MountPoint),
+			attribute.Key("system.filesystem.type").String(fs.Type),
+			attribute.Key("system.filesystem.mode").String(mode),
+		}
+		withState := func(state string) api.ObserveOption {
+			return api.WithAttributes(append(attrs, attribute.Key("system.filesystem.state").String(state))...)
+		}
+
+		o.ObserveInt64(c.fsLimit, fs.Size, api.WithAttributes(attrs...))
+		o.ObserveInt64(c.fsUsage, fs.Size-fs.Free, withState("used"))
+		o.ObserveInt64(c.fsUsage, fs.Available, withState("free"))
+		o.ObserveInt64(c.fsUsage, fs.Free-fs.Available, withState("reserved"))
+		o.ObserveInt64(c.inodesUsage, fs.Inodes-fs.InodesFree, withState("used"))
+		o.ObserveInt64(c.inodesUsage, fs.InodesFree, withState("free"))
+	}
+
+	for _, d := range c.BlockDevices {
+		device := attribute.Key("system.device").String(d.Name)
+		read := api.WithAttributes(device, attribute.Key("disk.io.direction").String("read"))
+		write := api.WithAttributes(device, attribute.Key("disk.io.direction").String("write"))
+
+		o.ObserveInt64(c.diskIO, d.ReadBytes, read)
+		o.ObserveInt64(c.diskIO, d.WriteBytes, write)
+		o.ObserveInt64(c.diskOps, d.ReadOps, read)
+		o.ObserveInt64(c.diskOps, d.WriteOps, write)
+		o.ObserveFloat64(c.diskOpTime, d.ReadTime, read)
+		o.ObserveFloat64(c.diskOpTime, d.WriteTime, write)
+		o.ObserveFloat64(c.diskIOTime, d.IOTime, api.WithAttributes(device))
+	}
+}
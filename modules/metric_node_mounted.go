@@ -23,22 +23,98 @@ package modules
 import (
 	"context"
 	"log"
+	"strings"
 
+	"github.com/alecthomas/kingpin/v2"
 	"github.com/rs/zerolog"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/metric"
 	api "go.opentelemetry.io/otel/metric"
 )
 
+var (
+	peripheralInterfaces = kingpin.Flag("peripheral-interfaces", "Interface of the peripherals reported by node_mounted, e.g. USB or Bluetooth (repeatable). By default all the interfaces are reported").PlaceHolder("INTERFACE").Strings()
+)
+
 type Peripheral struct {
 	Device       string
 	ResourcePath string
 	Available    bool
+	// Provider that found the peripheral, e.g. nuvla or usb
+	Source string
+	// How the peripheral is connected, e.g. USB, Bluetooth, GPU or Network
+	Interface string
+	// USB descriptors, empty when the source does not read them
+	VendorID     string
+	ProductID    string
+	Manufacturer string
+	Serial       string
+	Class        string
+	// Other fields of the source, published by tlum_peripheral_info
+	Details map[string]string
+}
+
+// ExtendedResource is a resource advertised by a Kubernetes device plugin, e.g. nvidia.com/gpu
+type ExtendedResource struct {
+	Name        string
+	Capacity    int64
+	Allocatable int64
+	// Assigned to the containers of the node
+	InUse int64
+}
+
+// peripheralAllowed tells if the peripherals of an interface are reported. An empty allowlist allows all of them
+func peripheralAllowed(allow []string, iface string) bool {
+	if len(allow) == 0 {
+		return true
+	}
+	for _, a := range allow {
+		if strings.EqualFold(a, iface) {
+			return true
+		}
+	}
+	return false
+}
+
+func init() {
+	RegisterCollector(CollectorRegistration[*NodeMountedCollector]{
+		Name:            "NodeMounted",
+		Flag:            "node-mount",
+		Description:     "Node Mounted Metrics",
+		DefaultInterval: "1m",
+		New:             func() *NodeMountedCollector { return &NodeMountedCollector{} }})
 }
 
 type NodeMountedCollector struct {
 	AttachedPeripherals []*Peripheral
+	ExtendedResources   []*ExtendedResource
 	gauge               metric.Int64ObservableGauge
+	details             metric.Int64ObservableGauge
+	capacity            metric.Int64ObservableGauge
+	allocatable         metric.Int64ObservableGauge
+	inUse               metric.Int64ObservableGauge
+}
+
+func (c *NodeMountedCollector) Clone() *NodeMountedCollector {
+	clone := *c
+	clone.AttachedPeripherals = append([]*Peripheral(nil), c.AttachedPeripherals...)
+	clone.ExtendedResources = append([]*ExtendedResource(nil), c.ExtendedResources...)
+	return &clone
+}
+
+// setPeripherals replaces the peripherals of a source, keeping the ones found by the other providers
+func (c *NodeMountedCollector) setPeripherals(source string, peripherals []*Peripheral) {
+	merged := make([]*Peripheral, 0, len(c.AttachedPeripherals)+len(peripherals))
+	for _, p := range c.AttachedPeripherals {
+		if p.Source != source {
+			merged = append(merged, p)
+		}
+	}
+	for _, p := range peripherals {
+		p.Source = source
+		merged = append(merged, p)
+	}
+	c.AttachedPeripherals = merged
 }
 
 func (c *NodeMountedCollector) GetMetrics(meter metric.Meter) []metric.Observable {
@@ -49,9 +125,25 @@ func (c *NodeMountedCollector) GetMetrics(meter metric.Meter) []metric.Observabl
 			log.Fatal(err)
 		}
 		c.gauge = gauge
+
+		details, err := meter.Int64ObservableGauge("tlum_peripheral_info", api.WithDescription("details of the attached peripherals"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		c.details = details
+
+		var errs [3]error
+		c.capacity, errs[0] = meter.Int64ObservableGauge("tlum_node_extended_resource_capacity", api.WithDescription("devices of an extended resource on the node"))
+		c.allocatable, errs[1] = meter.Int64ObservableGauge("tlum_node_extended_resource_allocatable", api.WithDescription("devices of an extended resource that can be assigned to the pods"))
+		c.inUse, errs[2] = meter.Int64ObservableGauge("tlum_node_extended_resource_in_use", api.WithDescription("devices of an extended resource assigned to the pods"))
+		for _, err := range errs {
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
 	}
 
-	return []metric.Observable{c.gauge}
+	return []metric.Observable{c.gauge, c.details, c.capacity, c.allocatable, c.inUse}
 }
 
 func (c *NodeMountedCollector) CreateObservations(ctx context.Context, o api.Observer, logger zerolog.Logger) {
@@ -59,7 +151,14 @@ func (c *NodeMountedCollector) CreateObservations(ctx context.Context, o api.Obs
 	for _, p := range c.AttachedPeripherals {
 		opt := api.WithAttributes(
 			attribute.Key("device").String(p.Device),
-			attribute.Key("resource_path").String(p.ResourcePath))
+			attribute.Key("resource_path").String(p.ResourcePath),
+			attribute.Key("source").String(p.Source),
+			attribute.Key("interface").String(p.Interface),
+			attribute.Key("vendor_id").String(p.VendorID),
+			attribute.Key("product_id").String(p.ProductID),
+			attribute.Key("manufacturer").String(p.Manufacturer),
+			attribute.Key("serial").String(p.Serial),
+			attribute.Key("device_class").String(p.Class))
 
 		var val int64 = 1
 
@@ -68,5 +167,24 @@ func (c *NodeMountedCollector) CreateObservations(ctx context.Context, o api.Obs
 		}
 
 		o.ObserveInt64(c.gauge, val, opt)
+
+		if len(p.Details) > 0 {
+			attrs := []attribute.KeyValue{
+				attribute.Key("device").String(p.Device),
+				attribute.Key("resource_path").String(p.ResourcePath),
+				attribute.Key("source").String(p.Source),
+			}
+			for _, k := range sortedKeys(p.Details) {
+				attrs = append(attrs, attribute.Key(k).String(p.Details[k]))
+			}
+			o.ObserveInt64(c.details, 1, api.WithAttributes(attrs...))
+		}
+	}
+
+	for _, r := range c.ExtendedResources {
+		opt := api.WithAttributes(attribute.Key("resource").String(r.Name))
+		o.ObserveInt64(c.capacity, r.Capacity, opt)
+		o.ObserveInt64(c.allocatable, r.Allocatable, opt)
+		o.ObserveInt64(c.inUse, r.InUse, opt)
 	}
 }
@@ -30,6 +30,15 @@ import (
 	api "go.opentelemetry.io/otel/metric"
 )
 
+func init() {
+	RegisterCollector(CollectorRegistration[*OrchInfoCollector]{
+		Name:            "OrchInfo",
+		Flag:            "orch-info",
+		Description:     "Orchestrator Info Metrics",
+		DefaultInterval: "2m",
+		New:             func() *OrchInfoCollector { return &OrchInfoCollector{} }})
+}
+
 type OrchInfoCollector struct {
 	Type      string
 	AgentId   string
@@ -39,6 +48,11 @@ type OrchInfoCollector struct {
 	gaugeOld  metric.Int64ObservableGauge
 }
 
+func (c *OrchInfoCollector) Clone() *OrchInfoCollector {
+	clone := *c
+	return &clone
+}
+
 func (c *OrchInfoCollector) GetMetrics(meter metric.Meter) []metric.Observable {
 
 	if c.gauge == nil {
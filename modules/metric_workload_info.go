@@ -36,6 +36,15 @@ type WorkloadInfo struct {
 	Annotations map[string]string
 }
 
+func init() {
+	RegisterCollector(CollectorRegistration[*WorkloadInfoCollector]{
+		Name:            "WorkloadInfo",
+		Flag:            "workload-info",
+		Description:     "Workload Info Metrics",
+		DefaultInterval: "1m",
+		New:             func() *WorkloadInfoCollector { return &WorkloadInfoCollector{} }})
+}
+
 type WorkloadInfoCollector struct {
 	RunningWorkloads []*WorkloadInfo
 	HostId           string
@@ -43,6 +52,12 @@ type WorkloadInfoCollector struct {
 	gauge            metric.Int64ObservableGauge
 }
 
+func (c *WorkloadInfoCollector) Clone() *WorkloadInfoCollector {
+	clone := *c
+	clone.RunningWorkloads = append([]*WorkloadInfo(nil), c.RunningWorkloads...)
+	return &clone
+}
+
 func (c *WorkloadInfoCollector) GetMetrics(meter metric.Meter) []metric.Observable {
 
 	if c.gauge == nil {
@@ -59,19 +74,23 @@ func (c *WorkloadInfoCollector) GetMetrics(meter metric.Meter) []metric.Observab
 func (c *WorkloadInfoCollector) CreateObservations(ctx context.Context, o api.Observer, logger zerolog.Logger) {
 
 	for _, w := range c.RunningWorkloads {
+		opt := api.WithAttributeSet(workloadAttributes(w, c.ClusterId, c.HostId))
 
-		var annotationAttributes []attribute.KeyValue
-
-		annotationAttributes = append(annotationAttributes, attribute.Key("name").String(w.Name))
-		annotationAttributes = append(annotationAttributes, attribute.Key("cluster_id").String(c.ClusterId))
-		annotationAttributes = append(annotationAttributes, attribute.Key("host_id").String(c.HostId))
+		o.ObserveInt64(c.gauge, 1, opt)
+	}
+}
 
-		for k, v := range w.Annotations {
-			annotationAttributes = append(annotationAttributes, attribute.Key(k).String(v))
-		}
+// workloadAttributes are the labels that identify a workload in all the tlum_workload_* metrics
+func workloadAttributes(w *WorkloadInfo, clusterId string, hostId string) attribute.Set {
+	var annotationAttributes []attribute.KeyValue
 
-		opt := api.WithAttributeSet(attribute.NewSet(annotationAttributes...))
+	annotationAttributes = append(annotationAttributes, attribute.Key("name").String(w.Name))
+	annotationAttributes = append(annotationAttributes, attribute.Key("cluster_id").String(clusterId))
+	annotationAttributes = append(annotationAttributes, attribute.Key("host_id").String(hostId))
 
-		o.ObserveInt64(c.gauge, 1, opt)
+	for k, v := range w.Annotations {
+		annotationAttributes = append(annotationAttributes, attribute.Key(k).String(v))
 	}
+
+	return attribute.NewSet(annotationAttributes...)
 }
@@ -0,0 +1,138 @@
+/*
+ICOS Telemetruum Agent
+Copyright © 2022-2024 Engineering Ingegneria Informatica S.p.A.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+This work has received funding from the European Union's HORIZON research
+and innovation programme under grant agreement No. 101070177.
+*/
+
+package modules
+
+import (
+	"context"
+	"log"
+
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	api "go.opentelemetry.io/otel/metric"
+)
+
+// WorkloadUsage is the resource usage of a workload. Counters are cumulative since the workload started
+type WorkloadUsage struct {
+	WorkloadInfo
+	// Container is set for the containers of a pod, whose totals are reported without it
+	Container  string
+	CPUSeconds float64
+	// Memory used without the inactive page cache (the working set)
+	MemoryUsage int64
+	// The following values are nil when the source does not report them
+	MemoryLimit      *int64
+	MemoryCache      *int64
+	NetworkRx        *int64
+	NetworkTx        *int64
+	BlockRead        *int64
+	BlockWrite       *int64
+	EphemeralStorage *int64
+}
+
+func init() {
+	RegisterCollector(CollectorRegistration[*WorkloadUsageCollector]{
+		Name:            "WorkloadUsage",
+		Flag:            "workload-usage",
+		Description:     "Workload Usage Metrics",
+		DefaultInterval: "30s",
+		New:             func() *WorkloadUsageCollector { return &WorkloadUsageCollector{} }})
+}
+
+type WorkloadUsageCollector struct {
+	Workloads   []*WorkloadUsage
+	HostId      string
+	ClusterId   string
+	cpu         metric.Float64ObservableCounter
+	memory      metric.Int64ObservableGauge
+	memoryLimit metric.Int64ObservableGauge
+	memoryCache metric.Int64ObservableGauge
+	networkRx   metric.Int64ObservableCounter
+	networkTx   metric.Int64ObservableCounter
+	blockRead   metric.Int64ObservableCounter
+	blockWrite  metric.Int64ObservableCounter
+	ephemeral   metric.Int64ObservableGauge
+}
+
+func (c *WorkloadUsageCollector) Clone() *WorkloadUsageCollector {
+	clone := *c
+	clone.Workloads = append([]*WorkloadUsage(nil), c.Workloads...)
+	return &clone
+}
+
+func (c *WorkloadUsageCollector) GetMetrics(meter metric.Meter) []metric.Observable {
+
+	if c.cpu == nil {
+		var errs [9]error
+		c.cpu, errs[0] = meter.Float64ObservableCounter("tlum_workload_cpu_time", api.WithUnit("s"), api.WithDescription("CPU time used by the workload"))
+		c.memory, errs[1] = meter.Int64ObservableGauge("tlum_workload_memory_usage", api.WithUnit("By"), api.WithDescription("memory used by the workload, without the inactive page cache"))
+		c.memoryLimit, errs[2] = meter.Int64ObservableGauge("tlum_workload_memory_limit", api.WithUnit("By"), api.WithDescription("memory limit of the workload"))
+		c.memoryCache, errs[3] = meter.Int64ObservableGauge("tlum_workload_memory_cache", api.WithUnit("By"), api.WithDescription("page cache used by the workload"))
+		c.networkRx, errs[4] = meter.Int64ObservableCounter("tlum_workload_network_receive", api.WithUnit("By"), api.WithDescription("bytes received by the workload"))
+		c.networkTx, errs[5] = meter.Int64ObservableCounter("tlum_workload_network_transmit", api.WithUnit("By"), api.WithDescription("bytes transmitted by the workload"))
+		c.blockRead, errs[6] = meter.Int64ObservableCounter("tlum_workload_block_read", api.WithUnit("By"), api.WithDescription("bytes read by the workload from block devices"))
+		c.blockWrite, errs[7] = meter.Int64ObservableCounter("tlum_workload_block_write", api.WithUnit("By"), api.WithDescription("bytes written by the workload to block devices"))
+		c.ephemeral, errs[8] = meter.Int64ObservableGauge("tlum_workload_ephemeral_storage_usage", api.WithUnit("By"), api.WithDescription("local ephemeral storage used by the workload"))
+		for _, err := range errs {
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	return []metric.Observable{c.cpu, c.memory, c.memoryLimit, c.memoryCache, c.networkRx, c.networkTx, c.blockRead, c.blockWrite, c.ephemeral}
+}
+
+func (c *WorkloadUsageCollector) CreateObservations(ctx context.Context, o api.Observer, logger zerolog.Logger) {
+
+	for _, w := range c.Workloads {
+		attrs := workloadAttributes(&w.WorkloadInfo, c.ClusterId, c.HostId)
+		if w.Container != "" {
+			kvs := append(attrs.ToSlice(), attribute.Key("container").String(w.Container))
+			attrs = attribute.NewSet(kvs...)
+		}
+		opt := api.WithAttributeSet(attrs)
+
+		o.ObserveFloat64(c.cpu, w.CPUSeconds, opt)
+		o.ObserveInt64(c.memory, w.MemoryUsage, opt)
+
+		for _, optional := range []struct {
+			instrument api.Int64Observable
+			value      *int64
+		}{
+			{c.memoryLimit, w.MemoryLimit},
+			{c.memoryCache, w.MemoryCache},
+			{c.networkRx, w.NetworkRx},
+			{c.networkTx, w.NetworkTx},
+			{c.blockRead, w.BlockRead},
+			{c.blockWrite, w.BlockWrite},
+			{c.ephemeral, w.EphemeralStorage},
+		} {
+			if optional.value != nil {
+				o.ObserveInt64(optional.instrument, *optional.value, opt)
+			}
+		}
+	}
+}
+
+func int64Ptr(v int64) *int64 {
+	return &v
+}
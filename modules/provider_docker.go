@@ -23,26 +23,47 @@ package modules
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/rs/zerolog"
 
-	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/client"
 )
 
-var ()
+func init() {
+	RegisterProvider(ProviderRegistration{
+		Name:     "Docker",
+		Flag:     "docker",
+		Priority: 30,
+		Initialize: func(cfg *Config, logger zerolog.Logger) (Provider, error) {
+			return InizializeDockerProvider(cfg, logger)
+		},
+		Settings: func(cfg *Config) any {
+			return []any{cfg.PathRootFs, cfg.DockerReconcileInterval, cfg.PeripheralInterfaces}
+		},
+		Feeds: []ProviderFeed{
+			Feed((*DockerProvider).ProvideWorkloadInfo),
+			Feed((*DockerProvider).ProvideWorkloadUsage),
+			Feed((*DockerProvider).ProvideNuvlaOrchestratorInfo),
+			Feed((*DockerProvider).ProvideNuvlaAttachedPeripherals),
+		}})
+}
 
 type DockerProvider struct {
 	BaseProvider
 	DockerClient *client.Client
 	Id           string
+	containers   *containerWatcher
+	// Interfaces of the Nuvla peripherals to report, all if empty
+	PeripheralInterfaces []string
 }
 
-func InizializeDockerProvider(logger zerolog.Logger) (*DockerProvider, error) {
+func InizializeDockerProvider(cfg *Config, logger zerolog.Logger) (*DockerProvider, error) {
 	cli, _ := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	info, err := cli.Info(context.TODO())
 	if err != nil {
@@ -50,56 +71,104 @@ func InizializeDockerProvider(logger zerolog.Logger) (*DockerProvider, error) {
 		return nil, err
 	}
 
-	return &DockerProvider{Id: info.Swarm.NodeID, DockerClient: cli, BaseProvider: BaseProvider{Logger: logger}}, nil
+	containers := &containerWatcher{
+		api:               cli,
+		table:             newContainerTable(),
+		reconcileInterval: time.Duration(cfg.DockerReconcileInterval),
+		logger:            logger,
+	}
+
+	return &DockerProvider{Id: info.Swarm.NodeID, DockerClient: cli, containers: containers, PeripheralInterfaces: cfg.PeripheralInterfaces, BaseProvider: BaseProvider{Logger: logger, PathRootFs: cfg.PathRootFs}}, nil
 }
 
+// Start follows the Docker events to keep the container table up to date
 func (kd *DockerProvider) Start(ctx context.Context, wg *sync.WaitGroup) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		kd.containers.run(ctx)
+	}()
 }
 
-func (kd *DockerProvider) ProvideWorkloadInfo(ctx context.Context, c *WorkloadInfoCollector) {
-	containers, err := kd.DockerClient.ContainerList(ctx, container.ListOptions{})
-	if err != nil {
-		panic(err)
-	}
-	res := []*WorkloadInfo{}
-
-	for _, ctr := range containers {
-		wi := &WorkloadInfo{Name: ctr.Names[0], Annotations: map[string]string{}}
-		res = append(res, wi)
-
-		for k, v := range ctr.Labels {
-			if m1.MatchString(k) {
-				newK := m1.ReplaceAllString(k, "icos.$1.$2")
-				wi.Annotations[newK] = v
-			}
+func (kd *DockerProvider) ProvideWorkloadInfo(ctx context.Context, c *WorkloadInfoCollector) error {
+	// while the events stream is down the table is refreshed with a full list
+	if !kd.containers.table.isSynced() {
+		if err := kd.containers.reconcile(ctx); err != nil {
+			return err
 		}
-
 	}
 
-	c.RunningWorkloads = res
+	c.RunningWorkloads = kd.containers.table.workloads()
 	c.ClusterId = kd.Id
+
+	return nil
 }
 
-func (kd *DockerProvider) ProvideNuvlaOrchestratorInfo(ctx context.Context, oic *OrchInfoCollector) {
-	CommonProvideNuvlaOrchestratorInfo(ctx, filepath.Join(*pathRootFs, "/nuvla_peripherals/.context"), oic, kd.Logger)
+func (kd *DockerProvider) ProvideNuvlaOrchestratorInfo(ctx context.Context, oic *OrchInfoCollector) error {
+	return CommonProvideNuvlaOrchestratorInfo(ctx, filepath.Join(kd.PathRootFs, "/nuvla_peripherals/.context"), oic, kd.Logger)
 }
 
 type NuvlaPeripheralFileStruct struct {
-	Identifier string `json:"identifier"`
-	Available  bool   `json:"available"`
-	Interface  string `json:"interface"`
-	DevicePath string `json:"device-path"`
-	Name       string `json:"name"`
+	Identifier   string   `json:"identifier"`
+	Available    bool     `json:"available"`
+	Interface    string   `json:"interface"`
+	DevicePath   string   `json:"device-path"`
+	Name         string   `json:"name"`
+	Description  string   `json:"description"`
+	Vendor       string   `json:"vendor"`
+	Product      string   `json:"product"`
+	Classes      []string `json:"classes"`
+	SerialNumber string   `json:"serial-number"`
+	// a number, but some versions of NuvlaEdge write it as a string
+	Port        any    `json:"port"`
+	VideoDevice string `json:"video-device"`
 }
 
-func (kd *DockerProvider) ProvideNuvlaAttachedPeripherals(ctx context.Context, oic *NodeMountedCollector) {
+// nuvlaPeripheral converts a peripheral discovered by NuvlaEdge
+func nuvlaPeripheral(v NuvlaPeripheralFileStruct) *Peripheral {
+	p := &Peripheral{
+		Device:       strings.ToLower(strings.ReplaceAll(v.Name, " ", "-")) + "_" + strings.ToLower(strings.ReplaceAll(v.Identifier, ":", "_")),
+		ResourcePath: v.DevicePath,
+		Available:    v.Available,
+		Interface:    v.Interface,
+		Manufacturer: v.Vendor,
+		Serial:       v.SerialNumber,
+		Class:        strings.Join(v.Classes, ","),
+		Details:      map[string]string{},
+	}
+	// the USB peripherals are identified by vendor:product
+	if vendor, product, ok := strings.Cut(v.Identifier, ":"); ok && strings.EqualFold(v.Interface, "USB") {
+		p.VendorID, p.ProductID = strings.ToLower(vendor), strings.ToLower(product)
+	}
 
-	peripheral_files := filepath.Join(*pathRootFs, "/nuvla_peripherals/.peripherals/local_peripherals.json")
+	for key, value := range map[string]string{
+		"identifier":   v.Identifier,
+		"name":         v.Name,
+		"description":  v.Description,
+		"product":      v.Product,
+		"video_device": v.VideoDevice,
+	} {
+		if value != "" {
+			p.Details[key] = value
+		}
+	}
+	if v.Port != nil {
+		p.Details["port"] = fmt.Sprint(v.Port)
+	}
+	return p
+}
+
+func (kd *DockerProvider) ProvideNuvlaAttachedPeripherals(ctx context.Context, oic *NodeMountedCollector) error {
+
+	peripheral_files := filepath.Join(kd.PathRootFs, "/nuvla_peripherals/.peripherals/local_peripherals.json")
 
 	nuvlaFile, err := os.ReadFile(peripheral_files) // just pass the file name
-	if err != nil {
+	if os.IsNotExist(err) {
 		kd.Logger.Warn().Msgf("Error reading Nuvla context file at %s: %s\n", peripheral_files, err)
-		return
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading Nuvla peripherals file at %s: %w", peripheral_files, err)
 	}
 
 	var nuvlaPeripherals map[string]NuvlaPeripheralFileStruct
@@ -107,23 +176,19 @@ func (kd *DockerProvider) ProvideNuvlaAttachedPeripherals(ctx context.Context, o
 	err = json.Unmarshal(nuvlaFile, &nuvlaPeripherals)
 
 	if err != nil {
-		kd.Logger.Warn().Msgf("Error unmarshalling Nuvla peripherals file: %s", err)
-		return
+		return fmt.Errorf("error unmarshalling Nuvla peripherals file: %w", err)
 	}
 
 	res := []*Peripheral{}
-	for _, v := range nuvlaPeripherals {
-
-		if v.Interface != "USB" {
+	for _, k := range sortedKeys(nuvlaPeripherals) {
+		v := nuvlaPeripherals[k]
+		if !peripheralAllowed(kd.PeripheralInterfaces, v.Interface) {
 			continue
 		}
-
-		device := strings.ToLower(strings.ReplaceAll(v.Name, " ", "-")) + "_" + strings.ToLower(strings.ReplaceAll(v.Identifier, ":", "_"))
-
-		p := &Peripheral{Device: device, Available: v.Available, ResourcePath: v.DevicePath}
-
-		res = append(res, p)
+		res = append(res, nuvlaPeripheral(v))
 	}
 
-	oic.AttachedPeripherals = res
+	oic.setPeripherals("nuvla", res)
+
+	return nil
 }
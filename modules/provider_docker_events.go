@@ -0,0 +1,286 @@
+/*
+ICOS Telemetruum Agent
+Copyright © 2022-2024 Engineering Ingegneria Informatica S.p.A.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+This work has received funding from the European Union's HORIZON research
+and innovation programme under grant agreement No. 101070177.
+*/
+
+package modules
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/rs/zerolog"
+)
+
+var (
+	dockerReconcileInterval = kingpin.Flag("docker-reconcile-interval", "Interval of the full container list that reconciles the container table built from the Docker events").Default("5m").Duration()
+)
+
+// dockerEventsAPI is the subset of the Docker client used by the container watcher
+type dockerEventsAPI interface {
+	ContainerList(ctx context.Context, options container.ListOptions) ([]types.Container, error)
+	Events(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error)
+}
+
+// event attributes that are not container labels
+var dockerEventAttributes = map[string]bool{"name": true, "image": true, "exitCode": true, "signal": true, "execDuration": true}
+
+type dockerContainer struct {
+	Name    string
+	Labels  map[string]string
+	Running bool
+	// the container started after the last read of the table
+	pending bool
+	// the container was destroyed but is kept until it is read once
+	removed bool
+}
+
+// containerTable is the in-memory state of the containers, kept up to date by the Docker events. Containers that
+// start and stop between two reads are still reported once
+type containerTable struct {
+	mu         sync.Mutex
+	containers map[string]*dockerContainer
+	synced     bool
+}
+
+func newContainerTable() *containerTable {
+	return &containerTable{containers: map[string]*dockerContainer{}}
+}
+
+func (t *containerTable) upsert(id string, name string, labels map[string]string) *dockerContainer {
+	c, ok := t.containers[id]
+	if !ok {
+		c = &dockerContainer{}
+		t.containers[id] = c
+	}
+	c.Name, c.Labels, c.removed = name, labels, false
+	return c
+}
+
+func (t *containerTable) remove(id string) {
+	if c, ok := t.containers[id]; ok {
+		if c.pending {
+			c.Running, c.removed = false, true
+		} else {
+			delete(t.containers, id)
+		}
+	}
+}
+
+// apply updates the table with a create, start, die or destroy event
+func (t *containerTable) apply(msg events.Message) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	id := msg.Actor.ID
+	switch msg.Action {
+	case events.ActionCreate, events.ActionStart:
+		labels := map[string]string{}
+		for k, v := range msg.Actor.Attributes {
+			if !dockerEventAttributes[k] {
+				labels[k] = v
+			}
+		}
+		c := t.upsert(id, "/"+msg.Actor.Attributes["name"], labels)
+		if msg.Action == events.ActionStart {
+			c.Running, c.pending = true, true
+		}
+	case events.ActionDie:
+		if c, ok := t.containers[id]; ok {
+			c.Running = false
+		}
+	case events.ActionDestroy:
+		t.remove(id)
+	}
+}
+
+// reconcile replaces the table with a full list of the containers, in case some events were missed
+func (t *containerTable) reconcile(list []types.Container) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	seen := map[string]bool{}
+	for _, ctr := range list {
+		seen[ctr.ID] = true
+		name := ""
+		if len(ctr.Names) > 0 {
+			name = ctr.Names[0]
+		}
+		c := t.upsert(ctr.ID, name, ctr.Labels)
+		running := ctr.State == "running"
+		if running && !c.Running {
+			c.pending = true
+		}
+		c.Running = running
+	}
+
+	for id := range t.containers {
+		if !seen[id] {
+			t.remove(id)
+		}
+	}
+}
+
+func (t *containerTable) setSynced(synced bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.synced = synced
+}
+
+func (t *containerTable) isSynced() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.synced
+}
+
+// workloads returns the running containers and the ones that ran since the previous call, sorted by name
+func (t *containerTable) workloads() []*WorkloadInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	res := []*WorkloadInfo{}
+	for id, c := range t.containers {
+		if !c.Running && !c.pending {
+			continue
+		}
+		res = append(res, dockerWorkload(c.Name, c.Labels))
+
+		c.pending = false
+		if c.removed {
+			delete(t.containers, id)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
+
+// running returns the running containers by id, without marking them as read
+func (t *containerTable) running() map[string]*WorkloadInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	res := map[string]*WorkloadInfo{}
+	for id, c := range t.containers {
+		if c.Running {
+			res[id] = dockerWorkload(c.Name, c.Labels)
+		}
+	}
+	return res
+}
+
+func dockerWorkload(name string, labels map[string]string) *WorkloadInfo {
+	wi := &WorkloadInfo{Name: name, Annotations: map[string]string{}}
+	for k, v := range labels {
+		if m1.MatchString(k) {
+			newK := m1.ReplaceAllString(k, "icos.$1.$2")
+			wi.Annotations[newK] = v
+		}
+	}
+	return wi
+}
+
+// containerWatcher keeps a containerTable up to date with the Docker events stream, reconciling it with a full
+// list every reconcileInterval and after every reconnection
+type containerWatcher struct {
+	api               dockerEventsAPI
+	table             *containerTable
+	reconcileInterval time.Duration
+	logger            zerolog.Logger
+}
+
+func (w *containerWatcher) reconcile(ctx context.Context) error {
+	list, err := w.api.ContainerList(ctx, container.ListOptions{All: true})
+	if err != nil {
+		return fmt.Errorf("error listing containers: %w", err)
+	}
+	w.table.reconcile(list)
+	return nil
+}
+
+// run follows the events stream until ctx is done, reconnecting with an exponential backoff
+func (w *containerWatcher) run(ctx context.Context) {
+	backoff := defaultMinBackoff
+	for {
+		connected, err := w.stream(ctx)
+		w.table.setSynced(false)
+		if ctx.Err() != nil {
+			return
+		}
+		if connected {
+			backoff = defaultMinBackoff
+		}
+
+		w.logger.Warn().Msgf("Docker events stream interrupted, reconnecting in %s: %s", backoff, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, defaultMaxBackoff)
+	}
+}
+
+// stream subscribes to the container events and applies them to the table until the stream fails. It tells if
+// the subscription succeeded
+func (w *containerWatcher) stream(ctx context.Context) (bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// subscribe before listing, so that the events between the list and the subscription are not lost. They are
+	// only read once the table has been reconciled
+	messages, errs := w.api.Events(ctx, types.EventsOptions{Filters: filters.NewArgs(
+		filters.Arg("type", string(events.ContainerEventType)),
+		filters.Arg("event", string(events.ActionCreate)),
+		filters.Arg("event", string(events.ActionStart)),
+		filters.Arg("event", string(events.ActionDie)),
+		filters.Arg("event", string(events.ActionDestroy)),
+	)})
+
+	if err := w.reconcile(ctx); err != nil {
+		return false, err
+	}
+	w.table.setSynced(true)
+	w.logger.Debug().Msg("Following the Docker events stream")
+
+	ticker := time.NewTicker(w.reconcileInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return true, ctx.Err()
+		case err := <-errs:
+			return true, err
+		case msg := <-messages:
+			w.logger.Trace().Msgf("Docker event %s %s (%s)", msg.Action, msg.Actor.Attributes["name"], msg.Actor.ID)
+			w.table.apply(msg)
+		case <-ticker.C:
+			if err := w.reconcile(ctx); err != nil {
+				w.logger.Warn().Msgf("Error reconciling the Docker containers: %s", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,160 @@
+/*
+ICOS Telemetruum Agent
+Copyright © 2022-2024 Engineering Ingegneria Informatica S.p.A.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+This work has received funding from the European Union's HORIZON research
+and innovation programme under grant agreement No. 101070177.
+*/
+
+package modules
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func containerEvent(action events.Action, id string, name string) events.Message {
+	return events.Message{
+		Type:   events.ContainerEventType,
+		Action: action,
+		Actor:  events.Actor{ID: id, Attributes: map[string]string{"name": name, "image": "alpine", "app.icos.eu/name": name + "-app"}},
+	}
+}
+
+func workloadNames(workloads []*WorkloadInfo) []string {
+	names := []string{}
+	for _, wi := range workloads {
+		names = append(names, wi.Name)
+	}
+	return names
+}
+
+func TestContainerTable(t *testing.T) {
+	table := newContainerTable()
+	table.reconcile([]types.Container{
+		{ID: "1", Names: []string{"/web"}, State: "running", Labels: map[string]string{"app.icos.eu/name": "shop"}},
+		{ID: "2", Names: []string{"/stopped"}, State: "exited"},
+	})
+
+	// a container that lives between two reads is reported once
+	table.apply(containerEvent(events.ActionCreate, "3", "job"))
+	table.apply(containerEvent(events.ActionStart, "3", "job"))
+	table.apply(containerEvent(events.ActionDie, "3", "job"))
+	table.apply(containerEvent(events.ActionDestroy, "3", "job"))
+
+	workloads := table.workloads()
+	assert.Equal(t, []string{"/job", "/web"}, workloadNames(workloads))
+	assert.Equal(t, map[string]string{"icos.app.name": "job-app"}, workloads[0].Annotations)
+	assert.Equal(t, map[string]string{"icos.app.name": "shop"}, workloads[1].Annotations)
+	assert.Equal(t, []string{"/web"}, workloadNames(table.workloads()))
+
+	// a restarted container is reported again, a stopped one is not
+	table.apply(containerEvent(events.ActionStart, "2", "stopped"))
+	table.apply(containerEvent(events.ActionDie, "1", "web"))
+	assert.Equal(t, []string{"/stopped"}, workloadNames(table.workloads()))
+
+	// missed events are fixed by the reconciliation
+	table.reconcile([]types.Container{{ID: "4", Names: []string{"/db"}, State: "running"}})
+	assert.Equal(t, []string{"/db"}, workloadNames(table.workloads()))
+	assert.Len(t, table.containers, 1)
+}
+
+// fakeDockerAPI serves a fixed container list and an events stream per subscription
+type fakeDockerAPI struct {
+	mu          sync.Mutex
+	list        []types.Container
+	lists       int
+	subscribers chan chan events.Message
+}
+
+func (f *fakeDockerAPI) ContainerList(ctx context.Context, options container.ListOptions) ([]types.Container, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lists++
+	return f.list, nil
+}
+
+func (f *fakeDockerAPI) Events(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error) {
+	messages := make(chan events.Message)
+	errs := make(chan error, 1)
+	stream := make(chan events.Message)
+	f.subscribers <- stream
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-stream:
+				if !ok {
+					errs <- errors.New("unexpected EOF")
+					return
+				}
+				messages <- msg
+			}
+		}
+	}()
+	return messages, errs
+}
+
+func TestContainerWatcher(t *testing.T) {
+	api := &fakeDockerAPI{
+		list:        []types.Container{{ID: "1", Names: []string{"/web"}, State: "running"}},
+		subscribers: make(chan chan events.Message, 1),
+	}
+	w := &containerWatcher{api: api, table: newContainerTable(), reconcileInterval: time.Hour, logger: zerolog.Nop()}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		w.run(ctx)
+		close(done)
+	}()
+
+	stream := <-api.subscribers
+	stream <- containerEvent(events.ActionStart, "2", "job")
+	assert.Eventually(t, func() bool { return len(w.table.workloads()) == 2 }, 5*time.Second, time.Millisecond)
+
+	// the stream is closed by the engine: the table is reconciled again after the reconnection
+	close(stream)
+	assert.Eventually(t, func() bool { return !w.table.isSynced() }, 5*time.Second, time.Millisecond)
+
+	stream = <-api.subscribers
+	assert.Eventually(t, w.table.isSynced, 5*time.Second, time.Millisecond)
+	api.mu.Lock()
+	assert.Equal(t, 2, api.lists)
+	api.mu.Unlock()
+
+	stream <- containerEvent(events.ActionStart, "3", "db")
+	assert.Eventually(t, func() bool { return len(w.table.workloads()) == 2 }, 5*time.Second, time.Millisecond)
+	assert.Equal(t, []string{"/db", "/web"}, workloadNames(w.table.workloads()), "the job is not in the list anymore")
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "the watcher did not stop")
+	}
+}
@@ -0,0 +1,147 @@
+/*
+ICOS Telemetruum Agent
+Copyright © 2022-2024 Engineering Ingegneria Informatica S.p.A.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+This work has received funding from the European Union's HORIZON research
+and innovation programme under grant agreement No. 101070177.
+*/
+
+package modules
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/errdefs"
+)
+
+// maximum number of concurrent calls of the stats API
+const dockerStatsConcurrency = 8
+
+// ProvideWorkloadUsage reads the resource usage of the running containers from the Docker stats API
+func (kd *DockerProvider) ProvideWorkloadUsage(ctx context.Context, c *WorkloadUsageCollector) error {
+	if !kd.containers.table.isSynced() {
+		if err := kd.containers.reconcile(ctx); err != nil {
+			return err
+		}
+	}
+	running := kd.containers.table.running()
+
+	mu := sync.Mutex{}
+	res := []*WorkloadUsage{}
+	var errs []error
+
+	sem := make(chan struct{}, dockerStatsConcurrency)
+	wg := sync.WaitGroup{}
+	for id, wi := range running {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(id string, wi *WorkloadInfo) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			usage, err := kd.containerUsage(ctx, id)
+			mu.Lock()
+			defer mu.Unlock()
+			if errdefs.IsNotFound(err) {
+				// the container was removed after the list
+				return
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", wi.Name, err))
+				return
+			}
+			usage.WorkloadInfo = *wi
+			res = append(res, usage)
+		}(id, wi)
+	}
+	wg.Wait()
+
+	if len(errs) > 0 && len(res) == 0 {
+		return fmt.Errorf("error reading the containers stats: %w", errors.Join(errs...))
+	}
+	for _, err := range errs {
+		kd.Logger.Warn().Msgf("Error reading the container stats of %s", err)
+	}
+
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	c.Workloads = res
+	c.ClusterId = kd.Id
+
+	return nil
+}
+
+func (kd *DockerProvider) containerUsage(ctx context.Context, id string) (*WorkloadUsage, error) {
+	resp, err := kd.DockerClient.ContainerStatsOneShot(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	stats := types.StatsJSON{}
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		return nil, fmt.Errorf("error decoding stats: %w", err)
+	}
+	return workloadUsageFromStats(&stats), nil
+}
+
+// workloadUsageFromStats converts the stats of a Linux container, with either cgroup v1 or v2
+func workloadUsageFromStats(stats *types.StatsJSON) *WorkloadUsage {
+	u := &WorkloadUsage{CPUSeconds: float64(stats.CPUStats.CPUUsage.TotalUsage) / 1e9}
+
+	// same as docker stats: total_inactive_file with cgroup v1, inactive_file with v2
+	mem := stats.MemoryStats
+	inactive, ok := mem.Stats["total_inactive_file"]
+	if !ok {
+		inactive = mem.Stats["inactive_file"]
+	}
+	if inactive < mem.Usage {
+		u.MemoryUsage = int64(mem.Usage - inactive)
+	}
+	if mem.Limit > 0 {
+		u.MemoryLimit = int64Ptr(int64(mem.Limit))
+	}
+	if cache, ok := mem.Stats["cache"]; ok {
+		u.MemoryCache = int64Ptr(int64(cache))
+	} else {
+		u.MemoryCache = int64Ptr(int64(mem.Stats["file"]))
+	}
+
+	var rx, tx, read, write int64
+	for _, n := range stats.Networks {
+		rx += int64(n.RxBytes)
+		tx += int64(n.TxBytes)
+	}
+	for _, e := range stats.BlkioStats.IoServiceBytesRecursive {
+		switch strings.ToLower(e.Op) {
+		case "read":
+			read += int64(e.Value)
+		case "write":
+			write += int64(e.Value)
+		}
+	}
+	u.NetworkRx, u.NetworkTx = int64Ptr(rx), int64Ptr(tx)
+	u.BlockRead, u.BlockWrite = int64Ptr(read), int64Ptr(write)
+
+	return u
+}
@@ -0,0 +1,120 @@
+/*
+ICOS Telemetruum Agent
+Copyright © 2022-2024 Engineering Ingegneria Informatica S.p.A.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+This work has received funding from the European Union's HORIZON research
+and innovation programme under grant agreement No. 101070177.
+*/
+
+package modules
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/client"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stats of a container with cgroup v2, trimmed
+const cgroupV2Stats = `{
+  "cpu_stats": {"cpu_usage": {"total_usage": 2500000000}},
+  "memory_stats": {"usage": 52428800, "limit": 2147483648, "stats": {"file": 8388608, "inactive_file": 4194304, "anon": 40000000}},
+  "networks": {"eth0": {"rx_bytes": 1000, "tx_bytes": 200}, "eth1": {"rx_bytes": 24, "tx_bytes": 6}},
+  "blkio_stats": {"io_service_bytes_recursive": [
+    {"major": 8, "minor": 0, "op": "read", "value": 4096},
+    {"major": 8, "minor": 0, "op": "write", "value": 512},
+    {"major": 8, "minor": 16, "op": "read", "value": 4096}
+  ]}
+}`
+
+// stats of a container with cgroup v1, trimmed
+const cgroupV1Stats = `{
+  "cpu_stats": {"cpu_usage": {"total_usage": 1000000}},
+  "memory_stats": {"usage": 10485760, "limit": 1073741824, "stats": {"cache": 2097152, "total_inactive_file": 1048576}},
+  "blkio_stats": {"io_service_bytes_recursive": [
+    {"major": 8, "minor": 0, "op": "Read", "value": 100},
+    {"major": 8, "minor": 0, "op": "Write", "value": 50},
+    {"major": 8, "minor": 0, "op": "Total", "value": 150}
+  ]}
+}`
+
+func TestProvideWorkloadUsage(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/containers/json"):
+			_, _ = w.Write([]byte(`[
+			  {"Id": "v2", "Names": ["/web"], "State": "running", "Labels": {"app.icos.eu/name": "shop"}},
+			  {"Id": "v1", "Names": ["/db"], "State": "running"},
+			  {"Id": "gone", "Names": ["/job"], "State": "running"},
+			  {"Id": "exited", "Names": ["/old"], "State": "exited"}
+			]`))
+		case strings.HasSuffix(r.URL.Path, "/containers/v2/stats"):
+			assert.Equal(t, "1", r.URL.Query().Get("one-shot"))
+			_, _ = w.Write([]byte(cgroupV2Stats))
+		case strings.HasSuffix(r.URL.Path, "/containers/v1/stats"):
+			_, _ = w.Write([]byte(cgroupV1Stats))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"message": "No such container"}`))
+		}
+	}))
+	defer server.Close()
+
+	cli, err := client.NewClientWithOpts(client.WithHost("tcp://"+strings.TrimPrefix(server.URL, "http://")), client.WithVersion("1.44"))
+	require.NoError(t, err)
+	kd := &DockerProvider{
+		Id:           "docker-1",
+		DockerClient: cli,
+		containers:   &containerWatcher{api: cli, table: newContainerTable(), reconcileInterval: time.Hour, logger: zerolog.Nop()},
+		BaseProvider: BaseProvider{Logger: zerolog.Nop()},
+	}
+
+	c := &WorkloadUsageCollector{}
+	require.NoError(t, kd.ProvideWorkloadUsage(context.Background(), c))
+	assert.Equal(t, "docker-1", c.ClusterId)
+	require.Len(t, c.Workloads, 2, "removed and exited containers are skipped")
+
+	db, web := c.Workloads[0], c.Workloads[1]
+	assert.Equal(t, WorkloadUsage{
+		WorkloadInfo: WorkloadInfo{Name: "/web", Annotations: map[string]string{"icos.app.name": "shop"}},
+		CPUSeconds:   2.5,
+		MemoryUsage:  52428800 - 4194304,
+		MemoryLimit:  int64Ptr(2147483648),
+		MemoryCache:  int64Ptr(8388608),
+		NetworkRx:    int64Ptr(1024),
+		NetworkTx:    int64Ptr(206),
+		BlockRead:    int64Ptr(8192),
+		BlockWrite:   int64Ptr(512),
+	}, *web)
+	assert.Equal(t, WorkloadUsage{
+		WorkloadInfo: WorkloadInfo{Name: "/db", Annotations: map[string]string{}},
+		CPUSeconds:   0.001,
+		MemoryUsage:  10485760 - 1048576,
+		MemoryLimit:  int64Ptr(1073741824),
+		MemoryCache:  int64Ptr(2097152),
+		NetworkRx:    int64Ptr(0),
+		NetworkTx:    int64Ptr(0),
+		BlockRead:    int64Ptr(100),
+		BlockWrite:   int64Ptr(50),
+	}, *db)
+}
@@ -0,0 +1,85 @@
+/*
+ICOS Telemetruum Agent
+Copyright © 2022-2024 Engineering Ingegneria Informatica S.p.A.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+This work has received funding from the European Union's HORIZON research
+and innovation programme under grant agreement No. 101070177.
+*/
+
+package modules
+
+import (
+	"context"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProvideNuvlaAttachedPeripherals(t *testing.T) {
+	root := t.TempDir()
+	writeFixture(t, root, map[string]string{"nuvla_peripherals/.peripherals/local_peripherals.json": `{
+  "usb_046d_0825": {
+    "identifier": "046D:0825", "available": true, "interface": "USB", "device-path": "/dev/bus/usb/001/004",
+    "name": "Webcam C270", "vendor": "Logitech, Inc.", "product": "Webcam C270", "classes": ["video", "audio"],
+    "serial-number": "200901010001", "video-device": "/dev/video0"
+  },
+  "gpu_nvidia": {
+    "identifier": "nvidia-0", "available": true, "interface": "GPU", "name": "Tesla T4", "vendor": "NVIDIA",
+    "classes": ["gpu"], "description": "NVIDIA GPU with CUDA 12.2"
+  },
+  "bt_speaker": {
+    "identifier": "AA:BB:CC:DD:EE:FF", "available": false, "interface": "Bluetooth", "name": "Speaker", "classes": []
+  },
+  "net_camera": {
+    "identifier": "192.168.1.20", "available": true, "interface": "Network", "name": "IP Camera", "port": 554
+  }
+}`})
+
+	p := &DockerProvider{BaseProvider: BaseProvider{Logger: zerolog.Nop(), PathRootFs: root}}
+	c := &NodeMountedCollector{AttachedPeripherals: []*Peripheral{{Device: "arduino_2341_0043", Source: "usb", Interface: "USB"}}}
+	require.NoError(t, p.ProvideNuvlaAttachedPeripherals(context.Background(), c))
+
+	assert.Equal(t, []*Peripheral{
+		{Device: "arduino_2341_0043", Source: "usb", Interface: "USB"},
+		{
+			Device: "speaker_aa_bb_cc_dd_ee_ff", Source: "nuvla", Interface: "Bluetooth",
+			Details: map[string]string{"identifier": "AA:BB:CC:DD:EE:FF", "name": "Speaker"},
+		},
+		{
+			Device: "tesla-t4_nvidia-0", Available: true, Source: "nuvla", Interface: "GPU", Manufacturer: "NVIDIA", Class: "gpu",
+			Details: map[string]string{"identifier": "nvidia-0", "name": "Tesla T4", "description": "NVIDIA GPU with CUDA 12.2"},
+		},
+		{
+			Device: "ip-camera_192.168.1.20", Available: true, Source: "nuvla", Interface: "Network",
+			Details: map[string]string{"identifier": "192.168.1.20", "name": "IP Camera", "port": "554"},
+		},
+		{
+			Device: "webcam-c270_046d_0825", ResourcePath: "/dev/bus/usb/001/004", Available: true, Source: "nuvla", Interface: "USB",
+			VendorID: "046d", ProductID: "0825", Manufacturer: "Logitech, Inc.", Serial: "200901010001", Class: "video,audio",
+			Details: map[string]string{"identifier": "046D:0825", "name": "Webcam C270", "product": "Webcam C270", "video_device": "/dev/video0"},
+		},
+	}, c.AttachedPeripherals)
+
+	// only the allowed interfaces are reported
+	p.PeripheralInterfaces = []string{"usb", "gpu"}
+	require.NoError(t, p.ProvideNuvlaAttachedPeripherals(context.Background(), c))
+	var devices []string
+	for _, p := range c.AttachedPeripherals {
+		devices = append(devices, p.Device)
+	}
+	assert.Equal(t, []string{"arduino_2341_0043", "tesla-t4_nvidia-0", "webcam-c270_046d_0825"}, devices)
+}
@@ -26,13 +26,17 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/alecthomas/kingpin/v2"
 	"github.com/rs/zerolog"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
@@ -45,128 +49,187 @@ var (
 	m1         = regexp.MustCompile(`(.+).icos.eu/(.+)`)
 )
 
+func init() {
+	RegisterProvider(ProviderRegistration{
+		Name:     "Kubernetes",
+		Flag:     "kubernetes",
+		Priority: 10,
+		Initialize: func(cfg *Config, logger zerolog.Logger) (Provider, error) {
+			return InizializeKubernetesProvider(cfg, logger)
+		},
+		Settings: func(cfg *Config) any {
+			return []any{cfg.KubeConfig, cfg.PathRootFs, cfg.Kubelet, cfg.PeripheralInterfaces}
+		},
+		Feeds: []ProviderFeed{
+			Feed((*KubernetesProvider).ProvideOCMOrchInfo),
+			Feed((*KubernetesProvider).ProvideWorkloadInfo),
+			Feed((*KubernetesProvider).ProvideWorkloadUsage),
+			Feed((*KubernetesProvider).ProvideNuvlaOrchestratorInfo),
+			Feed((*KubernetesProvider).ProvideExtendedResources),
+		}})
+}
+
 type KubernetesProvider struct {
 	BaseProvider
-	KubernetesClient *kubernetes.Clientset
-	iAmTheLeader     bool
+	KubernetesClient kubernetes.Interface
+	iAmTheLeader     atomic.Bool
 	Id               string
+	pods             *podCache
+	kubelet          *kubeletClient
+	// Interfaces of the peripherals to report, all if empty
+	PeripheralInterfaces []string
+	// empty when the devices of the device plugins are not reported
+	podResourcesSocket string
+	// klusterlet pods, set while this agent is the leader
+	ocm atomic.Pointer[ocmCache]
 }
 
-func InizializeKubernetesProvider(logger zerolog.Logger) (*KubernetesProvider, error) {
+func InizializeKubernetesProvider(config *Config, logger zerolog.Logger) (*KubernetesProvider, error) {
 
-	var clientset *kubernetes.Clientset
+	var restConfig *rest.Config
+	var err error
 
-	if *kubeConfig != "" {
-		cfg, err := clientcmd.BuildConfigFromFlags("", *kubeConfig)
-		if err != nil {
-			return nil, err
-		}
+	if config.KubeConfig != "" {
+		restConfig, err = clientcmd.BuildConfigFromFlags("", config.KubeConfig)
+	} else {
+		restConfig, err = rest.InClusterConfig()
+	}
+	if err != nil {
+		return nil, err
+	}
 
-		clientset, err = kubernetes.NewForConfig(cfg)
-		if err != nil {
-			return nil, err
-		}
+	clientset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, err
+	}
 
-	} else {
+	kp, err := newKubernetesProvider(clientset, config.PathRootFs, logger)
+	if err != nil {
+		return nil, err
+	}
 
-		cfg, err := rest.InClusterConfig()
-		if err != nil {
-			return nil, err
-		}
-		clientset, err = kubernetes.NewForConfig(cfg)
-		if err != nil {
-			return nil, err
-		}
+	kp.kubelet, err = newKubeletClient(config.Kubelet, restConfig, clientset, kp.pods.nodeName, logger)
+	if err != nil {
+		return nil, fmt.Errorf("error configuring the kubelet client: %w", err)
 	}
+	kp.PeripheralInterfaces = config.PeripheralInterfaces
+	if config.Kubelet.PodResourcesSocket != "" {
+		kp.podResourcesSocket = filepath.Join(config.PathRootFs, config.Kubelet.PodResourcesSocket)
+	}
+
+	return kp, nil
+}
 
-	kubeSystemNS, err := clientset.CoreV1().Namespaces().Get(context.TODO(), "kube-system", metav1.GetOptions{})
+func newKubernetesProvider(client kubernetes.Interface, pathRootFs string, logger zerolog.Logger) (*KubernetesProvider, error) {
+	kubeSystemNS, err := client.CoreV1().Namespaces().Get(context.TODO(), "kube-system", metav1.GetOptions{})
 	if err != nil {
 		return nil, fmt.Errorf("Error reading cluster id from \"kube-system\" namespace: %s", err)
 	}
 
 	logger.Debug().Msgf("Initialed Kubernetes Provider for cluster with Id: %s", string(kubeSystemNS.UID))
 
-	return &KubernetesProvider{Id: string(kubeSystemNS.UID), KubernetesClient: clientset, BaseProvider: BaseProvider{Logger: logger}}, nil
+	nodeName := os.Getenv("NODE_NAME")
+	if nodeName == "" {
+		// the kubelet registers the node with the hostname by default
+		nodeName, err = os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("NODE_NAME is not set and the hostname is unknown: %w", err)
+		}
+		logger.Warn().Msgf("NODE_NAME is not set, watching the pods of node \"%s\"", nodeName)
+	}
+
+	return &KubernetesProvider{
+		Id:               string(kubeSystemNS.UID),
+		KubernetesClient: client,
+		pods:             newPodCache(client, nodeName, logger),
+		BaseProvider:     BaseProvider{Logger: logger, PathRootFs: pathRootFs},
+	}, nil
 }
 
+// Start watches the pods of the node and runs the leader election of the cluster-wide info
 func (kp *KubernetesProvider) Start(ctx context.Context, wg *sync.WaitGroup) {
+	kp.pods.start(ctx, wg)
 	kp.leaderElectionControlLoop(ctx, wg)
 }
 
-func (kp *KubernetesProvider) ProvideWorkloadInfo(ctx context.Context, c *WorkloadInfoCollector) {
-	nodeName := os.Getenv("NODE_NAME")
-	kp.Logger.Debug().Msgf("Listing pods in node \"%s\"\n", nodeName)
-
-	pods, _ := kp.KubernetesClient.
-		CoreV1().
-		Pods("").
-		List(ctx, metav1.ListOptions{
-			FieldSelector: "spec.nodeName=" + nodeName,
-		})
+func (kp *KubernetesProvider) ProvideWorkloadInfo(ctx context.Context, c *WorkloadInfoCollector) error {
+	pods, err := kp.pods.list(labels.Everything())
+	if err != nil {
+		return fmt.Errorf("error listing pods in node %s: %w", kp.pods.nodeName, err)
+	}
+	sort.Slice(pods, func(i, j int) bool { return pods[i].Name < pods[j].Name })
 
 	res := []*WorkloadInfo{}
-	for _, p := range pods.Items {
-		wi := &WorkloadInfo{Name: p.ObjectMeta.Name, Annotations: map[string]string{}}
-		res = append(res, wi)
-
-		for k, v := range p.ObjectMeta.Annotations {
-			if m1.MatchString(k) {
-				newK := m1.ReplaceAllString(k, "icos.$1.$2")
-				wi.Annotations[newK] = v
-			}
-		}
+	for _, p := range pods {
+		res = append(res, podWorkload(p))
 	}
 
 	c.RunningWorkloads = res
 	c.ClusterId = kp.Id
+
+	return nil
 }
 
-func (kp *KubernetesProvider) ProvideNuvlaOrchestratorInfo(ctx context.Context, oic *OrchInfoCollector) {
+// podWorkload returns the workload of a pod, with its icos.* annotations
+func podWorkload(p *corev1.Pod) *WorkloadInfo {
+	wi := &WorkloadInfo{Name: p.ObjectMeta.Name, Annotations: map[string]string{}}
+	for k, v := range p.ObjectMeta.Annotations {
+		if m1.MatchString(k) {
+			newK := m1.ReplaceAllString(k, "icos.$1.$2")
+			wi.Annotations[newK] = v
+		}
+	}
+	return wi
+}
 
-	nodeName := os.Getenv("NODE_NAME")
+// ProvideNuvlaOrchestratorInfo reads the Nuvla context of the NuvlaEdge agent running on this node
+func (kp *KubernetesProvider) ProvideNuvlaOrchestratorInfo(ctx context.Context, oic *OrchInfoCollector) error {
 
-	nuvlaEdgePodList, _ := kp.KubernetesClient.CoreV1().Pods("").List(context.TODO(),
-		metav1.ListOptions{
-			LabelSelector: "app.kubernetes.io/name=nuvlaedge,component=agent"})
+	nuvlaEdgePodList, err := kp.pods.list(labels.SelectorFromSet(labels.Set{"app.kubernetes.io/name": "nuvlaedge", "component": "agent"}))
+	if err != nil {
+		return fmt.Errorf("error listing NuvlaEdge pods: %w", err)
+	}
 
-	if len(nuvlaEdgePodList.Items) == 0 {
-		kp.Logger.Warn().Msgf("No NuvlaEdge pod found.\n")
-		return
+	if len(nuvlaEdgePodList) == 0 {
+		kp.Logger.Debug().Msgf("No NuvlaEdge pod found in node \"%s\". Not extracting info from Nuvla context file", kp.pods.nodeName)
+		return nil
 	}
 
-	if len(nuvlaEdgePodList.Items) > 1 {
+	if len(nuvlaEdgePodList) > 1 {
 		kp.Logger.Warn().Msgf("More than on pod found for NuvlaEdge. This should never happen. Do not extract Nuvla info.\n")
-		return
+		return nil
 	}
 
-	nuvlaEdgePod := nuvlaEdgePodList.Items[0]
+	nuvlaEdgePod := nuvlaEdgePodList[0]
 	kp.Logger.Debug().Msgf("NuvlaEdge pod found: %s", nuvlaEdgePod.ObjectMeta.Name)
 
-	if nodeName != nuvlaEdgePod.Spec.NodeName {
-		kp.Logger.Warn().Msg("We are in a different node from the one NuvlaEdge is running. Not extracting info from Nuvla context file\n")
-		return
-	}
-
-	nuvlaContextFile := filepath.Join(*pathRootFs, fmt.Sprintf("/var/lib/nuvlaedge/%s/.context", nuvlaEdgePod.ObjectMeta.Namespace))
+	nuvlaContextFile := filepath.Join(kp.PathRootFs, fmt.Sprintf("/var/lib/nuvlaedge/%s/.context", nuvlaEdgePod.ObjectMeta.Namespace))
 
 	if _, err := os.Stat(nuvlaContextFile); !os.IsNotExist(err) {
 		kp.Logger.Debug().Msgf("Nuvla Context file found at %s", nuvlaContextFile)
-		CommonProvideNuvlaOrchestratorInfo(ctx, nuvlaContextFile, oic, kp.Logger)
-	} else {
-		kp.Logger.Warn().Msgf("Nuvla Context file not found at %s", nuvlaContextFile)
+		return CommonProvideNuvlaOrchestratorInfo(ctx, nuvlaContextFile, oic, kp.Logger)
 	}
+
+	kp.Logger.Warn().Msgf("Nuvla Context file not found at %s", nuvlaContextFile)
+	return nil
 }
 
-func (kp *KubernetesProvider) ProvideOCMOrchInfo(ctx context.Context, c *OrchInfoCollector) {
+// ProvideOCMOrchInfo reads the OCM agent info from the klusterlet work agent pod. The pod can run on any node,
+// so only the leader watches it and the info is published once per cluster
+func (kp *KubernetesProvider) ProvideOCMOrchInfo(ctx context.Context, c *OrchInfoCollector) error {
 
-	if !kp.iAmTheLeader {
-		return
+	ocm := kp.ocm.Load()
+	if !kp.iAmTheLeader.Load() || ocm == nil {
+		return nil
 	}
 
 	kp.Logger.Debug().Msg("Getting OCM Agent info from Klusterlet pod...")
 
-	pods, _ := kp.KubernetesClient.CoreV1().Pods("").List(context.TODO(), metav1.ListOptions{})
-	for _, p := range pods.Items {
+	pods, err := ocm.list()
+	if err != nil {
+		return fmt.Errorf("error listing pods: %w", err)
+	}
+	for _, p := range pods {
 		if strings.HasPrefix(p.ObjectMeta.Name, "klusterlet-work-agent") {
 			ocm_agent_name := ""
 			ocm_agent_id := ""
@@ -190,6 +253,8 @@ func (kp *KubernetesProvider) ProvideOCMOrchInfo(ctx context.Context, c *OrchInf
 			}
 		}
 	}
+
+	return nil
 }
 
 func (kp *KubernetesProvider) leaderElectionControlLoop(ctx context.Context, wg *sync.WaitGroup) {
@@ -199,6 +264,10 @@ func (kp *KubernetesProvider) leaderElectionControlLoop(ctx context.Context, wg
 	go func() {
 		namespace := os.Getenv("NAMESPACE")
 		podName := os.Getenv("POD_NAME")
+		if podName == "" {
+			// the hostname of a pod is its name
+			podName, _ = os.Hostname()
+		}
 
 		lock := &resourcelock.LeaseLock{
 			LeaseMeta: metav1.ObjectMeta{
@@ -219,18 +288,23 @@ func (kp *KubernetesProvider) leaderElectionControlLoop(ctx context.Context, wg
 			RetryPeriod:     5 * time.Second,
 			Callbacks: leaderelection.LeaderCallbacks{
 				OnStartedLeading: func(ctx context.Context) {
-
+					wg.Add(1)
+					defer wg.Done()
+					ocm := newOCMCache(kp.KubernetesClient)
+					kp.ocm.Store(ocm)
+					ocm.run(ctx)
+					kp.ocm.CompareAndSwap(ocm, nil)
 				},
 				OnStoppedLeading: func() {
 					kp.Logger.Info().Msg("[kubernetes] Stopping leading. Stopping collecting metrics")
-					kp.iAmTheLeader = false
+					kp.iAmTheLeader.Store(false)
 					wg.Done()
 				},
 				OnNewLeader: func(identity string) {
 					kp.Logger.Info().Msgf("[kubernetes] New leader is \"%s\"", identity)
 					if identity == podName {
 						kp.Logger.Info().Msgf("[kubernetes] We are the new leader. Starting collecting metrics")
-						kp.iAmTheLeader = true
+						kp.iAmTheLeader.Store(true)
 					}
 				},
 			},
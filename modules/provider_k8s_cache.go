@@ -0,0 +1,163 @@
+/*
+ICOS Telemetruum Agent
+Copyright © 2022-2024 Engineering Ingegneria Informatica S.p.A.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+This work has received funding from the European Union's HORIZON research
+and innovation programme under grant agreement No. 101070177.
+*/
+
+package modules
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/rs/zerolog"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+var (
+	errPodCacheNotSynced  = errors.New("the pods of the node are not synced yet")
+	errNodeCacheNotSynced = errors.New("the node is not synced yet")
+	errOCMCacheNotSynced  = errors.New("the klusterlet pods are not synced yet")
+)
+
+const (
+	// namespace and labels of the klusterlet work agent pods
+	ocmAgentNamespace = "open-cluster-management-agent"
+	ocmAgentSelector  = "app=klusterlet-manifestwork-agent"
+)
+
+// podCache is an informer cache of the pods scheduled on the node of the agent, and of the node itself. It is
+// shared by all the Kubernetes provider methods, so the API server is only watched once and blips do not affect
+// the collections
+type podCache struct {
+	nodeName     string
+	factory      informers.SharedInformerFactory
+	informer     cache.SharedIndexInformer
+	lister       corelisters.PodLister
+	nodeFactory  informers.SharedInformerFactory
+	nodeInformer cache.SharedIndexInformer
+	nodeLister   corelisters.NodeLister
+	logger       zerolog.Logger
+}
+
+// stripManagedFields drops the managed fields, the largest part of the objects, which are never read
+func stripManagedFields(obj interface{}) (interface{}, error) {
+	if acc, ok := obj.(metav1.ObjectMetaAccessor); ok {
+		acc.GetObjectMeta().SetManagedFields(nil)
+	}
+	return obj, nil
+}
+
+func newPodCache(client kubernetes.Interface, nodeName string, logger zerolog.Logger) *podCache {
+	factory := informers.NewSharedInformerFactoryWithOptions(client, 0,
+		informers.WithTweakListOptions(func(o *metav1.ListOptions) {
+			o.FieldSelector = "spec.nodeName=" + nodeName
+		}),
+		informers.WithTransform(stripManagedFields))
+	nodeFactory := informers.NewSharedInformerFactoryWithOptions(client, 0,
+		informers.WithTweakListOptions(func(o *metav1.ListOptions) {
+			o.FieldSelector = "metadata.name=" + nodeName
+		}),
+		informers.WithTransform(stripManagedFields))
+
+	pods := factory.Core().V1().Pods()
+	nodes := nodeFactory.Core().V1().Nodes()
+	return &podCache{
+		nodeName:     nodeName,
+		factory:      factory,
+		informer:     pods.Informer(),
+		lister:       pods.Lister(),
+		nodeFactory:  nodeFactory,
+		nodeInformer: nodes.Informer(),
+		nodeLister:   nodes.Lister(),
+		logger:       logger,
+	}
+}
+
+// start runs the informer until ctx is done
+func (c *podCache) start(ctx context.Context, wg *sync.WaitGroup) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		c.factory.Start(ctx.Done())
+		c.nodeFactory.Start(ctx.Done())
+		if cache.WaitForCacheSync(ctx.Done(), c.informer.HasSynced, c.nodeInformer.HasSynced) {
+			c.logger.Debug().Msgf("Synced the pods of node \"%s\"", c.nodeName)
+		}
+		<-ctx.Done()
+		c.factory.Shutdown()
+		c.nodeFactory.Shutdown()
+	}()
+}
+
+// list returns the cached pods of the node matching selector
+func (c *podCache) list(selector labels.Selector) ([]*corev1.Pod, error) {
+	if !c.informer.HasSynced() {
+		return nil, errPodCacheNotSynced
+	}
+	return c.lister.List(selector)
+}
+
+// node returns the cached node of the agent
+func (c *podCache) node() (*corev1.Node, error) {
+	if !c.nodeInformer.HasSynced() {
+		return nil, errNodeCacheNotSynced
+	}
+	return c.nodeLister.Get(c.nodeName)
+}
+
+// ocmCache is an informer cache of the klusterlet work agent pods. They can run on any node, so the cache is only
+// run by the leader
+type ocmCache struct {
+	factory  informers.SharedInformerFactory
+	informer cache.SharedIndexInformer
+	lister   corelisters.PodLister
+}
+
+func newOCMCache(client kubernetes.Interface) *ocmCache {
+	factory := informers.NewSharedInformerFactoryWithOptions(client, 0,
+		informers.WithNamespace(ocmAgentNamespace),
+		informers.WithTweakListOptions(func(o *metav1.ListOptions) {
+			o.LabelSelector = ocmAgentSelector
+		}),
+		informers.WithTransform(stripManagedFields))
+
+	pods := factory.Core().V1().Pods()
+	return &ocmCache{factory: factory, informer: pods.Informer(), lister: pods.Lister()}
+}
+
+// run runs the informer until ctx is done
+func (c *ocmCache) run(ctx context.Context) {
+	c.factory.Start(ctx.Done())
+	<-ctx.Done()
+	c.factory.Shutdown()
+}
+
+// list returns the cached klusterlet work agent pods
+func (c *ocmCache) list() ([]*corev1.Pod, error) {
+	if !c.informer.HasSynced() {
+		return nil, errOCMCacheNotSynced
+	}
+	return c.lister.Pods(ocmAgentNamespace).List(labels.Everything())
+}
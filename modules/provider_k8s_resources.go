@@ -0,0 +1,199 @@
+/*
+ICOS Telemetruum Agent
+Copyright © 2022-2024 Engineering Ingegneria Informatica S.p.A.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+This work has received funding from the European Union's HORIZON research
+and innovation programme under grant agreement No. 101070177.
+*/
+
+package modules
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	podresourcesv1 "k8s.io/kubelet/pkg/apis/podresources/v1"
+)
+
+// isExtendedResource tells if a resource of the node is advertised by a device plugin or patched by an operator,
+// i.e. it is namespaced outside kubernetes.io like nvidia.com/gpu or smarter-devices/ttyUSB0
+func isExtendedResource(name corev1.ResourceName) bool {
+	n := string(name)
+	return strings.Contains(n, "/") && !strings.Contains(n, "kubernetes.io/") && !strings.HasPrefix(n, "requests.")
+}
+
+// podRequests returns the extended resources requested by a pod. Init containers run one at a time before the
+// others, so the pod needs the largest of their requests and the sum of the ones of the containers
+func podRequests(p *corev1.Pod) map[string]int64 {
+	res := map[string]int64{}
+	for _, c := range p.Spec.Containers {
+		for name, q := range c.Resources.Requests {
+			if isExtendedResource(name) {
+				res[string(name)] += q.Value()
+			}
+		}
+	}
+	for _, c := range p.Spec.InitContainers {
+		for name, q := range c.Resources.Requests {
+			if isExtendedResource(name) {
+				res[string(name)] = max(res[string(name)], q.Value())
+			}
+		}
+	}
+	return res
+}
+
+// deviceAssignment is the container a device plugin device is assigned to
+type deviceAssignment struct {
+	namespace string
+	pod       string
+	container string
+}
+
+// podResourcesDevices reads the devices of the device plugins from the pod-resources API of the kubelet
+func (kp *KubernetesProvider) podResourcesDevices(ctx context.Context) ([]*Peripheral, error) {
+	conn, err := grpc.DialContext(ctx, "unix:"+kp.podResourcesSocket, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	client := podresourcesv1.NewPodResourcesListerClient(conn)
+
+	list, err := client.List(ctx, &podresourcesv1.ListPodResourcesRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("error listing the pod resources: %w", err)
+	}
+	assigned := map[string]deviceAssignment{}
+	devices := []*podresourcesv1.ContainerDevices{}
+	for _, p := range list.GetPodResources() {
+		for _, c := range p.GetContainers() {
+			for _, d := range c.GetDevices() {
+				for _, id := range d.GetDeviceIds() {
+					assigned[d.GetResourceName()+"/"+id] = deviceAssignment{namespace: p.GetNamespace(), pod: p.GetName(), container: c.GetName()}
+				}
+				devices = append(devices, d)
+			}
+		}
+	}
+
+	// before Kubernetes 1.28 the allocatable devices could be disabled by a feature gate
+	if alloc, err := client.GetAllocatableResources(ctx, &podresourcesv1.AllocatableResourcesRequest{}); err != nil {
+		kp.Logger.Debug().Msgf("Cannot read the allocatable devices, only the assigned ones are reported: %s", err)
+	} else {
+		devices = alloc.GetDevices()
+	}
+
+	peripherals := []*Peripheral{}
+	seen := map[string]bool{}
+	for _, d := range devices {
+		numa := []string{}
+		for _, n := range d.GetTopology().GetNodes() {
+			numa = append(numa, fmt.Sprint(n.GetID()))
+		}
+		for _, id := range d.GetDeviceIds() {
+			key := d.GetResourceName() + "/" + id
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+
+			details := map[string]string{"resource": d.GetResourceName(), "device_id": id}
+			if len(numa) > 0 {
+				details["numa_node"] = strings.Join(numa, ",")
+			}
+			a, inUse := assigned[key]
+			if inUse {
+				details["namespace"], details["pod"], details["container"] = a.namespace, a.pod, a.container
+			}
+			peripherals = append(peripherals, &Peripheral{
+				Device:    strings.ToLower(strings.ReplaceAll(d.GetResourceName(), "/", "_")) + "_" + id,
+				Available: !inUse,
+				Interface: "DevicePlugin",
+				Details:   details,
+			})
+		}
+	}
+	sort.Slice(peripherals, func(i, j int) bool { return peripherals[i].Device < peripherals[j].Device })
+	return peripherals, nil
+}
+
+// ProvideExtendedResources reports the extended resources of the node, with the devices of the device plugins when
+// the pod-resources socket of the kubelet is mounted
+func (kp *KubernetesProvider) ProvideExtendedResources(ctx context.Context, c *NodeMountedCollector) error {
+	node, err := kp.pods.node()
+	if err != nil {
+		return fmt.Errorf("error reading node %s: %w", kp.pods.nodeName, err)
+	}
+	pods, err := kp.pods.list(labels.Everything())
+	if err != nil {
+		return fmt.Errorf("error listing pods in node %s: %w", kp.pods.nodeName, err)
+	}
+
+	resources := map[string]*ExtendedResource{}
+	resource := func(name corev1.ResourceName) *ExtendedResource {
+		if _, ok := resources[string(name)]; !ok {
+			resources[string(name)] = &ExtendedResource{Name: string(name)}
+		}
+		return resources[string(name)]
+	}
+	for name, q := range node.Status.Capacity {
+		if isExtendedResource(name) {
+			resource(name).Capacity = q.Value()
+		}
+	}
+	for name, q := range node.Status.Allocatable {
+		if isExtendedResource(name) {
+			resource(name).Allocatable = q.Value()
+		}
+	}
+	// the resources of the completed pods are released
+	for _, p := range pods {
+		if p.Status.Phase == corev1.PodSucceeded || p.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		for name, v := range podRequests(p) {
+			resource(corev1.ResourceName(name)).InUse += v
+		}
+	}
+
+	c.ExtendedResources = []*ExtendedResource{}
+	for _, name := range sortedKeys(resources) {
+		c.ExtendedResources = append(c.ExtendedResources, resources[name])
+	}
+
+	if kp.podResourcesSocket == "" || !peripheralAllowed(kp.PeripheralInterfaces, "DevicePlugin") {
+		return nil
+	}
+	if _, err := os.Stat(kp.podResourcesSocket); err != nil {
+		kp.Logger.Debug().Msgf("The pod-resources socket %s is not mounted, not reporting the devices of the device plugins", kp.podResourcesSocket)
+		return nil
+	}
+	// the extended resources come from the API server and are published anyway
+	devices, err := kp.podResourcesDevices(ctx)
+	if err != nil {
+		kp.Logger.Warn().Msgf("Error reading the pod-resources API of the kubelet, not reporting the devices of the device plugins: %s", err)
+		return nil
+	}
+	c.setPeripherals("kubernetes", devices)
+
+	return nil
+}
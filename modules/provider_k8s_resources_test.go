@@ -0,0 +1,181 @@
+/*
+ICOS Telemetruum Agent
+Copyright © 2022-2024 Engineering Ingegneria Informatica S.p.A.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+This work has received funding from the European Union's HORIZON research
+and innovation programme under grant agreement No. 101070177.
+*/
+
+package modules
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	podresourcesv1 "k8s.io/kubelet/pkg/apis/podresources/v1"
+)
+
+type fakePodResources struct {
+	podresourcesv1.UnimplementedPodResourcesListerServer
+}
+
+func (fakePodResources) List(context.Context, *podresourcesv1.ListPodResourcesRequest) (*podresourcesv1.ListPodResourcesResponse, error) {
+	return &podresourcesv1.ListPodResourcesResponse{PodResources: []*podresourcesv1.PodResources{{
+		Name:      "inference",
+		Namespace: "default",
+		Containers: []*podresourcesv1.ContainerResources{{
+			Name:    "main",
+			Devices: []*podresourcesv1.ContainerDevices{{ResourceName: "nvidia.com/gpu", DeviceIds: []string{"GPU-1"}}},
+		}},
+	}}}, nil
+}
+
+func (fakePodResources) GetAllocatableResources(context.Context, *podresourcesv1.AllocatableResourcesRequest) (*podresourcesv1.AllocatableResourcesResponse, error) {
+	return &podresourcesv1.AllocatableResourcesResponse{Devices: []*podresourcesv1.ContainerDevices{
+		{
+			ResourceName: "nvidia.com/gpu",
+			DeviceIds:    []string{"GPU-0", "GPU-1"},
+			Topology:     &podresourcesv1.TopologyInfo{Nodes: []*podresourcesv1.NUMANode{{ID: 0}}},
+		},
+		{ResourceName: "smarter-devices/ttyUSB0", DeviceIds: []string{"ttyUSB0"}},
+	}}, nil
+}
+
+// startPodResources serves the pod-resources API on a socket in rootFs, where the kubelet creates it
+func startPodResources(t *testing.T, rootFs string) {
+	socket := filepath.Join(rootFs, defaultPodResourcesSocket)
+	require.NoError(t, os.MkdirAll(filepath.Dir(socket), 0o755))
+	l, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	s := grpc.NewServer()
+	podresourcesv1.RegisterPodResourcesListerServer(s, &fakePodResources{})
+	go func() { _ = s.Serve(l) }()
+	t.Cleanup(s.Stop)
+}
+
+func withRequests(p *corev1.Pod, requests corev1.ResourceList) *corev1.Pod {
+	p.Spec.Containers[0].Resources.Requests = requests
+	return p
+}
+
+func TestKubernetesExtendedResources(t *testing.T) {
+	t.Setenv("NODE_NAME", "node-1")
+	// unix socket paths are limited to about 100 characters
+	rootFs, err := os.MkdirTemp("", "tlum")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(rootFs) })
+
+	completed := withRequests(testPod("default", "job", nil, nil), corev1.ResourceList{"nvidia.com/gpu": resource.MustParse("1")})
+	completed.Status.Phase = corev1.PodSucceeded
+	client := fake.NewSimpleClientset(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "kube-system", UID: "cluster-1"}},
+		&corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: "node-1"},
+			Status: corev1.NodeStatus{
+				Capacity: corev1.ResourceList{
+					corev1.ResourceCPU:                   resource.MustParse("4"),
+					"hugepages-2Mi":                      resource.MustParse("0"),
+					"nvidia.com/gpu":                     resource.MustParse("2"),
+					"smarter-devices/ttyUSB0":            resource.MustParse("1"),
+					"attachable-volumes-kubernetes.io/x": resource.MustParse("10"),
+				},
+				Allocatable: corev1.ResourceList{
+					"nvidia.com/gpu":          resource.MustParse("2"),
+					"smarter-devices/ttyUSB0": resource.MustParse("0"),
+				},
+			},
+		},
+		withRequests(testPod("default", "inference", nil, nil), corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1"), "nvidia.com/gpu": resource.MustParse("1")}),
+		completed,
+	)
+	kp, err := newKubernetesProvider(client, rootFs, zerolog.Nop())
+	require.NoError(t, err)
+	kp.podResourcesSocket = filepath.Join(rootFs, defaultPodResourcesSocket)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	kp.Start(ctx, wg)
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+	require.Eventually(t, func() bool { return kp.pods.informer.HasSynced() && kp.pods.nodeInformer.HasSynced() }, 5*time.Second, time.Millisecond)
+
+	// without the socket only the extended resources are reported
+	c := &NodeMountedCollector{}
+	require.NoError(t, kp.ProvideExtendedResources(context.Background(), c))
+	assert.Equal(t, []*ExtendedResource{
+		{Name: "nvidia.com/gpu", Capacity: 2, Allocatable: 2, InUse: 1},
+		{Name: "smarter-devices/ttyUSB0", Capacity: 1},
+	}, c.ExtendedResources)
+	assert.Empty(t, c.AttachedPeripherals)
+
+	// the node is still published when the pod-resources API fails
+	require.NoError(t, os.MkdirAll(filepath.Dir(kp.podResourcesSocket), 0o755))
+	require.NoError(t, os.WriteFile(kp.podResourcesSocket, nil, 0o600))
+	c = &NodeMountedCollector{}
+	require.NoError(t, kp.ProvideExtendedResources(context.Background(), c))
+	assert.Len(t, c.ExtendedResources, 2)
+	assert.Empty(t, c.AttachedPeripherals)
+	require.NoError(t, os.Remove(kp.podResourcesSocket))
+
+	startPodResources(t, rootFs)
+	c = &NodeMountedCollector{AttachedPeripherals: []*Peripheral{{Device: "camera", Source: "usb"}}}
+	require.NoError(t, kp.ProvideExtendedResources(context.Background(), c))
+	require.Len(t, c.AttachedPeripherals, 4)
+	assert.Equal(t, "camera", c.AttachedPeripherals[0].Device)
+	assert.Equal(t, &Peripheral{
+		Device:    "nvidia.com_gpu_GPU-0",
+		Available: true,
+		Source:    "kubernetes",
+		Interface: "DevicePlugin",
+		Details:   map[string]string{"resource": "nvidia.com/gpu", "device_id": "GPU-0", "numa_node": "0"},
+	}, c.AttachedPeripherals[1])
+	assert.Equal(t, &Peripheral{
+		Device:    "nvidia.com_gpu_GPU-1",
+		Source:    "kubernetes",
+		Interface: "DevicePlugin",
+		Details: map[string]string{
+			"resource": "nvidia.com/gpu", "device_id": "GPU-1", "numa_node": "0",
+			"namespace": "default", "pod": "inference", "container": "main",
+		},
+	}, c.AttachedPeripherals[2])
+	assert.Equal(t, "smarter-devices_ttyusb0_ttyUSB0", c.AttachedPeripherals[3].Device)
+
+	// the devices are not reported when their interface is filtered
+	kp.PeripheralInterfaces = []string{"USB"}
+	c = &NodeMountedCollector{}
+	require.NoError(t, kp.ProvideExtendedResources(context.Background(), c))
+	assert.Empty(t, c.AttachedPeripherals)
+	assert.Len(t, c.ExtendedResources, 2)
+
+	// the node is read from the informer, never fetched at every collection
+	for _, a := range client.Actions() {
+		assert.False(t, a.GetVerb() == "get" && a.GetResource().Resource == "nodes", "unexpected %v", a)
+	}
+}
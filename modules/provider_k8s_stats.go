@@ -0,0 +1,410 @@
+/*
+ICOS Telemetruum Agent
+Copyright © 2022-2024 Engineering Ingegneria Informatica S.p.A.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+This work has received funding from the European Union's HORIZON research
+and innovation programme under grant agreement No. 101070177.
+*/
+
+package modules
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/rs/zerolog"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+var (
+	kubeletEndpoint = kingpin.Flag("kubelet-endpoint", "host:port of the kubelet. By default the node address and the kubelet port are read from the API server").PlaceHolder("HOST:PORT").String()
+	kubeletCAFile   = kingpin.Flag("kubelet-ca-file", "CA bundle used to verify the kubelet certificate. By default the CA of the service account").PlaceHolder("FILE").String()
+	kubeletInsecure = kingpin.Flag("kubelet-insecure-skip-verify", "Do not verify the kubelet certificate, which is often self-signed").Bool()
+	kubeletPodRes   = kingpin.Flag("kubelet-pod-resources-socket", "Socket of the kubelet pod-resources API, relative to --path-rootfs. The devices of the device plugins are only reported when it is mounted").Default(defaultPodResourcesSocket).PlaceHolder("FILE").String()
+)
+
+const (
+	defaultKubeletPort        = 10250
+	defaultPodResourcesSocket = "/var/lib/kubelet/pod-resources/kubelet.sock"
+)
+
+// KubeletConfig holds the settings used to read the Summary and the pod-resources APIs of the local kubelet
+type KubeletConfig struct {
+	// host:port of the kubelet, read from the Node status if empty
+	Endpoint string          `yaml:"endpoint"`
+	TLS      TLSClientConfig `yaml:"tls"`
+	// unix socket of the pod-resources API, relative to the root fs
+	PodResourcesSocket string `yaml:"pod_resources_socket"`
+}
+
+func defaultKubeletConfig() KubeletConfig {
+	return KubeletConfig{
+		Endpoint:           *kubeletEndpoint,
+		TLS:                TLSClientConfig{CAFile: *kubeletCAFile, InsecureSkipVerify: *kubeletInsecure},
+		PodResourcesSocket: *kubeletPodRes,
+	}
+}
+
+func (c KubeletConfig) validate() error {
+	var errs []error
+
+	if c.Endpoint != "" {
+		if _, _, err := net.SplitHostPort(c.Endpoint); err != nil {
+			errs = append(errs, fmt.Errorf("endpoint: %w", err))
+		}
+	}
+
+	if err := c.TLS.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("tls: %w", err))
+	}
+
+	return errors.Join(errs...)
+}
+
+// kubeletSummary is the subset of the kubelet Summary API (stats/v1alpha1) read by the agent. Values are
+// pointers because the kubelet omits the ones it can't measure
+type kubeletSummary struct {
+	Pods []kubeletPodStats `json:"pods"`
+}
+
+type kubeletPodStats struct {
+	PodRef struct {
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+	} `json:"podRef"`
+	Containers       []kubeletContainerStats `json:"containers"`
+	CPU              *kubeletCPUStats        `json:"cpu"`
+	Memory           *kubeletMemoryStats     `json:"memory"`
+	Network          *kubeletNetworkStats    `json:"network"`
+	EphemeralStorage *kubeletFsStats         `json:"ephemeral-storage"`
+}
+
+type kubeletContainerStats struct {
+	Name   string              `json:"name"`
+	CPU    *kubeletCPUStats    `json:"cpu"`
+	Memory *kubeletMemoryStats `json:"memory"`
+	Rootfs *kubeletFsStats     `json:"rootfs"`
+	Logs   *kubeletFsStats     `json:"logs"`
+}
+
+type kubeletCPUStats struct {
+	UsageCoreNanoSeconds *uint64 `json:"usageCoreNanoSeconds"`
+}
+
+type kubeletMemoryStats struct {
+	WorkingSetBytes *uint64 `json:"workingSetBytes"`
+}
+
+type kubeletInterfaceStats struct {
+	Name    string  `json:"name"`
+	RxBytes *uint64 `json:"rxBytes"`
+	TxBytes *uint64 `json:"txBytes"`
+}
+
+type kubeletNetworkStats struct {
+	kubeletInterfaceStats
+	Interfaces []kubeletInterfaceStats `json:"interfaces"`
+}
+
+type kubeletFsStats struct {
+	UsedBytes *uint64 `json:"usedBytes"`
+}
+
+// kubeletClient reads the Summary API of the kubelet of the node, directly with the service account token or,
+// if that fails, through the API server proxy
+type kubeletClient struct {
+	nodeName string
+	client   kubernetes.Interface
+	http     *http.Client
+	token    func() (string, error)
+	logger   zerolog.Logger
+
+	mu       sync.Mutex
+	endpoint string
+}
+
+func newKubeletClient(c KubeletConfig, restConfig *rest.Config, client kubernetes.Interface, nodeName string, logger zerolog.Logger) (*kubeletClient, error) {
+	// by default the kubelet certificate is verified with the cluster CA, as with serverTLSBootstrap
+	tlsClient := c.TLS
+	if tlsClient.CAFile == "" {
+		tlsClient.CAFile = restConfig.CAFile
+	}
+	tlsConfig, err := tlsClient.Build()
+	if err != nil {
+		return nil, err
+	}
+	if tlsClient.CAFile == "" && len(restConfig.CAData) > 0 {
+		tlsConfig.RootCAs = x509.NewCertPool()
+		tlsConfig.RootCAs.AppendCertsFromPEM(restConfig.CAData)
+	}
+
+	token := func() (string, error) { return restConfig.BearerToken, nil }
+	if restConfig.BearerTokenFile != "" {
+		// projected service account tokens are rotated by the kubelet
+		f := &watchedFile{path: restConfig.BearerTokenFile}
+		token = func() (string, error) {
+			b, _, err := f.read()
+			return strings.TrimSpace(string(b)), err
+		}
+	}
+
+	return &kubeletClient{
+		nodeName: nodeName,
+		client:   client,
+		http:     &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment}},
+		token:    token,
+		logger:   logger,
+		endpoint: c.Endpoint,
+	}, nil
+}
+
+// resolveEndpoint reads the address and the kubelet port of the node from the API server
+func (k *kubeletClient) resolveEndpoint(ctx context.Context) (string, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.endpoint != "" {
+		return k.endpoint, nil
+	}
+
+	node, err := k.client.CoreV1().Nodes().Get(ctx, k.nodeName, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("error reading node %s: %w", k.nodeName, err)
+	}
+
+	address := ""
+	for _, t := range []corev1.NodeAddressType{corev1.NodeInternalIP, corev1.NodeExternalIP, corev1.NodeHostName} {
+		for _, a := range node.Status.Addresses {
+			if a.Type == t && address == "" {
+				address = a.Address
+			}
+		}
+	}
+	if address == "" {
+		return "", fmt.Errorf("node %s has no address", k.nodeName)
+	}
+
+	port := int(node.Status.DaemonEndpoints.KubeletEndpoint.Port)
+	if port == 0 {
+		port = defaultKubeletPort
+	}
+
+	k.endpoint = net.JoinHostPort(address, strconv.Itoa(port))
+	k.logger.Debug().Msgf("Reading the kubelet stats from %s", k.endpoint)
+	return k.endpoint, nil
+}
+
+func (k *kubeletClient) direct(ctx context.Context) ([]byte, error) {
+	endpoint, err := k.resolveEndpoint(ctx)
+	if err != nil {
+		return nil, err
+	}
+	token, err := k.token()
+	if err != nil {
+		return nil, fmt.Errorf("error reading the service account token: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+endpoint+"/stats/summary", nil)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := k.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("kubelet answered %s", resp.Status)
+	}
+	return body, nil
+}
+
+func (k *kubeletClient) proxy(ctx context.Context) ([]byte, error) {
+	return k.client.CoreV1().RESTClient().Get().
+		AbsPath("/api/v1/nodes", k.nodeName, "proxy", "stats", "summary").
+		DoRaw(ctx)
+}
+
+// summary returns the pods stats of the node
+func (k *kubeletClient) summary(ctx context.Context) (*kubeletSummary, error) {
+	body, err := k.direct(ctx)
+	if err != nil {
+		k.logger.Debug().Msgf("Error reading the kubelet stats, falling back to the API server proxy: %s", err)
+
+		var proxyErr error
+		body, proxyErr = k.proxy(ctx)
+		if proxyErr != nil {
+			return nil, fmt.Errorf("error reading the kubelet stats: %w", errors.Join(err, fmt.Errorf("proxy: %w", proxyErr)))
+		}
+	}
+
+	summary := &kubeletSummary{}
+	if err := json.Unmarshal(body, summary); err != nil {
+		return nil, fmt.Errorf("error decoding the kubelet stats: %w", err)
+	}
+	return summary, nil
+}
+
+func uint64Ptr(v *uint64) *int64 {
+	if v == nil {
+		return nil
+	}
+	return int64Ptr(int64(*v))
+}
+
+func cpuSeconds(s *kubeletCPUStats) float64 {
+	if s == nil || s.UsageCoreNanoSeconds == nil {
+		return 0
+	}
+	return float64(*s.UsageCoreNanoSeconds) / 1e9
+}
+
+func workingSet(s *kubeletMemoryStats) int64 {
+	if s == nil || s.WorkingSetBytes == nil {
+		return 0
+	}
+	return int64(*s.WorkingSetBytes)
+}
+
+// memoryLimits returns the memory limit of every container of the pod, and of the pod if all its containers
+// have one
+func memoryLimits(pod *corev1.Pod) (map[string]*int64, *int64) {
+	if pod == nil {
+		return nil, nil
+	}
+
+	limits := map[string]*int64{}
+	var total int64
+	for _, c := range pod.Spec.Containers {
+		if q, ok := c.Resources.Limits[corev1.ResourceMemory]; ok {
+			limits[c.Name] = int64Ptr(q.Value())
+			total += q.Value()
+		}
+	}
+	if len(limits) == 0 || len(limits) < len(pod.Spec.Containers) {
+		return limits, nil
+	}
+	return limits, int64Ptr(total)
+}
+
+// ProvideWorkloadUsage reads the usage of the pods of the node, and of their containers, from the kubelet
+func (kp *KubernetesProvider) ProvideWorkloadUsage(ctx context.Context, c *WorkloadUsageCollector) error {
+	summary, err := kp.kubelet.summary(ctx)
+	if err != nil {
+		return err
+	}
+
+	pods, err := kp.pods.list(labels.Everything())
+	if err != nil {
+		return fmt.Errorf("error listing pods in node %s: %w", kp.pods.nodeName, err)
+	}
+	byName := map[string]*corev1.Pod{}
+	for _, p := range pods {
+		byName[p.Namespace+"/"+p.Name] = p
+	}
+
+	res := []*WorkloadUsage{}
+	for _, ps := range summary.Pods {
+		pod := byName[ps.PodRef.Namespace+"/"+ps.PodRef.Name]
+		wi := WorkloadInfo{Name: ps.PodRef.Name, Annotations: map[string]string{}}
+		if pod != nil {
+			wi = *podWorkload(pod)
+		}
+		containerLimits, podLimit := memoryLimits(pod)
+
+		usage := &WorkloadUsage{
+			WorkloadInfo: wi,
+			CPUSeconds:   cpuSeconds(ps.CPU),
+			MemoryUsage:  workingSet(ps.Memory),
+			MemoryLimit:  podLimit,
+		}
+		if ps.Network != nil {
+			rx, tx := ps.Network.RxBytes, ps.Network.TxBytes
+			if len(ps.Network.Interfaces) > 0 {
+				var rxSum, txSum uint64
+				for _, i := range ps.Network.Interfaces {
+					if i.RxBytes != nil {
+						rxSum += *i.RxBytes
+					}
+					if i.TxBytes != nil {
+						txSum += *i.TxBytes
+					}
+				}
+				rx, tx = &rxSum, &txSum
+			}
+			usage.NetworkRx, usage.NetworkTx = uint64Ptr(rx), uint64Ptr(tx)
+		}
+		if ps.EphemeralStorage != nil {
+			usage.EphemeralStorage = uint64Ptr(ps.EphemeralStorage.UsedBytes)
+		}
+		res = append(res, usage)
+
+		for _, cs := range ps.Containers {
+			cu := &WorkloadUsage{
+				WorkloadInfo: wi,
+				Container:    cs.Name,
+				CPUSeconds:   cpuSeconds(cs.CPU),
+				MemoryUsage:  workingSet(cs.Memory),
+				MemoryLimit:  containerLimits[cs.Name],
+			}
+			var storage int64
+			var hasStorage bool
+			for _, fs := range []*kubeletFsStats{cs.Rootfs, cs.Logs} {
+				if fs != nil && fs.UsedBytes != nil {
+					storage += int64(*fs.UsedBytes)
+					hasStorage = true
+				}
+			}
+			if hasStorage {
+				cu.EphemeralStorage = int64Ptr(storage)
+			}
+			res = append(res, cu)
+		}
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Name != res[j].Name {
+			return res[i].Name < res[j].Name
+		}
+		return res[i].Container < res[j].Container
+	})
+	c.Workloads = res
+	c.ClusterId = kp.Id
+
+	return nil
+}
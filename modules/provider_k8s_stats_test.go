@@ -0,0 +1,173 @@
+/*
+ICOS Telemetruum Agent
+Copyright © 2022-2024 Engineering Ingegneria Informatica S.p.A.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+This work has received funding from the European Union's HORIZON research
+and innovation programme under grant agreement No. 101070177.
+*/
+
+package modules
+
+import (
+	"context"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+)
+
+// summary of the kubelet stand-in, trimmed
+const kubeletSummaryJSON = `{
+  "node": {"nodeName": "node-1"},
+  "pods": [
+    {
+      "podRef": {"name": "web", "namespace": "default", "uid": "1"},
+      "cpu": {"usageCoreNanoSeconds": 3000000000},
+      "memory": {"workingSetBytes": 300, "usageBytes": 400},
+      "network": {"name": "eth0", "rxBytes": 10, "txBytes": 5, "interfaces": [
+        {"name": "eth0", "rxBytes": 10, "txBytes": 5},
+        {"name": "net1", "rxBytes": 1, "txBytes": 1}
+      ]},
+      "ephemeral-storage": {"usedBytes": 4096},
+      "containers": [
+        {"name": "app", "cpu": {"usageCoreNanoSeconds": 2000000000}, "memory": {"workingSetBytes": 200}, "rootfs": {"usedBytes": 1024}, "logs": {"usedBytes": 512}},
+        {"name": "sidecar", "cpu": {"usageCoreNanoSeconds": 1000000000}, "memory": {"workingSetBytes": 100}}
+      ]
+    },
+    {
+      "podRef": {"name": "static", "namespace": "kube-system", "uid": "2"},
+      "cpu": {"usageCoreNanoSeconds": 500000000},
+      "memory": {"workingSetBytes": 50}
+    }
+  ]
+}`
+
+// startKubelet starts a kubelet stand-in that requires the given token, and returns its CA file
+func startKubelet(t *testing.T, token string, calls *atomic.Int32) (*httptest.Server, string) {
+	kubelet := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if r.URL.Path != "/stats/summary" || r.Header.Get("Authorization") != "Bearer "+token {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte(kubeletSummaryJSON))
+	}))
+	t.Cleanup(kubelet.Close)
+
+	caFile := filepath.Join(t.TempDir(), "kubelet-ca.pem")
+	require.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: kubelet.Certificate().Raw}), 0o600))
+	return kubelet, caFile
+}
+
+// startAPIServer starts an API server stand-in serving the node and the kubelet proxy
+func startAPIServer(t *testing.T, kubeletPort int, proxyCalls *atomic.Int32) string {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/api/v1/nodes/node-1":
+			_, _ = fmt.Fprintf(w, `{"kind": "Node", "apiVersion": "v1", "metadata": {"name": "node-1"}, "status": {
+			  "addresses": [{"type": "Hostname", "address": "node-1"}, {"type": "InternalIP", "address": "127.0.0.1"}],
+			  "daemonEndpoints": {"kubeletEndpoint": {"Port": %d}}}}`, kubeletPort)
+		case "/api/v1/nodes/node-1/proxy/stats/summary":
+			proxyCalls.Add(1)
+			_, _ = w.Write([]byte(kubeletSummaryJSON))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(api.Close)
+	return api.URL
+}
+
+func TestKubeletWorkloadUsage(t *testing.T) {
+	t.Setenv("NODE_NAME", "node-1")
+	var kubeletCalls, proxyCalls atomic.Int32
+
+	kubelet, caFile := startKubelet(t, "sa-token", &kubeletCalls)
+	_, port, err := net.SplitHostPort(kubelet.Listener.Addr().String())
+	require.NoError(t, err)
+	kubeletPort, err := strconv.Atoi(port)
+	require.NoError(t, err)
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("sa-token\n"), 0o600))
+	restConfig := &rest.Config{Host: startAPIServer(t, kubeletPort, &proxyCalls), BearerTokenFile: tokenFile}
+	apiClient, err := kubernetes.NewForConfig(restConfig)
+	require.NoError(t, err)
+
+	// the pods cache is fed by a fake clientset
+	web := testPod("default", "web", nil, map[string]string{"app.icos.eu/name": "shop"})
+	web.Spec.Containers = []corev1.Container{
+		{Name: "app", Resources: corev1.ResourceRequirements{Limits: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("256Mi")}}},
+		{Name: "sidecar"},
+	}
+	kp, err := newKubernetesProvider(fake.NewSimpleClientset(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "kube-system", UID: "cluster-1"}}, web), "/", zerolog.Nop())
+	require.NoError(t, err)
+	kp.kubelet, err = newKubeletClient(KubeletConfig{TLS: TLSClientConfig{CAFile: caFile}}, restConfig, apiClient, "node-1", zerolog.Nop())
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	kp.Start(ctx, wg)
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+	require.Eventually(t, kp.pods.informer.HasSynced, 5*time.Second, time.Millisecond)
+
+	c := &WorkloadUsageCollector{}
+	require.NoError(t, kp.ProvideWorkloadUsage(context.Background(), c))
+	assert.Equal(t, int32(1), kubeletCalls.Load())
+	assert.Equal(t, int32(0), proxyCalls.Load())
+	assert.Equal(t, "cluster-1", c.ClusterId)
+
+	shop := WorkloadInfo{Name: "web", Annotations: map[string]string{"icos.app.name": "shop"}}
+	assert.Equal(t, []*WorkloadUsage{
+		{WorkloadInfo: WorkloadInfo{Name: "static", Annotations: map[string]string{}}, CPUSeconds: 0.5, MemoryUsage: 50},
+		{WorkloadInfo: shop, CPUSeconds: 3, MemoryUsage: 300, NetworkRx: int64Ptr(11), NetworkTx: int64Ptr(6), EphemeralStorage: int64Ptr(4096)},
+		{WorkloadInfo: shop, Container: "app", CPUSeconds: 2, MemoryUsage: 200, MemoryLimit: int64Ptr(256 << 20), EphemeralStorage: int64Ptr(1536)},
+		{WorkloadInfo: shop, Container: "sidecar", CPUSeconds: 1, MemoryUsage: 100},
+	}, c.Workloads)
+
+	// the API server proxy is used when the kubelet refuses the token
+	require.NoError(t, os.WriteFile(tokenFile, []byte("expired"), 0o600))
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(tokenFile, later, later))
+
+	c = &WorkloadUsageCollector{}
+	require.NoError(t, kp.ProvideWorkloadUsage(context.Background(), c))
+	assert.Equal(t, int32(2), kubeletCalls.Load())
+	assert.Equal(t, int32(1), proxyCalls.Load())
+	assert.Len(t, c.Workloads, 4)
+}
@@ -0,0 +1,110 @@
+/*
+ICOS Telemetruum Agent
+Copyright © 2022-2024 Engineering Ingegneria Informatica S.p.A.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+This work has received funding from the European Union's HORIZON research
+and innovation programme under grant agreement No. 101070177.
+*/
+
+package modules
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func testPod(namespace string, name string, labels map[string]string, annotations map[string]string, args ...string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Labels: labels, Annotations: annotations},
+		Spec:       corev1.PodSpec{NodeName: "node-1", Containers: []corev1.Container{{Name: "main", Args: args}}},
+	}
+}
+
+func TestKubernetesPodCache(t *testing.T) {
+	t.Setenv("NODE_NAME", "node-1")
+	t.Setenv("NAMESPACE", "telemetruum")
+	t.Setenv("POD_NAME", "agent-1")
+	rootFs := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(rootFs, "var/lib/nuvlaedge/nuvla"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(rootFs, "var/lib/nuvlaedge/nuvla/.context"), []byte(`{"id":"nuvlabox/1"}`), 0o644))
+
+	client := fake.NewSimpleClientset(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "kube-system", UID: "cluster-1"}},
+		testPod("default", "web", nil, map[string]string{"app.icos.eu/name": "shop", "other": "x"}),
+		testPod("nuvla", "nuvlaedge-agent", map[string]string{"app.kubernetes.io/name": "nuvlaedge", "component": "agent"}, nil),
+		testPod("open-cluster-management-agent", "klusterlet-work-agent-1", map[string]string{"app": "klusterlet-manifestwork-agent"}, nil, "--spoke-cluster-name=edge", "--agent-id=abc"),
+		testPod("default", "klusterlet-work-agent-2", nil, nil, "--spoke-cluster-name=other", "--agent-id=def"),
+	)
+	kp, err := newKubernetesProvider(client, rootFs, zerolog.Nop())
+	require.NoError(t, err)
+
+	// nothing is reported until the cache is synced
+	assert.ErrorIs(t, kp.ProvideWorkloadInfo(context.Background(), &WorkloadInfoCollector{}), errPodCacheNotSynced)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	kp.Start(ctx, wg)
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+	require.Eventually(t, kp.pods.informer.HasSynced, 5*time.Second, time.Millisecond)
+
+	wc := &WorkloadInfoCollector{}
+	require.NoError(t, kp.ProvideWorkloadInfo(context.Background(), wc))
+	assert.Equal(t, "cluster-1", wc.ClusterId)
+	require.Len(t, wc.RunningWorkloads, 4)
+	assert.Equal(t, "web", wc.RunningWorkloads[3].Name)
+	assert.Equal(t, map[string]string{"icos.app.name": "shop"}, wc.RunningWorkloads[3].Annotations)
+
+	nuvla := &OrchInfoCollector{}
+	require.NoError(t, kp.ProvideNuvlaOrchestratorInfo(context.Background(), nuvla))
+	assert.Equal(t, "nuvla", nuvla.Type)
+	assert.Equal(t, "nuvlabox/1", nuvla.AgentId)
+
+	// the OCM info is published by the leader only, from the klusterlet pods of the agent namespace
+	ocm := &OrchInfoCollector{}
+	require.Eventually(t, func() bool {
+		ocm = &OrchInfoCollector{}
+		return kp.ProvideOCMOrchInfo(context.Background(), ocm) == nil && ocm.Type != ""
+	}, 5*time.Second, time.Millisecond)
+	assert.Equal(t, OrchInfoCollector{Type: "ocm", AgentId: "abc", AgentName: "edge", ClusterId: "cluster-1"}, *ocm)
+	for _, a := range client.Actions() {
+		if a.GetVerb() == "list" && a.GetResource().Resource == "pods" {
+			restricted := a.GetNamespace() != "" || !a.(k8stesting.ListAction).GetListRestrictions().Fields.Empty()
+			assert.True(t, restricted, "pods are never listed on the whole cluster")
+		}
+	}
+
+	// new pods are seen without listing again
+	_, err = client.CoreV1().Pods("default").Create(context.Background(), testPod("default", "db", nil, nil), metav1.CreateOptions{})
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		wc := &WorkloadInfoCollector{}
+		return kp.ProvideWorkloadInfo(context.Background(), wc) == nil && len(wc.RunningWorkloads) == 5
+	}, 5*time.Second, time.Millisecond)
+}
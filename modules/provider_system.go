@@ -23,81 +23,112 @@ package modules
 import (
 	"context"
 	"fmt"
-	"log"
-	"net"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
 	"sync"
 
-	"github.com/alecthomas/kingpin/v2"
+	"github.com/rs/zerolog"
 )
 
+func init() {
+	RegisterProvider(ProviderRegistration{
+		Name:     "System",
+		Flag:     "system",
+		Priority: 20,
+		Initialize: func(cfg *Config, logger zerolog.Logger) (Provider, error) {
+			return &SystemProvider{
+				BaseProvider:         BaseProvider{Logger: logger, PathRootFs: cfg.PathRootFs},
+				HostIP:               cfg.HostIP,
+				CPUFlags:             cfg.CPUFlags,
+				Location:             cfg.Location,
+				PeripheralInterfaces: cfg.PeripheralInterfaces,
+				storage:              newStorageFilter(cfg.Storage),
+			}, nil
+		},
+		Settings: func(cfg *Config) any {
+			return []any{cfg.PathRootFs, cfg.HostIP, cfg.Storage, cfg.CPUFlags, cfg.Location, cfg.PeripheralInterfaces}
+		},
+		Feeds: []ProviderFeed{
+			Feed((*SystemProvider).ProvideHostInfo),
+			Feed((*SystemProvider).ProvideWorkloadInfoLabels),
+			Feed((*SystemProvider).ProvideWorkloadUsageLabels),
+			Feed((*SystemProvider).ProvideHostResources),
+			Feed((*SystemProvider).ProvideHostStorage),
+			Feed((*SystemProvider).ProvideHostNetwork),
+			Feed((*SystemProvider).ProvideHostCapabilities),
+			Feed((*SystemProvider).ProvideHostAccelerators),
+			Feed((*SystemProvider).ProvideUSBPeripherals),
+		}})
+}
+
 type SystemProvider struct {
 	BaseProvider
+	HostIP   HostIPConfig
+	CPUFlags []string
+	Location LocationConfig
+	// Interfaces of the peripherals to report, all if empty
+	PeripheralInterfaces []string
+	storage              storageFilter
+	stuckMounts          sync.Map
+	netnsWarning         sync.Once
 }
 
-var (
-	ipHint = kingpin.Flag("ip-hint", "An ip:port to use to help identify the device's ip (the specified endpoint is never called)").Default("8.8.8.8:80").String()
-)
-
 func (p *SystemProvider) Start(context.Context, *sync.WaitGroup) {
 
 }
 
-func (p *SystemProvider) ProvideWorkloadInfoLabels(ctx context.Context, wic *WorkloadInfoCollector) {
-
-	b, err := os.ReadFile(filepath.Join(*pathRootFs, "/etc/machine-id")) // just pass the file name
+func (p *SystemProvider) machineId() string {
+	b, err := os.ReadFile(filepath.Join(p.PathRootFs, "/etc/machine-id")) // just pass the file name
 	if err != nil {
-		p.Logger.Warn().Msgf("Cannot find %s file", filepath.Join(*pathRootFs, "/etc/machine-id"))
-		fmt.Print(err)
+		p.Logger.Warn().Msgf("Cannot find %s file: %s", filepath.Join(p.PathRootFs, "/etc/machine-id"), err)
 	}
 
-	wic.HostId = strings.Trim(string(b), "\n")
+	return strings.Trim(string(b), "\n")
 }
 
-func (p *SystemProvider) ProvideHostInfo(ctx context.Context, hic *HostInfoCollector) {
+func (p *SystemProvider) ProvideWorkloadInfoLabels(ctx context.Context, wic *WorkloadInfoCollector) error {
+	wic.HostId = p.machineId()
+	return nil
+}
+
+func (p *SystemProvider) ProvideWorkloadUsageLabels(ctx context.Context, wuc *WorkloadUsageCollector) error {
+	wuc.HostId = p.machineId()
+	return nil
+}
+
+func (p *SystemProvider) ProvideHostInfo(ctx context.Context, hic *HostInfoCollector) error {
 	p.Logger.Debug().Msg("Collecting host metrics")
 
 	hostname, err := os.Hostname()
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("cannot get the hostname: %w", err)
+	}
+	b, err := os.ReadFile(filepath.Join(p.PathRootFs, "/etc/machine-id")) // just pass the file name
+	if err != nil {
+		p.Logger.Warn().Msgf("Cannot find %s file: %s", filepath.Join(p.PathRootFs, "/etc/machine-id"), err)
 	}
-	b, err := os.ReadFile(filepath.Join(*pathRootFs, "/etc/machine-id")) // just pass the file name
+	loc, err := p.location(ctx)
 	if err != nil {
-		p.Logger.Warn().Msgf("Cannot find %s file", filepath.Join(*pathRootFs, "/etc/machine-id"))
-		fmt.Print(err)
+		p.Logger.Warn().Msgf("Cannot determine the host location: %s", err)
+	}
+	// a host without a usable address, e.g. an air-gapped node, is still reported
+	ip := ""
+	if interfaces, err := p.readInterfaces(); err != nil {
+		p.Logger.Warn().Msgf("Cannot determine the host ip: %s", err)
+	} else if addr, err := p.selectHostIP(interfaces); err != nil {
+		p.Logger.Warn().Msgf("Cannot determine the host ip: %s", err)
+	} else {
+		ip = addr.String()
 	}
-	loc := p.getMachineLocation()
 
 	hic.Os = runtime.GOOS
 	hic.Arch = runtime.GOARCH
-	hic.Ip = p.getOutboundIP().String()
-	hic.Latitutde = loc[0]
-	hic.Longitude = loc[1]
+	hic.Ip = ip
+	hic.Location = loc
 	hic.Hostname = hostname
 	hic.Id = strings.Trim(string(b), "\n")
-}
-
-func (p *SystemProvider) getMachineLocation() []string {
-	content, err := os.ReadFile(filepath.Join(*pathRootFs, "/etc/machine-location")) // just pass the file name
-	if err != nil {
-		p.Logger.Warn().Msgf("Cannot find %s file", filepath.Join(*pathRootFs, "/etc/machine-location"))
-		return []string{"", ""}
-	}
-	return strings.Split(strings.Trim(string(content), "\n"), ":")
-}
-
-// Get preferred outbound ip of this machine
-func (p *SystemProvider) getOutboundIP() net.IP {
-	conn, err := net.Dial("udp", *ipHint)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer conn.Close()
-
-	localAddr := conn.LocalAddr().(*net.UDPAddr)
 
-	return localAddr.IP
+	return nil
 }
@@ -0,0 +1,191 @@
+/*
+ICOS Telemetruum Agent
+Copyright © 2022-2024 Engineering Ingegneria Informatica S.p.A.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+This work has received funding from the European Union's HORIZON research
+and innovation programme under grant agreement No. 101070177.
+*/
+
+package modules
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/kingpin/v2"
+)
+
+var (
+	cpuFlags = kingpin.Flag("cpu-flags", "Instruction set extension reported by tlum_host_cpu_flag (repeatable)").Default("aes", "avx2", "avx512f", "neon", "sve").PlaceHolder("FLAG").Strings()
+)
+
+// cpuFlagAliases maps the names used by some architectures to the common ones
+var cpuFlagAliases = map[string]string{
+	// NEON is called Advanced SIMD on arm64
+	"asimd": "neon",
+}
+
+// cpuImplementers are the vendors of the arm64 CPUs, which only report the implementer code
+var cpuImplementers = map[string]string{
+	"0x41": "ARM",
+	"0x42": "Broadcom",
+	"0x43": "Cavium",
+	"0x46": "Fujitsu",
+	"0x48": "HiSilicon",
+	"0x4e": "NVIDIA",
+	"0x51": "Qualcomm",
+	"0x61": "Apple",
+	"0xc0": "Ampere",
+}
+
+type cpuInfo struct {
+	vendor     string
+	model      string
+	flags      map[string]bool
+	processors int64
+}
+
+// parseCPUInfo reads the first processor of /proc/cpuinfo, on x86 and arm, and counts the processors
+func parseCPUInfo(content []byte) cpuInfo {
+	info := cpuInfo{flags: map[string]bool{}}
+	first := true
+	s := bufio.NewScanner(bytes.NewReader(content))
+	for s.Scan() {
+		key, value, ok := strings.Cut(s.Text(), ":")
+		if !ok {
+			continue
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if key == "processor" {
+			if _, err := strconv.Atoi(value); err == nil {
+				info.processors++
+				first = info.processors == 1
+			}
+			continue
+		}
+		if !first {
+			continue
+		}
+		switch key {
+		case "vendor_id":
+			info.vendor = value
+		case "CPU implementer":
+			if info.vendor == "" {
+				info.vendor = cpuImplementers[strings.ToLower(value)]
+			}
+		case "model name", "Processor":
+			if info.model == "" {
+				info.model = value
+			}
+		case "flags", "Features":
+			for _, f := range strings.Fields(value) {
+				info.flags[f] = true
+				if alias, ok := cpuFlagAliases[f]; ok {
+					info.flags[alias] = true
+				}
+			}
+		}
+	}
+	return info
+}
+
+// readInt reads a file holding a single integer
+func readInt(path string) (int64, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+}
+
+// cpuTopology counts the physical cores and finds the highest frequency of the CPUs in sysfs
+func (p *SystemProvider) cpuTopology() (cores int64, maxFrequency int64) {
+	cpus, _ := filepath.Glob(filepath.Join(p.PathRootFs, "sys/devices/system/cpu/cpu[0-9]*"))
+	seen := map[[2]int64]bool{}
+	for _, cpu := range cpus {
+		pkg, err1 := readInt(filepath.Join(cpu, "topology/physical_package_id"))
+		core, err2 := readInt(filepath.Join(cpu, "topology/core_id"))
+		if err1 == nil && err2 == nil {
+			seen[[2]int64{pkg, core}] = true
+		}
+		// in kHz
+		if freq, err := readInt(filepath.Join(cpu, "cpufreq/cpuinfo_max_freq")); err == nil {
+			maxFrequency = max(maxFrequency, freq*1000)
+		}
+	}
+	return int64(len(seen)), maxFrequency
+}
+
+// hugePages reads the number of pages reserved for each huge page size
+func (p *SystemProvider) hugePages() map[int64]int64 {
+	pages := map[int64]int64{}
+	dirs, _ := filepath.Glob(filepath.Join(p.PathRootFs, "sys/kernel/mm/hugepages/hugepages-*kB"))
+	for _, dir := range dirs {
+		size, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(filepath.Base(dir), "hugepages-"), "kB"), 10, 64)
+		if err != nil {
+			continue
+		}
+		n, err := readInt(filepath.Join(dir, "nr_hugepages"))
+		if err != nil {
+			p.Logger.Debug().Msgf("Cannot read the huge pages of %s: %s", dir, err)
+			continue
+		}
+		pages[size*1024] = n
+	}
+	return pages
+}
+
+// ProvideHostCapabilities reads the CPU and memory capabilities of the host from /proc/cpuinfo and sysfs
+func (p *SystemProvider) ProvideHostCapabilities(ctx context.Context, c *HostCapabilitiesCollector) error {
+	content, err := os.ReadFile(filepath.Join(p.PathRootFs, "proc/cpuinfo"))
+	if err != nil {
+		return fmt.Errorf("error reading the cpu info: %w", err)
+	}
+	cpu := parseCPUInfo(content)
+
+	fs, err := p.procFS()
+	if err != nil {
+		return err
+	}
+	mem, err := fs.Meminfo()
+	if err != nil {
+		return fmt.Errorf("error reading the memory info: %w", err)
+	}
+
+	c.Arch = runtime.GOARCH
+	c.CPUVendor, c.CPUModel = cpu.vendor, cpu.model
+	c.LogicalCores = cpu.processors
+	c.PhysicalCores, c.MaxFrequency = p.cpuTopology()
+	if c.PhysicalCores == 0 {
+		// no topology in sysfs, e.g. in some containers
+		c.PhysicalCores = c.LogicalCores
+	}
+	c.CPUFlags = map[string]bool{}
+	for _, f := range p.CPUFlags {
+		f = strings.ToLower(f)
+		c.CPUFlags[f] = cpu.flags[f]
+	}
+	c.MemoryTotal = kibibytes(mem.MemTotal)
+	c.HugePages = p.hugePages()
+
+	return nil
+}
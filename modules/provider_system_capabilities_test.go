@@ -0,0 +1,132 @@
+/*
+ICOS Telemetruum Agent
+Copyright © 2022-2024 Engineering Ingegneria Informatica S.p.A.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+This work has received funding from the European Union's HORIZON research
+and innovation programme under grant agreement No. 101070177.
+*/
+
+package modules
+
+import (
+	"context"
+	"runtime"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProvideHostCapabilities(t *testing.T) {
+	x86 := map[string]string{
+		"proc/cpuinfo": `processor	: 0
+vendor_id	: GenuineIntel
+cpu family	: 6
+model name	: Intel(R) Xeon(R) Gold 6230 CPU @ 2.10GHz
+flags		: fpu vme sse4_2 aes avx avx2 avx512f avx512bw
+
+processor	: 1
+vendor_id	: GenuineIntel
+model name	: Intel(R) Xeon(R) Gold 6230 CPU @ 2.10GHz
+flags		: fpu vme sse4_2 aes avx avx2 avx512f avx512bw
+
+processor	: 2
+vendor_id	: GenuineIntel
+model name	: Intel(R) Xeon(R) Gold 6230 CPU @ 2.10GHz
+flags		: fpu vme sse4_2 aes avx avx2 avx512f avx512bw
+
+processor	: 3
+vendor_id	: GenuineIntel
+model name	: Intel(R) Xeon(R) Gold 6230 CPU @ 2.10GHz
+flags		: fpu vme sse4_2 aes avx avx2 avx512f avx512bw
+`,
+		"proc/meminfo": "MemTotal:        16000000 kB\nMemFree:          1000000 kB\n",
+		// two cores with hyper-threading
+		"sys/devices/system/cpu/cpu0/topology/physical_package_id": "0\n",
+		"sys/devices/system/cpu/cpu0/topology/core_id":             "0\n",
+		"sys/devices/system/cpu/cpu0/cpufreq/cpuinfo_max_freq":     "3900000\n",
+		"sys/devices/system/cpu/cpu1/topology/physical_package_id": "0\n",
+		"sys/devices/system/cpu/cpu1/topology/core_id":             "1\n",
+		"sys/devices/system/cpu/cpu1/cpufreq/cpuinfo_max_freq":     "3900000\n",
+		"sys/devices/system/cpu/cpu2/topology/physical_package_id": "0\n",
+		"sys/devices/system/cpu/cpu2/topology/core_id":             "0\n",
+		"sys/devices/system/cpu/cpu3/topology/physical_package_id": "0\n",
+		"sys/devices/system/cpu/cpu3/topology/core_id":             "1\n",
+		"sys/devices/system/cpu/cpufreq/.keep":                     "",
+		"sys/kernel/mm/hugepages/hugepages-2048kB/nr_hugepages":    "512\n",
+		"sys/kernel/mm/hugepages/hugepages-1048576kB/nr_hugepages": "0\n",
+	}
+	arm64 := map[string]string{
+		"proc/cpuinfo": `processor	: 0
+BogoMIPS	: 108.00
+Features	: fp asimd evtstrm aes pmull sha1 sha2 crc32 cpuid
+CPU implementer	: 0x41
+CPU architecture: 8
+CPU part	: 0xd08
+
+processor	: 1
+BogoMIPS	: 108.00
+Features	: fp asimd evtstrm aes pmull sha1 sha2 crc32 cpuid
+CPU implementer	: 0x41
+CPU architecture: 8
+CPU part	: 0xd08
+`,
+		"proc/meminfo": "MemTotal:         3884000 kB\n",
+	}
+
+	for _, tc := range []struct {
+		name     string
+		files    map[string]string
+		flags    []string
+		expected HostCapabilitiesCollector
+	}{
+		{
+			name:  "x86",
+			files: x86,
+			flags: []string{"aes", "AVX2", "avx512f", "neon", "sve"},
+			expected: HostCapabilitiesCollector{
+				CPUVendor: "GenuineIntel", CPUModel: "Intel(R) Xeon(R) Gold 6230 CPU @ 2.10GHz",
+				PhysicalCores: 2, LogicalCores: 4, MaxFrequency: 3900000000,
+				CPUFlags:    map[string]bool{"aes": true, "avx2": true, "avx512f": true, "neon": false, "sve": false},
+				MemoryTotal: 16000000 * 1024,
+				HugePages:   map[int64]int64{2 * 1024 * 1024: 512, 1024 * 1024 * 1024: 0},
+			},
+		},
+		{
+			name:  "arm64 without topology",
+			files: arm64,
+			flags: []string{"aes", "neon", "sve"},
+			expected: HostCapabilitiesCollector{
+				CPUVendor: "ARM", PhysicalCores: 2, LogicalCores: 2,
+				CPUFlags:    map[string]bool{"aes": true, "neon": true, "sve": false},
+				MemoryTotal: 3884000 * 1024,
+				HugePages:   map[int64]int64{},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			root := t.TempDir()
+			writeFixture(t, root, tc.files)
+
+			p := &SystemProvider{BaseProvider: BaseProvider{Logger: zerolog.Nop(), PathRootFs: root}, CPUFlags: tc.flags}
+			c := &HostCapabilitiesCollector{}
+			require.NoError(t, p.ProvideHostCapabilities(context.Background(), c))
+
+			tc.expected.Arch = runtime.GOARCH
+			assert.Equal(t, &tc.expected, c)
+		})
+	}
+}
@@ -0,0 +1,476 @@
+/*
+ICOS Telemetruum Agent
+Copyright © 2022-2024 Engineering Ingegneria Informatica S.p.A.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+This work has received funding from the European Union's HORIZON research
+and innovation programme under grant agreement No. 101070177.
+*/
+
+package modules
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"gopkg.in/yaml.v3"
+)
+
+var locationSourceNames = []string{"file", "gpsd", "nmea", "static"}
+
+var (
+	locationSources = kingpin.Flag("location-sources", "Sources of the location of the host, in priority order: file, gpsd, nmea or static (repeatable)").Default(locationSourceNames...).PlaceHolder("SOURCE").Strings()
+	locationFile    = kingpin.Flag("location-file", "JSON or YAML file with the location of the host, relative to --path-rootfs. The LATITUDE:LONGITUDE format is also accepted").Default("/etc/machine-location").PlaceHolder("FILE").String()
+	locationGPSD    = kingpin.Flag("location-gpsd", "host:port of the gpsd daemon").Default("localhost:2947").PlaceHolder("HOST:PORT").String()
+	locationNMEA    = kingpin.Flag("location-nmea", "Serial device or file streaming NMEA 0183 sentences").PlaceHolder("FILE").String()
+	locationStatic  = kingpin.Flag("location-static", "Location of the host").PlaceHolder("LAT,LON[,ALT[,ACCURACY]]").String()
+	locationGeohash = kingpin.Flag("location-geohash-precision", "Length of the geohash published with the location, 0 to disable it").Default("0").Int()
+)
+
+const (
+	// a GPS receiver sends a fix every second
+	locationTimeout = 3 * time.Second
+
+	maxGeohashPrecision = 12
+	geohashAlphabet     = "0123456789bcdefghjkmnpqrstuvwxyz"
+)
+
+// errLocationNotConfigured is returned by the sources without settings, which are skipped
+var errLocationNotConfigured = errors.New("not configured")
+
+// LocationConfig holds the sources of the location of the host. The first one that knows it is used
+type LocationConfig struct {
+	Sources []string `yaml:"sources"`
+	File    string   `yaml:"file"`
+	GPSD    string   `yaml:"gpsd"`
+	NMEA    string   `yaml:"nmea"`
+	// LAT,LON[,ALT[,ACCURACY]]
+	Static           string `yaml:"static"`
+	GeohashPrecision int    `yaml:"geohash_precision"`
+}
+
+func defaultLocationConfig() LocationConfig {
+	return LocationConfig{
+		Sources:          *locationSources,
+		File:             *locationFile,
+		GPSD:             *locationGPSD,
+		NMEA:             *locationNMEA,
+		Static:           *locationStatic,
+		GeohashPrecision: *locationGeohash,
+	}
+}
+
+func (c LocationConfig) validate() error {
+	var errs []error
+	for i, s := range c.Sources {
+		if !slices.Contains(locationSourceNames, s) {
+			errs = append(errs, fmt.Errorf("sources: unknown source %q", s))
+		} else if slices.Contains(c.Sources[:i], s) {
+			errs = append(errs, fmt.Errorf("sources: duplicate source %q", s))
+		}
+	}
+	if c.GPSD != "" {
+		if _, _, err := net.SplitHostPort(c.GPSD); err != nil {
+			errs = append(errs, fmt.Errorf("gpsd: %w", err))
+		}
+	}
+	if c.Static != "" {
+		if _, err := parseLocation(c.Static); err != nil {
+			errs = append(errs, fmt.Errorf("static: %w", err))
+		}
+	}
+	if c.GeohashPrecision < 0 || c.GeohashPrecision > maxGeohashPrecision {
+		errs = append(errs, fmt.Errorf("geohash_precision: must be between 0 and %d", maxGeohashPrecision))
+	}
+	return errors.Join(errs...)
+}
+
+func (l *Location) validate() error {
+	if math.IsNaN(l.Latitude) || l.Latitude < -90 || l.Latitude > 90 {
+		return fmt.Errorf("invalid latitude %v", l.Latitude)
+	}
+	if math.IsNaN(l.Longitude) || l.Longitude < -180 || l.Longitude > 180 {
+		return fmt.Errorf("invalid longitude %v", l.Longitude)
+	}
+	if l.Accuracy != nil && !(*l.Accuracy >= 0) {
+		return fmt.Errorf("invalid accuracy %v", *l.Accuracy)
+	}
+	return nil
+}
+
+// parseLocation parses LAT,LON[,ALT[,ACCURACY]]
+func parseLocation(s string) (*Location, error) {
+	fields := strings.Split(s, ",")
+	if len(fields) < 2 || len(fields) > 4 {
+		return nil, fmt.Errorf("%q is not LAT,LON[,ALT[,ACCURACY]]", s)
+	}
+	values := make([]float64, len(fields))
+	for i, f := range fields {
+		v, err := strconv.ParseFloat(strings.TrimSpace(f), 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not LAT,LON[,ALT[,ACCURACY]]: %w", s, err)
+		}
+		values[i] = v
+	}
+
+	loc := &Location{Latitude: values[0], Longitude: values[1]}
+	if len(values) > 2 {
+		loc.Altitude = &values[2]
+	}
+	if len(values) > 3 {
+		loc.Accuracy = &values[3]
+	}
+	return loc, loc.validate()
+}
+
+type locationFileContent struct {
+	Latitude  *float64 `yaml:"latitude"`
+	Longitude *float64 `yaml:"longitude"`
+	Altitude  *float64 `yaml:"altitude"`
+	Accuracy  *float64 `yaml:"accuracy"`
+}
+
+// readLocationFile reads a JSON or YAML file with the latitude, longitude, altitude and accuracy keys, or the
+// LATITUDE:LONGITUDE line written by the former versions of the agent
+func readLocationFile(path string) (*Location, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if lat, lon, ok := strings.Cut(strings.TrimSpace(string(content)), ":"); ok {
+		if loc, err := parseLocation(lat + "," + lon); err == nil {
+			return loc, nil
+		}
+	}
+
+	// JSON is also YAML
+	var f locationFileContent
+	if err := yaml.Unmarshal(content, &f); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", path, err)
+	}
+	if f.Latitude == nil || f.Longitude == nil {
+		return nil, fmt.Errorf("%s has no latitude and longitude", path)
+	}
+	loc := &Location{Latitude: *f.Latitude, Longitude: *f.Longitude, Altitude: f.Altitude, Accuracy: f.Accuracy}
+	return loc, loc.validate()
+}
+
+// gpsdReport is a TPV report of gpsd, the only fields read by the agent
+type gpsdReport struct {
+	Class string `json:"class"`
+	// 0 and 1 mean no fix, 2 a 2D fix and 3 a 3D fix
+	Mode   int      `json:"mode"`
+	Lat    *float64 `json:"lat"`
+	Lon    *float64 `json:"lon"`
+	Alt    *float64 `json:"alt"`
+	AltMSL *float64 `json:"altMSL"`
+	Eph    *float64 `json:"eph"`
+	Epx    *float64 `json:"epx"`
+	Epy    *float64 `json:"epy"`
+	// the last reports of all the devices, in the answer to ?POLL
+	TPV []gpsdReport `json:"tpv"`
+}
+
+func (r gpsdReport) location() *Location {
+	if r.Mode < 2 || r.Lat == nil || r.Lon == nil {
+		return nil
+	}
+	loc := &Location{Latitude: *r.Lat, Longitude: *r.Lon}
+	if r.Mode == 3 {
+		// alt is the deprecated name of altMSL
+		loc.Altitude = r.AltMSL
+		if loc.Altitude == nil {
+			loc.Altitude = r.Alt
+		}
+	}
+	if r.Eph != nil {
+		loc.Accuracy = r.Eph
+	} else if r.Epx != nil && r.Epy != nil {
+		loc.Accuracy = ptr(max(*r.Epx, *r.Epy))
+	}
+	if loc.validate() != nil {
+		return nil
+	}
+	return loc
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+// gpsdLocation reads the current fix from gpsd. gpsd only opens the devices when a client watches them, so the
+// answer to ?POLL may be empty and the following reports are read until locationTimeout
+func gpsdLocation(ctx context.Context, address string) (*Location, error) {
+	ctx, cancel := context.WithTimeout(ctx, locationTimeout)
+	defer cancel()
+
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	if err := conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.Write([]byte("?WATCH={\"enable\":true,\"json\":true};?POLL;\n")); err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		var r gpsdReport
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			continue
+		}
+		switch r.Class {
+		case "TPV":
+			if loc := r.location(); loc != nil {
+				return loc, nil
+			}
+		case "POLL":
+			for _, tpv := range r.TPV {
+				if loc := tpv.location(); loc != nil {
+					return loc, nil
+				}
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+		return nil, err
+	}
+	return nil, fmt.Errorf("no fix from %s in %s", address, locationTimeout)
+}
+
+// nmeaFields returns the fields of an NMEA 0183 sentence, without the talker of the first one (e.g. GGA for GPGGA
+// and GNGGA). Sentences with a wrong checksum are discarded
+func nmeaFields(line string) ([]string, bool) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "$") {
+		return nil, false
+	}
+	body, checksum, hasChecksum := strings.Cut(line[1:], "*")
+	if hasChecksum {
+		var sum byte
+		for i := 0; i < len(body); i++ {
+			sum ^= body[i]
+		}
+		if v, err := strconv.ParseUint(checksum, 16, 8); err != nil || byte(v) != sum {
+			return nil, false
+		}
+	}
+	fields := strings.Split(body, ",")
+	if len(fields[0]) != 5 {
+		return nil, false
+	}
+	fields[0] = fields[0][2:]
+	return fields, true
+}
+
+// nmeaCoordinate converts a (d)ddmm.mmmm value and its hemisphere to degrees
+func nmeaCoordinate(value string, hemisphere string) (float64, error) {
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, err
+	}
+	degrees := math.Trunc(v / 100)
+	degrees += (v - degrees*100) / 60
+	if hemisphere == "S" || hemisphere == "W" {
+		degrees = -degrees
+	}
+	return degrees, nil
+}
+
+// parseGGA returns the fix of a GGA sentence, nil if it has none
+func parseGGA(fields []string) *Location {
+	if len(fields) < 10 || fields[6] == "" || fields[6] == "0" {
+		return nil
+	}
+	lat, err := nmeaCoordinate(fields[2], fields[3])
+	if err != nil {
+		return nil
+	}
+	lon, err := nmeaCoordinate(fields[4], fields[5])
+	if err != nil {
+		return nil
+	}
+	loc := &Location{Latitude: lat, Longitude: lon}
+	if alt, err := strconv.ParseFloat(fields[9], 64); err == nil {
+		loc.Altitude = &alt
+	}
+	if loc.validate() != nil {
+		return nil
+	}
+	return loc
+}
+
+// parseGST returns the horizontal error of a GST sentence, the largest of the latitude and longitude ones
+func parseGST(fields []string) *float64 {
+	if len(fields) < 8 {
+		return nil
+	}
+	lat, err := strconv.ParseFloat(fields[6], 64)
+	if err != nil {
+		return nil
+	}
+	lon, err := strconv.ParseFloat(fields[7], 64)
+	if err != nil {
+		return nil
+	}
+	return ptr(max(lat, lon))
+}
+
+// nmeaLocation reads the last fix of a file of NMEA sentences, or the first one sent by a serial device. The
+// error estimated by a GST sentence following the GGA one of the fix is its accuracy
+func nmeaLocation(ctx context.Context, path string) (*Location, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	stream := !fi.Mode().IsRegular()
+	if stream {
+		deadline := time.Now().Add(locationTimeout)
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		if err := f.SetReadDeadline(deadline); err != nil {
+			return nil, err
+		}
+	}
+
+	var fix *Location
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields, ok := nmeaFields(scanner.Text())
+		if !ok {
+			continue
+		}
+		switch fields[0] {
+		case "GGA":
+			// the sentences of the fix end with the next GGA
+			if stream && fix != nil {
+				return fix, nil
+			}
+			if loc := parseGGA(fields); loc != nil {
+				fix = loc
+			}
+		case "GST":
+			if fix != nil {
+				fix.Accuracy = parseGST(fields)
+			}
+		}
+	}
+	if fix != nil {
+		return fix, nil
+	}
+	if err := scanner.Err(); err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+		return nil, err
+	}
+	return nil, fmt.Errorf("no fix in %s", path)
+}
+
+// geohash encodes a location with the given number of characters
+func geohash(lat float64, lon float64, precision int) string {
+	latRange, lonRange := [2]float64{-90, 90}, [2]float64{-180, 180}
+	var b strings.Builder
+	bits, ch := 0, 0
+	for even := true; b.Len() < precision; even = !even {
+		r, v := &lonRange, lon
+		if !even {
+			r, v = &latRange, lat
+		}
+		mid := (r[0] + r[1]) / 2
+		ch <<= 1
+		if v >= mid {
+			ch |= 1
+			r[0] = mid
+		} else {
+			r[1] = mid
+		}
+		if bits++; bits == 5 {
+			b.WriteByte(geohashAlphabet[ch])
+			bits, ch = 0, 0
+		}
+	}
+	return b.String()
+}
+
+// location reads the location of the host from the first source that knows it
+func (p *SystemProvider) location(ctx context.Context) (*Location, error) {
+	var errs []error
+	for _, source := range p.Location.Sources {
+		loc, err := p.locationFrom(ctx, source)
+		if errors.Is(err, errLocationNotConfigured) {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", source, err))
+			continue
+		}
+
+		loc.Source = source
+		if p.Location.GeohashPrecision > 0 {
+			loc.Geohash = geohash(loc.Latitude, loc.Longitude, p.Location.GeohashPrecision)
+		}
+		return loc, nil
+	}
+
+	if len(errs) == 0 {
+		return nil, errors.New("no location source is configured")
+	}
+	return nil, errors.Join(errs...)
+}
+
+func (p *SystemProvider) locationFrom(ctx context.Context, source string) (*Location, error) {
+	switch source {
+	case "file":
+		if p.Location.File == "" {
+			return nil, errLocationNotConfigured
+		}
+		return readLocationFile(filepath.Join(p.PathRootFs, p.Location.File))
+	case "gpsd":
+		if p.Location.GPSD == "" {
+			return nil, errLocationNotConfigured
+		}
+		return gpsdLocation(ctx, p.Location.GPSD)
+	case "nmea":
+		if p.Location.NMEA == "" {
+			return nil, errLocationNotConfigured
+		}
+		return nmeaLocation(ctx, p.Location.NMEA)
+	case "static":
+		if p.Location.Static == "" {
+			return nil, errLocationNotConfigured
+		}
+		return parseLocation(p.Location.Static)
+	}
+	return nil, fmt.Errorf("unknown source")
+}
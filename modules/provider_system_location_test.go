@@ -0,0 +1,212 @@
+/*
+ICOS Telemetruum Agent
+Copyright © 2022-2024 Engineering Ingegneria Informatica S.p.A.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+This work has received funding from the European Union's HORIZON research
+and innovation programme under grant agreement No. 101070177.
+*/
+
+package modules
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startGPSD serves the reports to the first client, after its ?WATCH command. The following ones are refused
+func startGPSD(t *testing.T, reports ...string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		conn, err := l.Accept()
+		l.Close()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprintln(conn, `{"class":"VERSION","release":"3.22","proto_major":3,"proto_minor":14}`)
+		cmd, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil || !strings.HasPrefix(cmd, "?WATCH=") {
+			return
+		}
+		for _, r := range reports {
+			fmt.Fprintln(conn, r)
+		}
+		// gpsd keeps the connection open
+		_, _ = conn.Read(make([]byte, 1))
+	}()
+	return l.Addr().String()
+}
+
+func TestGPSDLocation(t *testing.T) {
+	address := startGPSD(t,
+		`{"class":"DEVICES","devices":[{"class":"DEVICE","path":"/dev/ttyACM0"}]}`,
+		`{"class":"POLL","active":0,"tpv":[],"sky":[]}`,
+		`{"class":"TPV","device":"/dev/ttyACM0","mode":1}`,
+		`{"class":"TPV","device":"/dev/ttyACM0","mode":3,"lat":45.0703,"lon":7.6869,"altHAE":290.1,"altMSL":239.5,"epx":4.2,"epy":6.1}`,
+	)
+	loc, err := gpsdLocation(context.Background(), address)
+	require.NoError(t, err)
+	assert.Equal(t, &Location{Latitude: 45.0703, Longitude: 7.6869, Altitude: ptr(239.5), Accuracy: ptr(6.1)}, loc)
+
+	// the last fix is in the answer to ?POLL when another client is watching
+	address = startGPSD(t, `{"class":"POLL","active":1,"tpv":[{"class":"TPV","mode":2,"lat":-33.86,"lon":151.21,"alt":3,"eph":12.5}]}`)
+	loc, err = gpsdLocation(context.Background(), address)
+	require.NoError(t, err)
+	assert.Equal(t, &Location{Latitude: -33.86, Longitude: 151.21, Accuracy: ptr(12.5)}, loc, "a 2D fix has no altitude")
+
+	address = startGPSD(t, `{"class":"TPV","mode":1}`)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = gpsdLocation(ctx, address)
+	assert.ErrorContains(t, err, "no fix")
+}
+
+// nmea appends the checksum to a sentence
+func nmea(body string) string {
+	var sum byte
+	for i := 0; i < len(body); i++ {
+		sum ^= body[i]
+	}
+	return fmt.Sprintf("$%s*%02X\r\n", body, sum)
+}
+
+func TestNMEALocation(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "gps.log")
+	require.NoError(t, os.WriteFile(file, []byte(
+		"$GPGGA,123519,4807.038,N,01131.000,E,1,08,0.9,545.4,M,46.9,M,,*47\r\n"+
+			nmea("GNRMC,123520,A,4807.040,N,01131.002,E,0.1,0.0,230394,,")+
+			"$GPGGA,123520,4807.040,N,01131.002,E,1,08,0.9,545.6,M,46.9,M,,*00\r\n"+ // wrong checksum
+			nmea("GNGGA,123521,3351.600,S,15112.600,W,2,10,0.8,12.0,M,20.0,M,,")+
+			nmea("GNGST,123521,1.2,2.5,1.5,45.0,1.8,2.4,3.0")+
+			nmea("GNGGA,123522,0000.000,N,00000.000,E,0,00,99.9,,,,,,"), // no fix
+	), 0o644))
+
+	loc, err := nmeaLocation(context.Background(), file)
+	require.NoError(t, err)
+	assert.InDelta(t, -33.86, loc.Latitude, 1e-9)
+	assert.InDelta(t, -151.21, loc.Longitude, 1e-9)
+	assert.Equal(t, ptr(12.0), loc.Altitude)
+	assert.Equal(t, ptr(2.4), loc.Accuracy)
+
+	// a serial device streams the sentences, the first fix is used
+	fifo := filepath.Join(dir, "ttyUSB0")
+	require.NoError(t, syscall.Mkfifo(fifo, 0o644))
+	go func() {
+		f, err := os.OpenFile(fifo, os.O_WRONLY, 0)
+		if err != nil {
+			return
+		}
+		defer f.Close()
+		_, _ = f.WriteString("garbage\n$GPGGA,123519,4807.038,N,01131.000,E,1,08,0.9,545.4,M,46.9,M,,*47\r\n" +
+			nmea("GPGGA,123520,4807.040,N,01131.002,E,1,08,0.9,545.6,M,46.9,M,,"))
+		// the device never ends the stream
+		_, _ = f.Read(make([]byte, 1))
+	}()
+	loc, err = nmeaLocation(context.Background(), fifo)
+	require.NoError(t, err)
+	assert.InDelta(t, 48.1173, loc.Latitude, 1e-9)
+	assert.InDelta(t, 11.516666, loc.Longitude, 1e-6)
+	assert.Equal(t, ptr(545.4), loc.Altitude)
+	assert.Nil(t, loc.Accuracy)
+}
+
+func TestReadLocationFile(t *testing.T) {
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		name    string
+		content string
+		want    *Location
+		err     string
+	}{
+		{"legacy", "45.0703:7.6869\n", &Location{Latitude: 45.0703, Longitude: 7.6869}, ""},
+		{"json", `{"latitude": 45.0703, "longitude": 7.6869, "altitude": 239, "accuracy": 10}`, &Location{Latitude: 45.0703, Longitude: 7.6869, Altitude: ptr(239.0), Accuracy: ptr(10.0)}, ""},
+		{"yaml", "latitude: -33.86\nlongitude: 151.21\n", &Location{Latitude: -33.86, Longitude: 151.21}, ""},
+		{"no colon", "45.0703\n", nil, "error parsing"},
+		{"out of range", "latitude: 95\nlongitude: 7\n", nil, "invalid latitude"},
+		{"empty", "", nil, "has no latitude and longitude"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(dir, tc.name)
+			require.NoError(t, os.WriteFile(path, []byte(tc.content), 0o644))
+			loc, err := readLocationFile(path)
+			if tc.err != "" {
+				assert.ErrorContains(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, loc)
+		})
+	}
+}
+
+func TestHostLocationSources(t *testing.T) {
+	rootFs := t.TempDir()
+	p := &SystemProvider{BaseProvider: BaseProvider{Logger: zerolog.Nop(), PathRootFs: rootFs}, Location: LocationConfig{
+		Sources:          locationSourceNames,
+		File:             "/etc/machine-location",
+		GPSD:             startGPSD(t, `{"class":"TPV","mode":2,"lat":57.64911,"lon":10.40744}`),
+		Static:           "45.0703,7.6869,239,100",
+		GeohashPrecision: 11,
+	}}
+	require.NoError(t, p.Location.validate())
+
+	// the file is missing, gpsd has a fix
+	hic := &HostInfoCollector{}
+	require.NoError(t, p.ProvideHostInfo(context.Background(), hic))
+	assert.Equal(t, &Location{Latitude: 57.64911, Longitude: 10.40744, Source: "gpsd", Geohash: "u4pruydqqvj"}, hic.Location)
+	latitude, longitude := hic.Location.labels()
+	assert.Equal(t, "57.64911", latitude)
+	assert.Equal(t, "10.40744", longitude)
+
+	// gpsd is not reachable any more, the static location is the last resort
+	p.Location.GeohashPrecision = 0
+	loc, err := p.location(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, &Location{Latitude: 45.0703, Longitude: 7.6869, Altitude: ptr(239.0), Accuracy: ptr(100.0), Source: "static"}, loc)
+
+	require.NoError(t, os.MkdirAll(filepath.Join(rootFs, "etc"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(rootFs, "etc/machine-location"), []byte("44.4949:11.3426\n"), 0o644))
+	loc, err = p.location(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "file", loc.Source)
+
+	p.Location.Sources = []string{"nmea"}
+	_, err = p.location(context.Background())
+	assert.EqualError(t, err, "no location source is configured")
+}
+
+func TestLocationConfigValidate(t *testing.T) {
+	assert.NoError(t, LocationConfig{Sources: []string{"static"}, Static: "45,7"}.validate())
+	err := LocationConfig{Sources: []string{"gps", "file", "file"}, GPSD: "localhost", Static: "45", GeohashPrecision: 13}.validate()
+	for _, msg := range []string{`unknown source "gps"`, `duplicate source "file"`, "gpsd:", "static:", "geohash_precision:"} {
+		assert.ErrorContains(t, err, msg)
+	}
+}
@@ -0,0 +1,255 @@
+/*
+ICOS Telemetruum Agent
+Copyright © 2022-2024 Engineering Ingegneria Informatica S.p.A.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+This work has received funding from the European Union's HORIZON research
+and innovation programme under grant agreement No. 101070177.
+*/
+
+package modules
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/procfs"
+	"github.com/prometheus/procfs/sysfs"
+)
+
+var (
+	hostIPInterface = kingpin.Flag("host-ip-interface", "Network interface whose address is published as the host ip. By default the interface of the default route is used").PlaceHolder("NAME").String()
+	hostIPCIDR      = kingpin.Flag("host-ip-cidr", "Publish as the host ip the first address of the host in this network").PlaceHolder("CIDR").String()
+	// deprecated, the host ip is no longer found by dialing out
+	ipHint = kingpin.Flag("ip-hint", "Deprecated and ignored, use --host-ip-interface or --host-ip-cidr").Hidden().PlaceHolder("IP:PORT").String()
+)
+
+// HostIPConfig selects the address published by tlum_host_info. When both are set, the address must be on the
+// interface and in the network
+type HostIPConfig struct {
+	Interface string `yaml:"interface"`
+	CIDR      string `yaml:"cidr"`
+}
+
+func defaultHostIPConfig() HostIPConfig {
+	return HostIPConfig{Interface: *hostIPInterface, CIDR: *hostIPCIDR}
+}
+
+func (c HostIPConfig) validate() error {
+	if c.CIDR != "" {
+		if _, _, err := net.ParseCIDR(c.CIDR); err != nil {
+			return fmt.Errorf("cidr: %w", err)
+		}
+	}
+	return nil
+}
+
+// interfaceAddrs is replaced in the tests
+var interfaceAddrs = func(name string) ([]string, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	cidrs := make([]string, 0, len(addrs))
+	for _, a := range addrs {
+		cidrs = append(cidrs, a.String())
+	}
+	return cidrs, nil
+}
+
+// selfNetNamespace is replaced in the tests
+var selfNetNamespace = "/proc/self/ns/net"
+
+// inHostNetNamespace tells whether the agent shares the network namespace of the host, whose interfaces are
+// read from sysfs. The addresses are read from the namespace of the agent
+func (p *SystemProvider) inHostNetNamespace() (bool, error) {
+	host, err := os.Readlink(filepath.Join(p.PathRootFs, "proc/1/ns/net"))
+	if err != nil {
+		return false, err
+	}
+	self, err := os.Readlink(selfNetNamespace)
+	if err != nil {
+		return false, err
+	}
+	return host == self, nil
+}
+
+func addressFamily(cidr string) string {
+	ip, _, err := net.ParseCIDR(cidr)
+	if err == nil && ip.To4() == nil {
+		return "ipv6"
+	}
+	return "ipv4"
+}
+
+// readInterfaces lists the network interfaces from sysfs, with their addresses and counters
+func (p *SystemProvider) readInterfaces() ([]*NetworkInterface, error) {
+	sfs, err := sysfs.NewFS(filepath.Join(p.PathRootFs, "sys"))
+	if err != nil {
+		return nil, err
+	}
+	class, err := sfs.NetClass()
+	if err != nil {
+		return nil, fmt.Errorf("error reading the network interfaces: %w", err)
+	}
+
+	pfs, err := procfs.NewFS(filepath.Join(p.PathRootFs, "proc"))
+	if err != nil {
+		return nil, err
+	}
+	dev, err := pfs.NetDev()
+	if err != nil {
+		return nil, fmt.Errorf("error reading the network counters: %w", err)
+	}
+
+	hostNetwork, err := p.inHostNetNamespace()
+	if err != nil {
+		// e.g. without the permission to read the namespace of the host init
+		p.Logger.Debug().Msgf("Cannot compare the network namespaces of the agent and of the host: %s", err)
+		hostNetwork = true
+	} else if !hostNetwork {
+		p.netnsWarning.Do(func() {
+			p.Logger.Warn().Msg("The agent is not in the network namespace of the host (hostNetwork), the addresses of the host interfaces are not reported")
+		})
+	}
+
+	interfaces := make([]*NetworkInterface, 0, len(class))
+	for _, name := range sortedKeys(class) {
+		c := class[name]
+		i := &NetworkInterface{Name: name, MAC: c.Address, OperState: c.OperState}
+		if c.MTU != nil {
+			i.MTU = *c.MTU
+		}
+		// sysfs reports Mbit/s, and -1 when the link is down
+		if c.Speed != nil && *c.Speed > 0 {
+			i.Speed = int64Ptr(*c.Speed * 1000 * 1000 / 8)
+		}
+
+		// outside of the host namespace the same names, e.g. eth0, are the interfaces of the agent
+		if hostNetwork {
+			if addrs, err := interfaceAddrs(name); err != nil {
+				p.Logger.Debug().Msgf("Cannot read the addresses of %s: %s", name, err)
+			} else {
+				i.Addresses = addrs
+			}
+		}
+
+		if d, ok := dev[name]; ok {
+			i.ReceiveBytes, i.TransmitBytes = int64(d.RxBytes), int64(d.TxBytes)
+			i.ReceivePackets, i.TransmitPackets = int64(d.RxPackets), int64(d.TxPackets)
+			i.ReceiveErrors, i.TransmitErrors = int64(d.RxErrors), int64(d.TxErrors)
+			i.ReceiveDropped, i.TransmitDropped = int64(d.RxDropped), int64(d.TxDropped)
+		}
+		interfaces = append(interfaces, i)
+	}
+	return interfaces, nil
+}
+
+// defaultRouteInterface returns the interface of the IPv4 default route with the lowest metric
+func (p *SystemProvider) defaultRouteInterface() (string, error) {
+	pfs, err := procfs.NewFS(filepath.Join(p.PathRootFs, "proc"))
+	if err != nil {
+		return "", err
+	}
+	routes, err := pfs.NetRoute()
+	if err != nil {
+		return "", fmt.Errorf("error reading the routing table: %w", err)
+	}
+
+	var defaults []procfs.NetRouteLine
+	for _, r := range routes {
+		if r.Destination == 0 && r.Mask == 0 && r.Iface != "blackhole" {
+			defaults = append(defaults, r)
+		}
+	}
+	if len(defaults) == 0 {
+		return "", errors.New("there is no default route")
+	}
+	sort.SliceStable(defaults, func(i, j int) bool { return defaults[i].Metric < defaults[j].Metric })
+	return defaults[0].Iface, nil
+}
+
+// preferredAddress picks an IPv4 address before an IPv6 one, skipping the loopback and link-local addresses.
+// If network is not nil the address must belong to it
+func preferredAddress(addrs []string, network *net.IPNet) net.IP {
+	var candidate net.IP
+	for _, a := range addrs {
+		ip, _, err := net.ParseCIDR(a)
+		if err != nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() || (network != nil && !network.Contains(ip)) {
+			continue
+		}
+		if ip.To4() != nil {
+			return ip
+		}
+		if candidate == nil {
+			candidate = ip
+		}
+	}
+	return candidate
+}
+
+// selectHostIP chooses the address published as the host ip according to the HostIPConfig
+func (p *SystemProvider) selectHostIP(interfaces []*NetworkInterface) (net.IP, error) {
+	var network *net.IPNet
+	if p.HostIP.CIDR != "" {
+		_, network, _ = net.ParseCIDR(p.HostIP.CIDR)
+	}
+
+	name := p.HostIP.Interface
+	if name == "" && network != nil {
+		for _, i := range interfaces {
+			if ip := preferredAddress(i.Addresses, network); ip != nil {
+				return ip, nil
+			}
+		}
+		return nil, fmt.Errorf("no address in %s", network)
+	}
+	if name == "" {
+		var err error
+		if name, err = p.defaultRouteInterface(); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, i := range interfaces {
+		if i.Name != name {
+			continue
+		}
+		if ip := preferredAddress(i.Addresses, network); ip != nil {
+			return ip, nil
+		}
+		return nil, fmt.Errorf("interface %s has no usable address", name)
+	}
+	return nil, fmt.Errorf("interface %s not found", name)
+}
+
+// ProvideHostNetwork reports the network interfaces of the host and their traffic
+func (p *SystemProvider) ProvideHostNetwork(ctx context.Context, c *HostNetworkCollector) error {
+	interfaces, err := p.readInterfaces()
+	if err != nil {
+		return err
+	}
+	c.Interfaces = interfaces
+	return nil
+}
@@ -0,0 +1,159 @@
+/*
+ICOS Telemetruum Agent
+Copyright © 2022-2024 Engineering Ingegneria Informatica S.p.A.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+This work has received funding from the European Union's HORIZON research
+and innovation programme under grant agreement No. 101070177.
+*/
+
+package modules
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeNetworkFixture(t *testing.T, route string) string {
+	root := t.TempDir()
+	writeFixture(t, root, map[string]string{
+		"sys/class/net/eth0/address":    "52:54:00:12:34:56\n",
+		"sys/class/net/eth0/mtu":        "1500\n",
+		"sys/class/net/eth0/operstate":  "up\n",
+		"sys/class/net/eth0/speed":      "1000\n",
+		"sys/class/net/wlan0/address":   "52:54:00:ab:cd:ef\n",
+		"sys/class/net/wlan0/mtu":       "1500\n",
+		"sys/class/net/wlan0/operstate": "down\n",
+		"sys/class/net/wlan0/speed":     "-1\n",
+		"sys/class/net/lo/address":      "00:00:00:00:00:00\n",
+		"sys/class/net/lo/mtu":          "65536\n",
+		"sys/class/net/lo/operstate":    "unknown\n",
+		"proc/net/dev": `Inter-|   Receive                                                |  Transmit
+ face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed
+    lo:    1000      10    0    0    0     0          0         0     1000      10    0    0    0     0       0          0
+  eth0: 5000000    4000    2    3    0     0          0         0   600000    3000    1    4    0     0       0          0
+`,
+		"proc/net/route": "Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\t\tMTU\tWindow\tIRTT\n" + route,
+	})
+	return root
+}
+
+func TestProvideHostNetwork(t *testing.T) {
+	defer func(f func(string) ([]string, error)) { interfaceAddrs = f }(interfaceAddrs)
+	interfaceAddrs = func(name string) ([]string, error) {
+		switch name {
+		case "lo":
+			return []string{"127.0.0.1/8", "::1/128"}, nil
+		case "eth0":
+			return []string{"fe80::5054:ff:fe12:3456/64", "2001:db8::10/64", "192.168.1.10/24"}, nil
+		case "wlan0":
+			return []string{"10.0.0.5/8"}, nil
+		}
+		return nil, fmt.Errorf("no interface %s", name)
+	}
+
+	root := writeNetworkFixture(t, "")
+	p := &SystemProvider{BaseProvider: BaseProvider{Logger: zerolog.Nop(), PathRootFs: root}}
+	c := &HostNetworkCollector{}
+	require.NoError(t, p.ProvideHostNetwork(context.Background(), c))
+
+	require.Len(t, c.Interfaces, 3)
+	eth0 := c.Interfaces[0]
+	assert.Equal(t, &NetworkInterface{
+		Name: "eth0", MAC: "52:54:00:12:34:56", MTU: 1500, OperState: "up", Speed: int64Ptr(125000000),
+		Addresses:    []string{"fe80::5054:ff:fe12:3456/64", "2001:db8::10/64", "192.168.1.10/24"},
+		ReceiveBytes: 5000000, TransmitBytes: 600000, ReceivePackets: 4000, TransmitPackets: 3000,
+		ReceiveErrors: 2, TransmitErrors: 1, ReceiveDropped: 3, TransmitDropped: 4,
+	}, eth0)
+	assert.Equal(t, "lo", c.Interfaces[1].Name)
+	assert.Nil(t, c.Interfaces[1].Speed, "virtual interfaces have no speed")
+	assert.Nil(t, c.Interfaces[2].Speed, "the speed of a link down is unknown")
+	assert.Equal(t, int64(0), c.Interfaces[2].ReceiveBytes)
+
+	// the addresses are read only in the network namespace of the host
+	self := filepath.Join(t.TempDir(), "net")
+	require.NoError(t, os.Symlink("net:[4026531840]", self))
+	defer func(path string) { selfNetNamespace = path }(selfNetNamespace)
+	selfNetNamespace = self
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "proc/1/ns"), 0o755))
+	require.NoError(t, os.Symlink("net:[4026531840]", filepath.Join(root, "proc/1/ns/net")))
+
+	c = &HostNetworkCollector{}
+	require.NoError(t, p.ProvideHostNetwork(context.Background(), c))
+	assert.NotEmpty(t, c.Interfaces[0].Addresses)
+
+	require.NoError(t, os.Remove(self))
+	require.NoError(t, os.Symlink("net:[4026532201]", self))
+	c = &HostNetworkCollector{}
+	require.NoError(t, p.ProvideHostNetwork(context.Background(), c))
+	require.Len(t, c.Interfaces, 3)
+	assert.Empty(t, c.Interfaces[0].Addresses)
+	assert.Equal(t, int64(5000000), c.Interfaces[0].ReceiveBytes)
+}
+
+func TestSelectHostIP(t *testing.T) {
+	interfaces := []*NetworkInterface{
+		{Name: "eth0", Addresses: []string{"fe80::5054:ff:fe12:3456/64", "2001:db8::10/64", "192.168.1.10/24"}},
+		{Name: "lo", Addresses: []string{"127.0.0.1/8", "::1/128"}},
+		{Name: "wg0", Addresses: []string{"fd00::2/64"}},
+		{Name: "wlan0", Addresses: []string{"10.0.0.5/8"}},
+	}
+	// default routes via wlan0 (metric 600) and eth0 (metric 100)
+	routes := "wlan0\t00000000\t0100000A\t0003\t0\t0\t600\t00000000\t0\t0\t0\n" +
+		"eth0\t00000000\t0101A8C0\t0003\t0\t0\t100\t00000000\t0\t0\t0\n" +
+		"eth0\t0001A8C0\t00000000\t0001\t0\t0\t100\t00FFFFFF\t0\t0\t0\n"
+
+	for _, tc := range []struct {
+		name   string
+		config HostIPConfig
+		routes string
+		ip     string
+		err    string
+	}{
+		{name: "default route", routes: routes, ip: "192.168.1.10"},
+		{name: "no default route", err: "no default route"},
+		{name: "interface", config: HostIPConfig{Interface: "wlan0"}, routes: routes, ip: "10.0.0.5"},
+		{name: "ipv6 only interface", config: HostIPConfig{Interface: "wg0"}, ip: "fd00::2"},
+		{name: "loopback only interface", config: HostIPConfig{Interface: "lo"}, err: "no usable address"},
+		{name: "unknown interface", config: HostIPConfig{Interface: "eth9"}, err: "not found"},
+		{name: "cidr", config: HostIPConfig{CIDR: "10.0.0.0/8"}, ip: "10.0.0.5"},
+		{name: "ipv6 cidr", config: HostIPConfig{CIDR: "2001:db8::/32"}, ip: "2001:db8::10"},
+		{name: "cidr without addresses", config: HostIPConfig{CIDR: "172.16.0.0/12"}, err: "no address in 172.16.0.0/12"},
+		{name: "interface and cidr", config: HostIPConfig{Interface: "eth0", CIDR: "2001:db8::/32"}, ip: "2001:db8::10"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &SystemProvider{BaseProvider: BaseProvider{Logger: zerolog.Nop(), PathRootFs: writeNetworkFixture(t, tc.routes)}, HostIP: tc.config}
+			ip, err := p.selectHostIP(interfaces)
+			if tc.err != "" {
+				assert.ErrorContains(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.ip, ip.String())
+		})
+	}
+}
+
+func TestHostIPConfigValidate(t *testing.T) {
+	assert.NoError(t, HostIPConfig{}.validate())
+	assert.NoError(t, HostIPConfig{Interface: "eth0", CIDR: "10.0.0.0/8"}.validate())
+	assert.ErrorContains(t, HostIPConfig{CIDR: "10.0.0.0"}.validate(), "cidr")
+}
@@ -0,0 +1,199 @@
+/*
+ICOS Telemetruum Agent
+Copyright © 2022-2024 Engineering Ingegneria Informatica S.p.A.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+This work has received funding from the European Union's HORIZON research
+and innovation programme under grant agreement No. 101070177.
+*/
+
+package modules
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// pciIDsPaths are the locations of the PCI ID database in the common distributions
+var pciIDsPaths = []string{"usr/share/hwdata/pci.ids", "usr/share/misc/pci.ids", "usr/share/pci.ids"}
+
+// pciVendors names the vendors of the accelerators when the host has no PCI ID database
+var pciVendors = map[string]string{
+	"1002": "Advanced Micro Devices, Inc. [AMD/ATI]",
+	"1022": "Advanced Micro Devices, Inc. [AMD]",
+	"10de": "NVIDIA Corporation",
+	"10ee": "Xilinx Corporation",
+	"1172": "Altera Corporation",
+	"14e4": "Broadcom Inc. and subsidiaries",
+	"15b3": "Mellanox Technologies",
+	"1ac1": "Global Unichip Corp.",
+	"1af4": "Red Hat, Inc.",
+	"1d0f": "Amazon.com, Inc.",
+	"1da3": "Habana Labs Ltd.",
+	"1e60": "Hailo Technologies Ltd.",
+	"19e5": "Huawei Technologies Co., Ltd.",
+	"8086": "Intel Corporation",
+}
+
+var (
+	// FPGA boards don't have a class of their own
+	fpgaVendors = map[string]bool{"10ee": true, "1172": true}
+	// vendors of neural network accelerators that don't use the processing accelerator class, e.g. Coral
+	npuVendors = map[string]bool{"1ac1": true, "1da3": true, "1e60": true}
+)
+
+// acceleratorType classifies a PCI device from its class code and vendor, it is empty for the other devices
+func acceleratorType(class uint32, vendorID string) string {
+	base, sub := class>>16, (class>>8)&0xff
+	switch {
+	case base == 0x06:
+		// bridges
+		return ""
+	case fpgaVendors[vendorID] && (base == 0x05 || base == 0x0b || base == 0x11 || base == 0x12 || base == 0xff):
+		return "fpga"
+	case npuVendors[vendorID] && base != 0x02:
+		return "npu"
+	case base == 0x03:
+		return "gpu"
+	case base == 0x12, base == 0x0b && sub == 0x40:
+		// processing accelerators and co-processors
+		return "npu"
+	case base == 0x02:
+		return "nic"
+	}
+	return ""
+}
+
+// readPCIIDs looks up the names of the given vendors and devices, keyed by vendor and vendor:device, in the PCI ID
+// database of the host
+func (p *SystemProvider) readPCIIDs(accelerators []*Accelerator) (vendors map[string]string, devices map[string]string) {
+	vendors, devices = map[string]string{}, map[string]string{}
+	wanted := map[string]bool{}
+	for _, a := range accelerators {
+		wanted[a.VendorID] = true
+	}
+
+	for _, path := range pciIDsPaths {
+		f, err := os.Open(filepath.Join(p.PathRootFs, path))
+		if err != nil {
+			continue
+		}
+		defer f.Close()
+
+		vendor := ""
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			line := s.Text()
+			switch {
+			case line == "" || line[0] == '#' || strings.HasPrefix(line, "\t\t"):
+			case strings.HasPrefix(line, "C "):
+				// the device classes follow the vendors
+				return vendors, devices
+			case line[0] == '\t':
+				if id, name, ok := strings.Cut(line[1:], "  "); ok && wanted[vendor] {
+					devices[vendor+":"+id] = name
+				}
+			default:
+				id, name, _ := strings.Cut(line, "  ")
+				vendor = id
+				if wanted[id] {
+					vendors[id] = name
+				}
+			}
+		}
+		return vendors, devices
+	}
+	return vendors, devices
+}
+
+// readSysfsID reads a PCI attribute like 0x10de, returning it without the prefix
+func readSysfsID(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimPrefix(strings.TrimSpace(string(content)), "0x"), nil
+}
+
+// ProvideHostAccelerators lists the GPUs, NPUs, FPGAs and NICs in /sys/bus/pci/devices
+func (p *SystemProvider) ProvideHostAccelerators(ctx context.Context, c *HostAcceleratorsCollector) error {
+	devices, err := filepath.Glob(filepath.Join(p.PathRootFs, "sys/bus/pci/devices/*"))
+	if err != nil {
+		return err
+	}
+	if len(devices) == 0 {
+		// hosts without a PCI bus, like many ARM boards, have no accelerators
+		if _, err := os.Stat(filepath.Join(p.PathRootFs, "sys/bus")); err != nil {
+			return fmt.Errorf("error reading the PCI devices: %w", err)
+		}
+	}
+
+	accelerators := []*Accelerator{}
+	for _, dev := range devices {
+		classID, err := readSysfsID(filepath.Join(dev, "class"))
+		if err != nil {
+			p.Logger.Debug().Msgf("Skipping PCI device %s: %s", dev, err)
+			continue
+		}
+		class, err := strconv.ParseUint(classID, 16, 32)
+		if err != nil {
+			p.Logger.Debug().Msgf("Skipping PCI device %s: invalid class %q", dev, classID)
+			continue
+		}
+		vendorID, err1 := readSysfsID(filepath.Join(dev, "vendor"))
+		deviceID, err2 := readSysfsID(filepath.Join(dev, "device"))
+		if err1 != nil || err2 != nil {
+			p.Logger.Debug().Msgf("Skipping PCI device %s: no vendor or device id", dev)
+			continue
+		}
+
+		typ := acceleratorType(uint32(class), vendorID)
+		if typ == "" {
+			continue
+		}
+		a := &Accelerator{
+			Address:  filepath.Base(dev),
+			Type:     typ,
+			Class:    fmt.Sprintf("0x%06x", class),
+			VendorID: vendorID,
+			DeviceID: deviceID,
+			NUMANode: -1,
+		}
+		if driver, err := os.Readlink(filepath.Join(dev, "driver")); err == nil {
+			a.Driver = filepath.Base(driver)
+		}
+		if node, err := readInt(filepath.Join(dev, "numa_node")); err == nil {
+			a.NUMANode = node
+		}
+		accelerators = append(accelerators, a)
+	}
+
+	vendors, names := p.readPCIIDs(accelerators)
+	for _, a := range accelerators {
+		a.Vendor, a.Device = vendors[a.VendorID], names[a.VendorID+":"+a.DeviceID]
+		if a.Vendor == "" {
+			a.Vendor = pciVendors[a.VendorID]
+		}
+	}
+	sort.Slice(accelerators, func(i, j int) bool { return accelerators[i].Address < accelerators[j].Address })
+
+	c.Accelerators = accelerators
+	return nil
+}
@@ -0,0 +1,94 @@
+/*
+ICOS Telemetruum Agent
+Copyright © 2022-2024 Engineering Ingegneria Informatica S.p.A.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+This work has received funding from the European Union's HORIZON research
+and innovation programme under grant agreement No. 101070177.
+*/
+
+package modules
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writePCIDevice adds a device to a fake /sys/bus/pci/devices, bound to driver if not empty
+func writePCIDevice(t *testing.T, root, address, class, vendor, device, driver, numaNode string) {
+	dir := filepath.Join("sys/bus/pci/devices", address)
+	writeFixture(t, root, map[string]string{
+		filepath.Join(dir, "class"):     class + "\n",
+		filepath.Join(dir, "vendor"):    vendor + "\n",
+		filepath.Join(dir, "device"):    device + "\n",
+		filepath.Join(dir, "numa_node"): numaNode + "\n",
+	})
+	if driver != "" {
+		require.NoError(t, os.MkdirAll(filepath.Join(root, "sys/bus/pci/drivers", driver), 0o755))
+		require.NoError(t, os.Symlink(filepath.Join("../../drivers", driver), filepath.Join(root, dir, "driver")))
+	}
+}
+
+func TestProvideHostAccelerators(t *testing.T) {
+	root := t.TempDir()
+	writePCIDevice(t, root, "0000:00:00.0", "0x060000", "0x8086", "0x3e0f", "", "-1")
+	writePCIDevice(t, root, "0000:00:02.0", "0x030000", "0x8086", "0x3e92", "i915", "-1")
+	writePCIDevice(t, root, "0000:00:14.0", "0x0c0330", "0x8086", "0xa36d", "xhci_hcd", "-1")
+	writePCIDevice(t, root, "0000:3b:00.0", "0x030200", "0x10de", "0x1eb8", "nvidia", "0")
+	writePCIDevice(t, root, "0000:5e:00.0", "0x020000", "0x15b3", "0x1017", "mlx5_core", "0")
+	writePCIDevice(t, root, "0000:af:00.0", "0x120000", "0x1e60", "0x2864", "", "1")
+	writePCIDevice(t, root, "0000:d8:00.0", "0x058000", "0x10ee", "0x5000", "xclmgmt", "1")
+	writePCIDevice(t, root, "0001:01:00.0", "0x088000", "0x1ac1", "0x089a", "apex", "-1")
+	writeFixture(t, root, map[string]string{
+		"usr/share/misc/pci.ids": `# PCI ID database
+10de  NVIDIA Corporation
+	1eb8  TU104GL [Tesla T4]
+		10de 12a2  T4 16GB
+15b3  Mellanox Technologies
+	1017  MT27800 Family [ConnectX-5]
+C 03  Display controller
+	00  VGA compatible controller
+`,
+	})
+
+	p := &SystemProvider{BaseProvider: BaseProvider{Logger: zerolog.Nop(), PathRootFs: root}}
+	c := &HostAcceleratorsCollector{}
+	require.NoError(t, p.ProvideHostAccelerators(context.Background(), c))
+
+	assert.Equal(t, []*Accelerator{
+		{Address: "0000:00:02.0", Type: "gpu", Class: "0x030000", VendorID: "8086", DeviceID: "3e92", Vendor: "Intel Corporation", Driver: "i915", NUMANode: -1},
+		{Address: "0000:3b:00.0", Type: "gpu", Class: "0x030200", VendorID: "10de", DeviceID: "1eb8", Vendor: "NVIDIA Corporation", Device: "TU104GL [Tesla T4]", Driver: "nvidia", NUMANode: 0},
+		{Address: "0000:5e:00.0", Type: "nic", Class: "0x020000", VendorID: "15b3", DeviceID: "1017", Vendor: "Mellanox Technologies", Device: "MT27800 Family [ConnectX-5]", Driver: "mlx5_core", NUMANode: 0},
+		{Address: "0000:af:00.0", Type: "npu", Class: "0x120000", VendorID: "1e60", DeviceID: "2864", Vendor: "Hailo Technologies Ltd.", NUMANode: 1},
+		{Address: "0000:d8:00.0", Type: "fpga", Class: "0x058000", VendorID: "10ee", DeviceID: "5000", Vendor: "Xilinx Corporation", Driver: "xclmgmt", NUMANode: 1},
+		{Address: "0001:01:00.0", Type: "npu", Class: "0x088000", VendorID: "1ac1", DeviceID: "089a", Vendor: "Global Unichip Corp.", Driver: "apex", NUMANode: -1},
+	}, c.Accelerators)
+
+	// a host without PCI bus, like many ARM boards
+	p.PathRootFs = t.TempDir()
+	writeFixture(t, p.PathRootFs, map[string]string{"sys/bus/platform/devices/.keep": ""})
+	c = &HostAcceleratorsCollector{}
+	require.NoError(t, p.ProvideHostAccelerators(context.Background(), c))
+	assert.Empty(t, c.Accelerators)
+
+	// sysfs is not mounted
+	p.PathRootFs = t.TempDir()
+	assert.Error(t, p.ProvideHostAccelerators(context.Background(), &HostAcceleratorsCollector{}))
+}
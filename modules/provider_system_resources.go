@@ -0,0 +1,113 @@
+/*
+ICOS Telemetruum Agent
+Copyright © 2022-2024 Engineering Ingegneria Informatica S.p.A.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+This work has received funding from the European Union's HORIZON research
+and innovation programme under grant agreement No. 101070177.
+*/
+
+package modules
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/procfs"
+)
+
+// procFS returns the proc filesystem of the host, mounted under the root fs
+func (p *SystemProvider) procFS() (procfs.FS, error) {
+	return procfs.NewFS(filepath.Join(p.PathRootFs, "proc"))
+}
+
+// kibibytes converts an optional meminfo value, in kB, to bytes
+func kibibytes(v *uint64) int64 {
+	if v == nil {
+		return 0
+	}
+	return int64(*v) * 1024
+}
+
+// ProvideHostResources reads the CPU, memory, load and process counters of the host from /proc
+func (p *SystemProvider) ProvideHostResources(ctx context.Context, c *HostResourcesCollector) error {
+	fs, err := p.procFS()
+	if err != nil {
+		return err
+	}
+
+	stat, err := fs.Stat()
+	if err != nil {
+		return fmt.Errorf("error reading the cpu stats: %w", err)
+	}
+	cpu := stat.CPUTotal
+	c.CPUTime = CPUTimes{
+		User:      cpu.User,
+		Nice:      cpu.Nice,
+		System:    cpu.System,
+		Idle:      cpu.Idle,
+		Iowait:    cpu.Iowait,
+		Interrupt: cpu.IRQ,
+		SoftIRQ:   cpu.SoftIRQ,
+		Steal:     cpu.Steal,
+	}
+	c.LogicalCPUs = int64(len(stat.CPU))
+	c.ContextSwitches = int64(stat.ContextSwitches)
+	c.ProcessesCreated = int64(stat.ProcessCreated)
+	c.ProcessesRunning = int64(stat.ProcessesRunning)
+	c.ProcessesBlocked = int64(stat.ProcessesBlocked)
+
+	load, err := fs.LoadAvg()
+	if err != nil {
+		return fmt.Errorf("error reading the load average: %w", err)
+	}
+	c.Load1, c.Load5, c.Load15 = load.Load1, load.Load5, load.Load15
+
+	mem, err := fs.Meminfo()
+	if err != nil {
+		return fmt.Errorf("error reading the memory info: %w", err)
+	}
+	c.MemoryTotal = kibibytes(mem.MemTotal)
+	c.MemoryFree = kibibytes(mem.MemFree)
+	c.MemoryBuffers = kibibytes(mem.Buffers)
+	// as free(1), the reclaimable slab is part of the cache
+	c.MemoryCached = kibibytes(mem.Cached) + kibibytes(mem.SReclaimable)
+	c.MemoryUsed = max(c.MemoryTotal-c.MemoryFree-c.MemoryBuffers-c.MemoryCached, 0)
+	c.MemoryAvailable = kibibytes(mem.MemAvailable)
+	if mem.MemAvailable == nil {
+		// kernels older than 3.14
+		c.MemoryAvailable = c.MemoryFree + c.MemoryBuffers + c.MemoryCached
+	}
+	c.SwapFree = kibibytes(mem.SwapFree)
+	c.SwapUsed = max(kibibytes(mem.SwapTotal)-c.SwapFree, 0)
+
+	uptime, err := os.ReadFile(filepath.Join(p.PathRootFs, "proc", "uptime"))
+	if err != nil {
+		return fmt.Errorf("error reading the uptime: %w", err)
+	}
+	fields := strings.Fields(string(uptime))
+	if len(fields) == 0 {
+		return fmt.Errorf("error parsing the uptime %q", uptime)
+	}
+	if c.UptimeSeconds, err = strconv.ParseFloat(fields[0], 64); err != nil {
+		return fmt.Errorf("error parsing the uptime: %w", err)
+	}
+
+	c.Collected = true
+	return nil
+}
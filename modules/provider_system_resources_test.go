@@ -0,0 +1,98 @@
+/*
+ICOS Telemetruum Agent
+Copyright © 2022-2024 Engineering Ingegneria Informatica S.p.A.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+This work has received funding from the European Union's HORIZON research
+and innovation programme under grant agreement No. 101070177.
+*/
+
+package modules
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeFixture creates the given files, relative to root
+func writeFixture(t *testing.T, root string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	}
+}
+
+func TestProvideHostResources(t *testing.T) {
+	root := t.TempDir()
+	writeFixture(t, root, map[string]string{
+		"proc/stat": `cpu  1000 20 300 5000 40 5 6 7 0 0
+cpu0 500 10 150 2500 20 3 3 4 0 0
+cpu1 500 10 150 2500 20 2 3 3 0 0
+intr 12345 0 0
+ctxt 987654
+btime 1700000000
+processes 4321
+procs_running 3
+procs_blocked 1
+softirq 100 1 2 3 4 5 6 7 8 9 10
+`,
+		"proc/loadavg": "0.50 0.25 0.10 3/250 4321\n",
+		"proc/meminfo": `MemTotal:        8000000 kB
+MemFree:         1000000 kB
+MemAvailable:    5000000 kB
+Buffers:          200000 kB
+Cached:          2500000 kB
+SReclaimable:     300000 kB
+SwapTotal:       2000000 kB
+SwapFree:        1500000 kB
+`,
+		"proc/uptime": "3600.25 7000.00\n",
+	})
+
+	p := &SystemProvider{BaseProvider: BaseProvider{Logger: zerolog.Nop(), PathRootFs: root}}
+	c := &HostResourcesCollector{}
+	require.NoError(t, p.ProvideHostResources(context.Background(), c))
+
+	// USER_HZ is 100
+	assert.Equal(t, CPUTimes{User: 10, Nice: 0.2, System: 3, Idle: 50, Iowait: 0.4, Interrupt: 0.05, SoftIRQ: 0.06, Steal: 0.07}, c.CPUTime)
+	assert.Equal(t, int64(2), c.LogicalCPUs)
+	assert.Equal(t, []float64{0.5, 0.25, 0.1}, []float64{c.Load1, c.Load5, c.Load15})
+
+	assert.Equal(t, int64(8000000*1024), c.MemoryTotal)
+	assert.Equal(t, int64(5000000*1024), c.MemoryAvailable)
+	assert.Equal(t, int64(1000000*1024), c.MemoryFree)
+	assert.Equal(t, int64(200000*1024), c.MemoryBuffers)
+	assert.Equal(t, int64(2800000*1024), c.MemoryCached)
+	assert.Equal(t, int64(4000000*1024), c.MemoryUsed)
+	assert.Equal(t, int64(500000*1024), c.SwapUsed)
+	assert.Equal(t, int64(1500000*1024), c.SwapFree)
+
+	assert.Equal(t, 3600.25, c.UptimeSeconds)
+	assert.Equal(t, int64(987654), c.ContextSwitches)
+	assert.Equal(t, int64(4321), c.ProcessesCreated)
+	assert.Equal(t, int64(3), c.ProcessesRunning)
+	assert.Equal(t, int64(1), c.ProcessesBlocked)
+	assert.True(t, c.Collected)
+
+	// a missing file fails the whole collection
+	require.NoError(t, os.Remove(filepath.Join(root, "proc/uptime")))
+	assert.Error(t, p.ProvideHostResources(context.Background(), &HostResourcesCollector{}))
+}
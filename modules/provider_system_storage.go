@@ -0,0 +1,262 @@
+/*
+ICOS Telemetruum Agent
+Copyright © 2022-2024 Engineering Ingegneria Informatica S.p.A.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+This work has received funding from the European Union's HORIZON research
+and innovation programme under grant agreement No. 101070177.
+*/
+
+package modules
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/procfs/blockdevice"
+)
+
+var (
+	storageExcludeFSTypes     = kingpin.Flag("storage-exclude-fs-types", "Regexp of the filesystem types that are not reported").Default(defaultExcludeFSTypes).PlaceHolder("REGEXP").String()
+	storageExcludeMountPoints = kingpin.Flag("storage-exclude-mount-points", "Regexp of the mount points that are not reported").Default(defaultExcludeMountPoints).PlaceHolder("REGEXP").String()
+	storageExcludeDevices     = kingpin.Flag("storage-exclude-devices", "Regexp of the block devices whose I/O is not reported").Default(defaultExcludeDevices).PlaceHolder("REGEXP").String()
+)
+
+const (
+	// pseudo and in-memory filesystems
+	defaultExcludeFSTypes = `^(autofs|binfmt_misc|bpf|cgroup2?|configfs|debugfs|devpts|devtmpfs|fusectl|hugetlbfs|mqueue|nsfs|overlay|proc|pstore|ramfs|rpc_pipefs|securityfs|selinuxfs|squashfs|sysfs|tmpfs|tracefs)$`
+	// the container runtimes mount a filesystem for every container
+	defaultExcludeMountPoints = `^/(dev|proc|run|sys|var/lib/docker/.+|var/lib/containerd/.+|var/lib/kubelet/.+)($|/)`
+	// partitions and virtual devices, whose I/O is already counted on the whole disk
+	defaultExcludeDevices = `^(ram|loop|fd|(h|s|v|xv)d[a-z]+|nvme\d+n\d+p|mmcblk\d+p)\d+$`
+
+	// statfs of a hung network filesystem never returns
+	statfsTimeout = 5 * time.Second
+
+	// /proc/diskstats always counts 512 bytes sectors
+	diskSectorSize = 512
+)
+
+// StorageConfig holds the filters of the filesystems and block devices reported by the System provider
+type StorageConfig struct {
+	ExcludeFSTypes     string `yaml:"exclude_fs_types"`
+	ExcludeMountPoints string `yaml:"exclude_mount_points"`
+	ExcludeDevices     string `yaml:"exclude_devices"`
+}
+
+func defaultStorageConfig() StorageConfig {
+	return StorageConfig{
+		ExcludeFSTypes:     *storageExcludeFSTypes,
+		ExcludeMountPoints: *storageExcludeMountPoints,
+		ExcludeDevices:     *storageExcludeDevices,
+	}
+}
+
+func (c StorageConfig) validate() error {
+	var errs []error
+	for name, re := range map[string]string{"exclude_fs_types": c.ExcludeFSTypes, "exclude_mount_points": c.ExcludeMountPoints, "exclude_devices": c.ExcludeDevices} {
+		if _, err := regexp.Compile(re); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// storageFilter is the compiled StorageConfig. An empty expression excludes nothing
+type storageFilter struct {
+	fsTypes     *regexp.Regexp
+	mountPoints *regexp.Regexp
+	devices     *regexp.Regexp
+}
+
+func newStorageFilter(c StorageConfig) storageFilter {
+	compile := func(re string) *regexp.Regexp {
+		if re == "" {
+			return nil
+		}
+		return regexp.MustCompile(re)
+	}
+	return storageFilter{fsTypes: compile(c.ExcludeFSTypes), mountPoints: compile(c.ExcludeMountPoints), devices: compile(c.ExcludeDevices)}
+}
+
+func excluded(re *regexp.Regexp, s string) bool {
+	return re != nil && re.MatchString(s)
+}
+
+type mountEntry struct {
+	device     string
+	mountPoint string
+	fsType     string
+	readOnly   bool
+}
+
+// unescapeMount decodes the octal escapes (e.g. \040 for a space) of the mount table
+func unescapeMount(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// readMounts reads the mount table of the host. The one of init is used, so that the host mounts are seen when
+// the agent runs in a container; the one of the agent is the fallback when init can't be inspected
+func (p *SystemProvider) readMounts() ([]mountEntry, error) {
+	content, err := os.ReadFile(filepath.Join(p.PathRootFs, "proc/1/mounts"))
+	if err != nil {
+		content, err = os.ReadFile(filepath.Join(p.PathRootFs, "proc/self/mounts"))
+		if err != nil {
+			return nil, fmt.Errorf("error reading the mount table: %w", err)
+		}
+	}
+
+	var mounts []mountEntry
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			continue
+		}
+		mounts = append(mounts, mountEntry{
+			device:     unescapeMount(fields[0]),
+			mountPoint: unescapeMount(fields[1]),
+			fsType:     fields[2],
+			readOnly:   slices.Contains(strings.Split(fields[3], ","), "ro"),
+		})
+	}
+	return mounts, nil
+}
+
+// statfs is replaced in the tests
+var statfs = func(path string) (*Filesystem, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return nil, err
+	}
+	bsize := int64(st.Bsize)
+	return &Filesystem{
+		Size:       int64(st.Blocks) * bsize,
+		Free:       int64(st.Bfree) * bsize,
+		Available:  int64(st.Bavail) * bsize,
+		Inodes:     int64(st.Files),
+		InodesFree: int64(st.Ffree),
+	}, nil
+}
+
+// statfsWithTimeout gives up on the filesystems that don't answer in time. They are skipped until the pending
+// call returns
+func (p *SystemProvider) statfsWithTimeout(path string) (*Filesystem, error) {
+	if _, stuck := p.stuckMounts.Load(path); stuck {
+		return nil, errors.New("a previous statfs has not returned yet")
+	}
+
+	type result struct {
+		fs  *Filesystem
+		err error
+	}
+	res := make(chan result, 1)
+	p.stuckMounts.Store(path, true)
+	go func() {
+		fs, err := statfs(path)
+		p.stuckMounts.Delete(path)
+		res <- result{fs, err}
+	}()
+
+	select {
+	case r := <-res:
+		return r.fs, r.err
+	case <-time.After(statfsTimeout):
+		return nil, fmt.Errorf("statfs did not return in %s", statfsTimeout)
+	}
+}
+
+// ProvideHostStorage reports the size of the mounted filesystems and the I/O of the block devices
+func (p *SystemProvider) ProvideHostStorage(ctx context.Context, c *HostStorageCollector) error {
+	mounts, err := p.readMounts()
+	if err != nil {
+		return err
+	}
+
+	filesystems := []*Filesystem{}
+	seen := map[string]int{}
+	for _, m := range mounts {
+		if excluded(p.storage.fsTypes, m.fsType) || excluded(p.storage.mountPoints, m.mountPoint) {
+			continue
+		}
+
+		fs, err := p.statfsWithTimeout(filepath.Join(p.PathRootFs, m.mountPoint))
+		if err != nil {
+			p.Logger.Debug().Msgf("Skipping filesystem %s: %s", m.mountPoint, err)
+			continue
+		}
+		fs.Device, fs.MountPoint, fs.Type, fs.ReadOnly = m.device, m.mountPoint, m.fsType, m.readOnly
+
+		// a mount over the same point hides the previous one
+		if i, ok := seen[m.mountPoint]; ok {
+			filesystems[i] = fs
+			continue
+		}
+		seen[m.mountPoint] = len(filesystems)
+		filesystems = append(filesystems, fs)
+	}
+	c.Filesystems = filesystems
+
+	bfs, err := blockdevice.NewFS(filepath.Join(p.PathRootFs, "proc"), filepath.Join(p.PathRootFs, "sys"))
+	if err != nil {
+		return err
+	}
+	stats, err := bfs.ProcDiskstats()
+	if err != nil {
+		return fmt.Errorf("error reading the disk stats: %w", err)
+	}
+
+	devices := []*BlockDevice{}
+	for _, d := range stats {
+		if excluded(p.storage.devices, d.DeviceName) {
+			continue
+		}
+		devices = append(devices, &BlockDevice{
+			Name:       d.DeviceName,
+			ReadBytes:  int64(d.ReadSectors) * diskSectorSize,
+			WriteBytes: int64(d.WriteSectors) * diskSectorSize,
+			ReadOps:    int64(d.ReadIOs),
+			WriteOps:   int64(d.WriteIOs),
+			ReadTime:   float64(d.ReadTicks) / 1000,
+			WriteTime:  float64(d.WriteTicks) / 1000,
+			IOTime:     float64(d.IOsTotalTicks) / 1000,
+		})
+	}
+	c.BlockDevices = devices
+
+	return nil
+}
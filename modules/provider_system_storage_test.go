@@ -0,0 +1,108 @@
+/*
+ICOS Telemetruum Agent
+Copyright © 2022-2024 Engineering Ingegneria Informatica S.p.A.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+This work has received funding from the European Union's HORIZON research
+and innovation programme under grant agreement No. 101070177.
+*/
+
+package modules
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProvideHostStorage(t *testing.T) {
+	root := t.TempDir()
+	writeFixture(t, root, map[string]string{
+		"proc/1/mounts": `/dev/sda1 / ext4 rw,relatime 0 0
+proc /proc proc rw,nosuid,nodev,noexec,relatime 0 0
+tmpfs /run tmpfs rw,nosuid,nodev 0 0
+/dev/sdb1 /mnt/my\040data xfs ro,relatime 0 0
+/dev/sdc1 /srv ext4 rw 0 0
+/dev/sdd1 /srv ext4 rw 0 0
+overlay /var/lib/docker/overlay2/abc/merged overlay rw 0 0
+nas:/export /mnt/nas nfs4 rw 0 0
+`,
+		"proc/diskstats": `   8       0 sda 100 5 2048 30 200 10 4096 50 0 70 80 0 0 0 0 0 0
+   8       1 sda1 90 5 2000 25 190 10 4000 45 0 60 70 0 0 0 0 0 0
+   7       0 loop0 10 0 80 1 0 0 0 0 0 1 1 0 0 0 0 0 0
+ 259       0 nvme0n1 1000 0 8000 400 500 0 16000 600 0 900 1000 0 0 0 0 0 0
+`,
+		"sys/block/.keep": "",
+	})
+
+	var stated []string
+	defer func(f func(string) (*Filesystem, error)) { statfs = f }(statfs)
+	statfs = func(path string) (*Filesystem, error) {
+		rel := "/" + strings.TrimPrefix(strings.TrimPrefix(path, root), "/")
+		stated = append(stated, rel)
+		if rel == "/mnt/nas" {
+			return nil, errors.New("stale file handle")
+		}
+		return &Filesystem{Size: 1000, Free: 400, Available: 300, Inodes: 100, InodesFree: 60}, nil
+	}
+
+	p := &SystemProvider{BaseProvider: BaseProvider{Logger: zerolog.Nop(), PathRootFs: root}, storage: newStorageFilter(StorageConfig{
+		ExcludeFSTypes:     defaultExcludeFSTypes,
+		ExcludeMountPoints: defaultExcludeMountPoints,
+		ExcludeDevices:     defaultExcludeDevices,
+	})}
+	c := &HostStorageCollector{}
+	require.NoError(t, p.ProvideHostStorage(context.Background(), c))
+
+	// the filesystems are stated under the host root and reported with their host paths
+	assert.Equal(t, []string{"/", "/mnt/my data", "/srv", "/srv", "/mnt/nas"}, stated)
+	fs := map[string]*Filesystem{}
+	for _, f := range c.Filesystems {
+		fs[f.MountPoint] = f
+	}
+	require.Len(t, fs, 3)
+	assert.Equal(t, &Filesystem{Device: "/dev/sda1", MountPoint: "/", Type: "ext4", Size: 1000, Free: 400, Available: 300, Inodes: 100, InodesFree: 60}, fs["/"])
+	assert.True(t, fs["/mnt/my data"].ReadOnly)
+	assert.Equal(t, "/dev/sdd1", fs["/srv"].Device, "the last mount over a point hides the previous ones")
+
+	require.Len(t, c.BlockDevices, 2)
+	assert.Equal(t, &BlockDevice{Name: "sda", ReadBytes: 2048 * 512, WriteBytes: 4096 * 512, ReadOps: 100, WriteOps: 200, ReadTime: 0.03, WriteTime: 0.05, IOTime: 0.07}, c.BlockDevices[0])
+	assert.Equal(t, "nvme0n1", c.BlockDevices[1].Name)
+
+	// without filters everything is reported
+	p.storage = newStorageFilter(StorageConfig{})
+	c = &HostStorageCollector{}
+	require.NoError(t, p.ProvideHostStorage(context.Background(), c))
+	assert.Len(t, c.Filesystems, 6, "all but the stale one")
+	assert.Len(t, c.BlockDevices, 4)
+
+	// the mount table of the agent is used when the one of init can't be read
+	require.NoError(t, os.Rename(filepath.Join(root, "proc/1"), filepath.Join(root, "proc/self")))
+	c = &HostStorageCollector{}
+	require.NoError(t, p.ProvideHostStorage(context.Background(), c))
+	assert.Len(t, c.Filesystems, 6)
+}
+
+func TestStorageConfigValidate(t *testing.T) {
+	assert.NoError(t, StorageConfig{ExcludeFSTypes: defaultExcludeFSTypes, ExcludeMountPoints: defaultExcludeMountPoints, ExcludeDevices: defaultExcludeDevices}.validate())
+	assert.NoError(t, StorageConfig{}.validate())
+	assert.ErrorContains(t, StorageConfig{ExcludeDevices: "^(sd"}.validate(), "exclude_devices")
+}
@@ -29,12 +29,8 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
-var testIPHint = "8.8.8.8:80"
-
 func TestHelloName(t *testing.T) {
 
-	ipHint = &testIPHint
-
 	systemProvider := &SystemProvider{BaseProvider: BaseProvider{}}
 
 	info := &HostInfoCollector{}
@@ -0,0 +1,203 @@
+/*
+ICOS Telemetruum Agent
+Copyright © 2022-2024 Engineering Ingegneria Informatica S.p.A.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+This work has received funding from the European Union's HORIZON research
+and innovation programme under grant agreement No. 101070177.
+*/
+
+package modules
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// usbClasses names the USB base classes, as in the usb.org class codes
+var usbClasses = map[string]string{
+	"01": "audio",
+	"02": "communications",
+	"03": "hid",
+	"05": "physical",
+	"06": "image",
+	"07": "printer",
+	"08": "mass-storage",
+	"09": "hub",
+	"0a": "cdc-data",
+	"0b": "smart-card",
+	"0d": "content-security",
+	"0e": "video",
+	"0f": "healthcare",
+	"10": "audio-video",
+	"11": "billboard",
+	"dc": "diagnostic",
+	"e0": "wireless",
+	"ef": "miscellaneous",
+	"fe": "application-specific",
+	"ff": "vendor-specific",
+}
+
+// readAttr reads a sysfs attribute, returning an empty string if it is missing
+func readAttr(dir, name string) string {
+	content, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(content))
+}
+
+// ueventDevName returns the DEVNAME of a sysfs uevent file, relative to /dev
+func ueventDevName(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if name, ok := strings.CutPrefix(s.Text(), "DEVNAME="); ok {
+			return name
+		}
+	}
+	return ""
+}
+
+// usbDevNodes finds the device nodes created by the drivers bound to the interfaces of a USB device (e.g.
+// /dev/ttyUSB0 or /dev/video0), falling back to the generic /dev/bus/usb node of the device
+func usbDevNodes(dir string) []string {
+	nodes := []string{}
+	interfaces, _ := filepath.Glob(dir + ":*")
+	for _, iface := range interfaces {
+		// the entries of /sys/bus/usb/devices are links, that WalkDir does not follow
+		iface, err := filepath.EvalSymlinks(iface)
+		if err != nil {
+			continue
+		}
+		_ = filepath.WalkDir(iface, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			// the class devices are at most a few levels below the interface, e.g. ttyUSB0/tty/ttyUSB0 or
+			// 0003:046D:C52B.0001/input/input5/event5
+			if d.IsDir() && (d.Name() == "power" || strings.HasPrefix(d.Name(), "ep_") ||
+				strings.Count(strings.TrimPrefix(path, iface), string(filepath.Separator)) > 4) {
+				return filepath.SkipDir
+			}
+			if d.Name() == "uevent" && path != filepath.Join(iface, "uevent") {
+				if name := ueventDevName(path); name != "" {
+					nodes = append(nodes, "/dev/"+name)
+				}
+			}
+			return nil
+		})
+	}
+	sort.Strings(nodes)
+	if len(nodes) == 0 {
+		if name := ueventDevName(filepath.Join(dir, "uevent")); name != "" {
+			nodes = append(nodes, "/dev/"+name)
+		}
+	}
+	return nodes
+}
+
+// usbClass names the class of a USB device. Composite devices declare the class in their interfaces
+func usbClass(dir string) string {
+	class := readAttr(dir, "bDeviceClass")
+	if class == "00" {
+		interfaces, _ := filepath.Glob(dir + ":*")
+		sort.Strings(interfaces)
+		if len(interfaces) > 0 {
+			class = readAttr(interfaces[0], "bInterfaceClass")
+		}
+	}
+	if name, ok := usbClasses[class]; ok {
+		return name
+	}
+	return class
+}
+
+// ProvideUSBPeripherals lists the USB devices in /sys/bus/usb/devices, skipping the hubs
+func (p *SystemProvider) ProvideUSBPeripherals(ctx context.Context, c *NodeMountedCollector) error {
+	if !peripheralAllowed(p.PeripheralInterfaces, "USB") {
+		c.setPeripherals("usb", nil)
+		return nil
+	}
+
+	entries, err := os.ReadDir(filepath.Join(p.PathRootFs, "sys/bus/usb/devices"))
+	if os.IsNotExist(err) {
+		// no USB controller
+		c.setPeripherals("usb", nil)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading the USB devices: %w", err)
+	}
+
+	peripherals := []*Peripheral{}
+	for _, e := range entries {
+		// the interfaces (1-1.2:1.0) are read with their device
+		if strings.Contains(e.Name(), ":") {
+			continue
+		}
+		dir := filepath.Join(p.PathRootFs, "sys/bus/usb/devices", e.Name())
+		vendor, product := readAttr(dir, "idVendor"), readAttr(dir, "idProduct")
+		class := usbClass(dir)
+		if vendor == "" || class == "hub" {
+			continue
+		}
+
+		name := readAttr(dir, "product")
+		if name == "" {
+			name = "usb-device"
+		}
+		details := map[string]string{"bus_path": e.Name()}
+		if product := readAttr(dir, "product"); product != "" {
+			details["product"] = product
+		}
+		// in Mbit/s
+		if speed := readAttr(dir, "speed"); speed != "" {
+			details["speed"] = speed
+		}
+
+		nodes := usbDevNodes(dir)
+		for _, node := range nodes {
+			peripherals = append(peripherals, &Peripheral{
+				// the same format used by NuvlaEdge
+				Device:       strings.ToLower(strings.ReplaceAll(name, " ", "-")) + "_" + vendor + "_" + product,
+				ResourcePath: node,
+				Available:    true,
+				Interface:    "USB",
+				VendorID:     vendor,
+				ProductID:    product,
+				Manufacturer: readAttr(dir, "manufacturer"),
+				Serial:       readAttr(dir, "serial"),
+				Class:        class,
+				Details:      details,
+			})
+		}
+		if len(nodes) == 0 {
+			p.Logger.Debug().Msgf("USB device %s has no device node", e.Name())
+		}
+	}
+
+	c.setPeripherals("usb", peripherals)
+	return nil
+}
@@ -0,0 +1,122 @@
+/*
+ICOS Telemetruum Agent
+Copyright © 2022-2024 Engineering Ingegneria Informatica S.p.A.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+This work has received funding from the European Union's HORIZON research
+and innovation programme under grant agreement No. 101070177.
+*/
+
+package modules
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeUSBFixture lays out the given devices and interfaces under /sys/devices, linked from /sys/bus/usb/devices as
+// in the real sysfs
+func writeUSBFixture(t *testing.T, root string, devices map[string]map[string]string) {
+	const controller = "sys/devices/pci0000:00/0000:00:14.0"
+	for path, files := range devices {
+		dir := filepath.Join(controller, path)
+		fixture := map[string]string{}
+		for name, content := range files {
+			fixture[filepath.Join(dir, name)] = content + "\n"
+		}
+		writeFixture(t, root, fixture)
+
+		link := filepath.Join(root, "sys/bus/usb/devices", filepath.Base(path))
+		require.NoError(t, os.MkdirAll(filepath.Dir(link), 0o755))
+		target, err := filepath.Rel(filepath.Dir(link), filepath.Join(root, dir))
+		require.NoError(t, err)
+		require.NoError(t, os.Symlink(target, link))
+	}
+}
+
+func TestProvideUSBPeripherals(t *testing.T) {
+	root := t.TempDir()
+	writeUSBFixture(t, root, map[string]map[string]string{
+		"usb1":     {"idVendor": "1d6b", "idProduct": "0002", "bDeviceClass": "09", "product": "xHCI Host Controller", "uevent": "DEVNAME=bus/usb/001/001"},
+		"usb1/1-1": {"idVendor": "05e3", "idProduct": "0610", "bDeviceClass": "09", "product": "USB2.0 Hub", "uevent": "DEVNAME=bus/usb/001/002"},
+		// a serial adapter, whose class is declared by its interface
+		"usb1/1-1/1-1.2": {
+			"idVendor": "0403", "idProduct": "6001", "bDeviceClass": "00", "manufacturer": "FTDI", "product": "FT232R USB UART", "serial": "A50285BI", "speed": "12",
+			"uevent": "DEVNAME=bus/usb/001/003",
+		},
+		"usb1/1-1/1-1.2/1-1.2:1.0": {
+			"bInterfaceClass": "ff", "uevent": "DEVTYPE=usb_interface",
+			"ttyUSB0/uevent": "DEVTYPE=usb_serial", "ttyUSB0/tty/ttyUSB0/uevent": "MAJOR=188\nMINOR=0\nDEVNAME=ttyUSB0",
+			"ep_81/uevent": "DEVTYPE=usb_endpoint",
+		},
+		// a webcam, with a video and an audio interface
+		"usb1/1-1/1-1.3": {
+			"idVendor": "046d", "idProduct": "0825", "bDeviceClass": "ef", "manufacturer": "Logitech", "product": "Webcam C270",
+			"uevent": "DEVNAME=bus/usb/001/004",
+		},
+		"usb1/1-1/1-1.3/1-1.3:1.0": {"bInterfaceClass": "0e", "video4linux/video0/uevent": "DEVNAME=video0"},
+		"usb1/1-1/1-1.3/1-1.3:1.2": {"bInterfaceClass": "01", "sound/card1/uevent": "SOUND_INITIALIZED=1", "sound/card1/pcmC1D0c/uevent": "DEVNAME=snd/pcmC1D0c"},
+		// a device without driver, only reachable through usbfs
+		"usb1/1-4": {"idVendor": "1a86", "idProduct": "7523", "bDeviceClass": "ff", "uevent": "DEVNAME=bus/usb/001/005"},
+	})
+
+	p := &SystemProvider{BaseProvider: BaseProvider{Logger: zerolog.Nop(), PathRootFs: root}}
+	c := &NodeMountedCollector{AttachedPeripherals: []*Peripheral{
+		{Device: "zigbee_10c4_ea60", ResourcePath: "/dev/ttyUSB1", Available: false, Source: "nuvla"},
+		{Device: "old_0000_0000", ResourcePath: "/dev/ttyUSB9", Available: true, Source: "usb"},
+	}}
+	require.NoError(t, p.ProvideUSBPeripherals(context.Background(), c))
+
+	assert.Equal(t, []*Peripheral{
+		{Device: "zigbee_10c4_ea60", ResourcePath: "/dev/ttyUSB1", Available: false, Source: "nuvla"},
+		{
+			Device: "ft232r-usb-uart_0403_6001", ResourcePath: "/dev/ttyUSB0", Available: true, Source: "usb", Interface: "USB",
+			VendorID: "0403", ProductID: "6001", Manufacturer: "FTDI", Serial: "A50285BI", Class: "vendor-specific",
+			Details: map[string]string{"bus_path": "1-1.2", "product": "FT232R USB UART", "speed": "12"},
+		},
+		{
+			Device: "webcam-c270_046d_0825", ResourcePath: "/dev/snd/pcmC1D0c", Available: true, Source: "usb", Interface: "USB",
+			VendorID: "046d", ProductID: "0825", Manufacturer: "Logitech", Class: "miscellaneous",
+			Details: map[string]string{"bus_path": "1-1.3", "product": "Webcam C270"},
+		},
+		{
+			Device: "webcam-c270_046d_0825", ResourcePath: "/dev/video0", Available: true, Source: "usb", Interface: "USB",
+			VendorID: "046d", ProductID: "0825", Manufacturer: "Logitech", Class: "miscellaneous",
+			Details: map[string]string{"bus_path": "1-1.3", "product": "Webcam C270"},
+		},
+		{
+			Device: "usb-device_1a86_7523", ResourcePath: "/dev/bus/usb/001/005", Available: true, Source: "usb", Interface: "USB",
+			VendorID: "1a86", ProductID: "7523", Class: "vendor-specific",
+			Details: map[string]string{"bus_path": "1-4"},
+		},
+	}, c.AttachedPeripherals)
+
+	// USB is not in the allowlist
+	p.PeripheralInterfaces = []string{"Bluetooth"}
+	require.NoError(t, p.ProvideUSBPeripherals(context.Background(), c))
+	require.Len(t, c.AttachedPeripherals, 1)
+	p.PeripheralInterfaces = nil
+
+	// a host without USB controllers
+	p.PathRootFs = t.TempDir()
+	require.NoError(t, p.ProvideUSBPeripherals(context.Background(), c))
+	require.Len(t, c.AttachedPeripherals, 1)
+	assert.Equal(t, "nuvla", c.AttachedPeripherals[0].Source)
+}
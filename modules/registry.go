@@ -0,0 +1,156 @@
+/*
+ICOS Telemetruum Agent
+Copyright © 2022-2024 Engineering Ingegneria Informatica S.p.A.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+This work has received funding from the European Union's HORIZON research
+and innovation programme under grant agreement No. 101070177.
+*/
+
+package modules
+
+import (
+	"context"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// CollectorRunner is the type-erased view of an AsyncCollectorRunner used by the registry
+type CollectorRunner interface {
+	Init(metric.Meter)
+	Start(context.Context, *sync.WaitGroup)
+	Close()
+	// SetAsyncDataProviders replaces, at once, the providers with the ones bound by ProviderFeed.bind to the
+	// collector type
+	SetAsyncDataProviders(feeds []any)
+	LastCollection() time.Time
+	// Current returns the last complete snapshot of the collector
+	Current() any
+}
+
+type collectorRegistration struct {
+	name      string
+	flag      string
+	enabled   *bool
+	interval  *time.Duration
+	newRunner func(schedule Schedule, logger zerolog.Logger) CollectorRunner
+}
+
+// CollectorRegistration describes a collector that can be enabled and scheduled by the registry
+type CollectorRegistration[T AsyncCollector[T]] struct {
+	// Name used in the logs (e.g. "HostInfo")
+	Name string
+	// Flag prefix used for the command line flags (e.g. "host-info")
+	Flag string
+	// Human readable description used in the flags help (e.g. "Host Info Metrics")
+	Description     string
+	DefaultInterval string
+	New             func() T
+}
+
+// ProviderFeed binds a provider method to the collectors of a given type
+type ProviderFeed struct {
+	// bind returns the DataProvider of the method of p, nil if p is not of the feed type
+	bind func(p Provider, name string, timeout time.Duration) any
+}
+
+// ProviderRegistration describes a provider that can be enabled by the registry
+type ProviderRegistration struct {
+	// Name used in the logs (e.g. "Kubernetes")
+	Name string
+	// Flag used to enable/disable the provider (e.g. "kubernetes")
+	Flag string
+	// Providers are initialized, and feed their collectors, in ascending priority
+	Priority   int
+	Initialize func(cfg *Config, logger zerolog.Logger) (Provider, error)
+	// Settings extracts from the configuration the values used by the provider. The provider is restarted
+	// when they change
+	Settings func(cfg *Config) any
+	Feeds    []ProviderFeed
+
+	enabled *bool
+}
+
+var (
+	registeredCollectors []*collectorRegistration
+	registeredProviders  []*ProviderRegistration
+)
+
+// RegisterCollector makes a collector available to the agent. It is meant to be called from init()
+func RegisterCollector[T AsyncCollector[T]](reg CollectorRegistration[T]) {
+	registeredCollectors = append(registeredCollectors, &collectorRegistration{
+		name:     reg.Name,
+		flag:     reg.Flag,
+		enabled:  kingpin.Flag(reg.Flag, "Enable "+reg.Description).Default("true").Bool(),
+		interval: kingpin.Flag(reg.Flag+"-interval", "Interval for "+reg.Description).Default(reg.DefaultInterval).Duration(),
+		newRunner: func(schedule Schedule, logger zerolog.Logger) CollectorRunner {
+			return &AsyncCollectorRunner[T]{
+				Schedule:  schedule,
+				Name:      reg.Name,
+				Collector: reg.New(),
+				Logger:    logger}
+		},
+	})
+}
+
+// RegisterProvider makes a provider available to the agent. It is meant to be called from init()
+func RegisterProvider(reg ProviderRegistration) {
+	reg.enabled = kingpin.Flag(reg.Flag, "Enable "+reg.Name+" Provider").Default("true").Bool()
+	registeredProviders = append(registeredProviders, &reg)
+}
+
+// Feed declares that a provider method feeds the collectors of type T
+func Feed[P Provider, T AsyncCollector[T]](fn func(P, context.Context, T) error) ProviderFeed {
+	method := runtime.FuncForPC(reflect.ValueOf(fn).Pointer()).Name()
+	method = method[strings.LastIndex(method, ".")+1:]
+
+	return ProviderFeed{bind: func(p Provider, name string, timeout time.Duration) any {
+		provider, ok := p.(P)
+		if !ok {
+			return nil
+		}
+		return DataProvider[T]{
+			Provider: name,
+			Name:     method,
+			Timeout:  timeout,
+			Provide: func(ctx context.Context, c T) error {
+				return fn(provider, ctx, c)
+			}}
+	}}
+}
+
+func findProvider(flag string) *ProviderRegistration {
+	for _, p := range registeredProviders {
+		if p.Flag == flag {
+			return p
+		}
+	}
+	return nil
+}
+
+func findCollector(flag string) *collectorRegistration {
+	for _, c := range registeredCollectors {
+		if c.flag == flag {
+			return c
+		}
+	}
+	return nil
+}
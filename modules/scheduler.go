@@ -0,0 +1,97 @@
+/*
+ICOS Telemetruum Agent
+Copyright © 2022-2024 Engineering Ingegneria Informatica S.p.A.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+This work has received funding from the European Union's HORIZON research
+and innovation programme under grant agreement No. 101070177.
+*/
+
+package modules
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+)
+
+var (
+	startJitter    = kingpin.Flag("start-jitter", "Maximum random delay before the collectors start their schedule").Default("0s").Duration()
+	intervalJitter = kingpin.Flag("interval-jitter", "Maximum random delay added to every collection. Must be lower than the collector interval").Default("0s").Duration()
+	immediateRun   = kingpin.Flag("immediate-first-run", "Run the collectors as soon as the agent starts, before waiting for their schedule").Default("true").Bool()
+)
+
+// Schedule describes when a collector runs. Random jitters are used to avoid that a fleet of agents
+// hits the Docker and Kubernetes APIs in lockstep
+type Schedule struct {
+	Interval time.Duration
+	// Maximum random delay before the ticker is started
+	StartJitter time.Duration
+	// Maximum random delay added to every tick
+	Jitter time.Duration
+	// Run once as soon as the schedule starts, without waiting for the start jitter nor the first tick
+	Immediate bool
+}
+
+// Run calls fn according to the schedule until ctx is cancelled
+func (s Schedule) Run(ctx context.Context, fn func(context.Context)) {
+	if s.Immediate {
+		fn(ctx)
+	}
+
+	if !sleepContext(ctx, randomDuration(s.StartJitter)) {
+		return
+	}
+
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !sleepContext(ctx, randomDuration(s.Jitter)) {
+				return
+			}
+			fn(ctx)
+		}
+	}
+}
+
+func randomDuration(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
+
+// sleepContext waits for d, returning false if ctx is cancelled in the meantime
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
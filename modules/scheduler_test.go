@@ -0,0 +1,63 @@
+/*
+ICOS Telemetruum Agent
+Copyright © 2022-2024 Engineering Ingegneria Informatica S.p.A.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+This work has received funding from the European Union's HORIZON research
+and innovation programme under grant agreement No. 101070177.
+*/
+
+package modules
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScheduleImmediateAndCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var runs atomic.Int32
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		Schedule{Interval: time.Hour, StartJitter: time.Hour, Immediate: true}.Run(ctx, func(context.Context) {
+			runs.Add(1)
+		})
+	}()
+
+	assert.Eventually(t, func() bool { return runs.Load() == 1 }, time.Second, time.Millisecond, "the first run should not wait for the start jitter")
+
+	cancel()
+	wg.Wait()
+	assert.Equal(t, int32(1), runs.Load())
+}
+
+func TestScheduleTicks(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var runs atomic.Int32
+	go Schedule{Interval: 10 * time.Millisecond, Jitter: 5 * time.Millisecond}.Run(ctx, func(context.Context) {
+		runs.Add(1)
+	})
+
+	assert.Eventually(t, func() bool { return runs.Load() >= 3 }, time.Second, time.Millisecond)
+}
@@ -0,0 +1,369 @@
+/*
+ICOS Telemetruum Agent
+Copyright © 2022-2024 Engineering Ingegneria Informatica S.p.A.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+This work has received funding from the European Union's HORIZON research
+and innovation programme under grant agreement No. 101070177.
+*/
+
+package modules
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/rs/zerolog"
+)
+
+var (
+	tlsCertFile     = kingpin.Flag("tls-cert-file", "Certificate served on --bind. It is reloaded when the file changes").PlaceHolder("FILE").String()
+	tlsKeyFile      = kingpin.Flag("tls-key-file", "Key of the certificate served on --bind").PlaceHolder("FILE").String()
+	tlsClientCAFile = kingpin.Flag("tls-client-ca-file", "CA bundle used to verify the client certificates. Clients without a valid certificate are rejected").PlaceHolder("FILE").String()
+	authUsername    = kingpin.Flag("auth-username", "Username required to read the metrics (basic authentication)").PlaceHolder("USER").String()
+	authPassword    = kingpin.Flag("auth-password-file", "File with the password required to read the metrics (basic authentication)").PlaceHolder("FILE").String()
+	authTokenFile   = kingpin.Flag("auth-bearer-token-file", "File with the bearer token required to read the metrics").PlaceHolder("FILE").String()
+	readTimeout     = kingpin.Flag("read-timeout", "Maximum duration for reading a request").Default("30s").Duration()
+	writeTimeout    = kingpin.Flag("write-timeout", "Maximum duration for writing a response").Default("30s").Duration()
+	idleTimeout     = kingpin.Flag("idle-timeout", "Maximum time to wait for the next request on a keep-alive connection").Default("2m").Duration()
+)
+
+// ServerTLSConfig holds the TLS settings of the HTTP server
+type ServerTLSConfig struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// If set, the clients must present a certificate signed by one of these CAs
+	ClientCAFile string `yaml:"client_ca_file"`
+}
+
+// ServerAuthConfig holds the credentials required by the HTTP server. The password and token files are read
+// again when they change
+type ServerAuthConfig struct {
+	BasicAuth       BasicAuth `yaml:"basic_auth"`
+	BearerToken     string    `yaml:"bearer_token"`
+	BearerTokenFile string    `yaml:"bearer_token_file"`
+}
+
+// ServerConfig holds the settings of the HTTP server listening on Config.Bind
+type ServerConfig struct {
+	TLS          ServerTLSConfig  `yaml:"tls"`
+	Auth         ServerAuthConfig `yaml:"auth"`
+	ReadTimeout  Duration         `yaml:"read_timeout"`
+	WriteTimeout Duration         `yaml:"write_timeout"`
+	IdleTimeout  Duration         `yaml:"idle_timeout"`
+}
+
+func defaultServerConfig() ServerConfig {
+	return ServerConfig{
+		TLS: ServerTLSConfig{CertFile: *tlsCertFile, KeyFile: *tlsKeyFile, ClientCAFile: *tlsClientCAFile},
+		Auth: ServerAuthConfig{
+			BasicAuth:       BasicAuth{Username: *authUsername, PasswordFile: *authPassword},
+			BearerTokenFile: *authTokenFile,
+		},
+		ReadTimeout:  Duration(*readTimeout),
+		WriteTimeout: Duration(*writeTimeout),
+		IdleTimeout:  Duration(*idleTimeout),
+	}
+}
+
+func (a ServerAuthConfig) basic() bool {
+	return a.BasicAuth.Username != "" || a.BasicAuth.Password != "" || a.BasicAuth.PasswordFile != ""
+}
+
+func (a ServerAuthConfig) bearer() bool {
+	return a.BearerToken != "" || a.BearerTokenFile != ""
+}
+
+func (c ServerConfig) validate() error {
+	var errs []error
+
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		errs = append(errs, errors.New("tls: cert_file and key_file must be set together"))
+	}
+	if c.TLS.ClientCAFile != "" && c.TLS.CertFile == "" {
+		errs = append(errs, errors.New("tls: client_ca_file requires cert_file and key_file"))
+	}
+
+	auth := c.Auth
+	if auth.basic() && auth.bearer() {
+		errs = append(errs, errors.New("auth: basic_auth and bearer_token are mutually exclusive"))
+	}
+	if auth.basic() && auth.BasicAuth.Username == "" {
+		errs = append(errs, errors.New("auth: basic_auth requires a username"))
+	}
+	if auth.BasicAuth.Password != "" && auth.BasicAuth.PasswordFile != "" {
+		errs = append(errs, errors.New("auth: password and password_file are mutually exclusive"))
+	}
+	if auth.BearerToken != "" && auth.BearerTokenFile != "" {
+		errs = append(errs, errors.New("auth: bearer_token and bearer_token_file are mutually exclusive"))
+	}
+
+	if auth.basic() && auth.BasicAuth.Password == "" && auth.BasicAuth.PasswordFile == "" {
+		errs = append(errs, errors.New("auth: basic_auth requires a password or a password_file"))
+	}
+
+	for _, f := range []string{c.TLS.CertFile, c.TLS.KeyFile, c.TLS.ClientCAFile} {
+		if f == "" {
+			continue
+		}
+		if _, err := os.Stat(f); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	// an empty secret would accept empty credentials
+	for _, f := range []string{auth.BasicAuth.PasswordFile, auth.BearerTokenFile} {
+		if f == "" {
+			continue
+		}
+		if content, err := os.ReadFile(f); err != nil {
+			errs = append(errs, err)
+		} else if len(bytes.TrimSpace(content)) == 0 {
+			errs = append(errs, fmt.Errorf("auth: %s is empty", f))
+		}
+	}
+
+	if c.ReadTimeout <= 0 || c.WriteTimeout <= 0 || c.IdleTimeout <= 0 {
+		errs = append(errs, errors.New("read_timeout, write_timeout and idle_timeout must be positive"))
+	}
+
+	return errors.Join(errs...)
+}
+
+// watchedFile caches the content of a file, reading it again when its modification time or size change
+type watchedFile struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	content []byte
+}
+
+// read returns the content of the file, and whether it changed since the last call
+func (f *watchedFile) read() ([]byte, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return nil, false, err
+	}
+	if f.content != nil && info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return f.content, false, nil
+	}
+
+	content, err := os.ReadFile(f.path)
+	if err != nil {
+		return nil, false, err
+	}
+	f.content, f.modTime, f.size = content, info.ModTime(), info.Size()
+	return content, true, nil
+}
+
+// certReloader serves the certificate in certFile, loading it again when the files change. If the new files
+// can't be loaded (e.g. while they are being replaced), the previous certificate is kept
+type certReloader struct {
+	cert   *watchedFile
+	key    *watchedFile
+	logger zerolog.Logger
+
+	mu      sync.Mutex
+	current *tls.Certificate
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	certPEM, certChanged, err := r.cert.read()
+	if err == nil {
+		var keyPEM []byte
+		var keyChanged bool
+		keyPEM, keyChanged, err = r.key.read()
+		if err == nil && (certChanged || keyChanged || r.current == nil) {
+			var cert tls.Certificate
+			cert, err = tls.X509KeyPair(certPEM, keyPEM)
+			if err == nil {
+				if r.current != nil {
+					r.logger.Info().Msgf("Reloaded the certificate %s", r.cert.path)
+				}
+				r.current = &cert
+			}
+		}
+	}
+
+	if err != nil {
+		if r.current == nil {
+			return nil, err
+		}
+		r.logger.Warn().Msgf("Error reloading the certificate %s, serving the previous one: %s", r.cert.path, err)
+	}
+	return r.current, nil
+}
+
+// Server is the HTTP(S) server of the agent
+type Server struct {
+	*http.Server
+	config ServerConfig
+	logger zerolog.Logger
+
+	password *watchedFile
+	token    *watchedFile
+}
+
+// NewServer creates the server listening on bind. The handler must be set before calling Start
+func NewServer(bind string, c ServerConfig, logger zerolog.Logger) (*Server, error) {
+	s := &Server{
+		Server: &http.Server{
+			Addr:              bind,
+			ReadTimeout:       time.Duration(c.ReadTimeout),
+			ReadHeaderTimeout: time.Duration(c.ReadTimeout),
+			WriteTimeout:      time.Duration(c.WriteTimeout),
+			IdleTimeout:       time.Duration(c.IdleTimeout),
+		},
+		config: c,
+		logger: logger,
+	}
+
+	if c.Auth.BasicAuth.PasswordFile != "" {
+		s.password = &watchedFile{path: c.Auth.BasicAuth.PasswordFile}
+	}
+	if c.Auth.BearerTokenFile != "" {
+		s.token = &watchedFile{path: c.Auth.BearerTokenFile}
+	}
+
+	if c.TLS.CertFile == "" {
+		return s, nil
+	}
+
+	reloader := &certReloader{cert: &watchedFile{path: c.TLS.CertFile}, key: &watchedFile{path: c.TLS.KeyFile}, logger: logger}
+	if _, err := reloader.GetCertificate(nil); err != nil {
+		return nil, fmt.Errorf("error loading the server certificate: %w", err)
+	}
+	s.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: reloader.GetCertificate}
+
+	if c.TLS.ClientCAFile != "" {
+		ca, err := os.ReadFile(c.TLS.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading the client CA file: %w", err)
+		}
+		s.TLSConfig.ClientCAs = x509.NewCertPool()
+		if !s.TLSConfig.ClientCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificate found in client CA file %s", c.TLS.ClientCAFile)
+		}
+		// verified here, enforced by Protect, so that the unprotected endpoints (e.g. the probes) can be
+		// reached without a certificate
+		s.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return s, nil
+}
+
+// Start listens on the bind address and serves the requests in background. The errors of the listener, e.g. an
+// address already in use, are returned
+func (s *Server) Start() error {
+	l, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return fmt.Errorf("error listening on %s: %w", s.Addr, err)
+	}
+
+	go func() {
+		var err error
+		if s.TLSConfig != nil {
+			err = s.ServeTLS(l, "", "")
+		} else {
+			err = s.Serve(l)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			s.logger.Error().Msgf("Error serving http: %s", err)
+		}
+	}()
+	return nil
+}
+
+// Protect requires the client certificate and the credentials set in the configuration to call h
+func (s *Server) Protect(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.config.TLS.ClientCAFile != "" && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+			http.Error(w, "client certificate required", http.StatusUnauthorized)
+			return
+		}
+
+		if err := s.authenticate(r); err != nil {
+			s.logger.Debug().Msgf("Unauthorized request from %s: %s", r.RemoteAddr, err)
+			if s.config.Auth.basic() {
+				w.Header().Set("WWW-Authenticate", `Basic realm="telemetruum-agent"`)
+			} else {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+			}
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) authenticate(r *http.Request) error {
+	auth := s.config.Auth
+
+	switch {
+	case auth.basic():
+		expected := []byte(auth.BasicAuth.Password)
+		if s.password != nil {
+			content, _, err := s.password.read()
+			if err != nil {
+				return err
+			}
+			expected = bytes.TrimSpace(content)
+		}
+		if len(expected) == 0 {
+			return errors.New("the expected password is empty")
+		}
+		username, password, ok := r.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(username), []byte(auth.BasicAuth.Username)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password), expected) != 1 {
+			return errors.New("invalid basic auth credentials")
+		}
+
+	case auth.bearer():
+		expected := []byte(auth.BearerToken)
+		if s.token != nil {
+			content, _, err := s.token.read()
+			if err != nil {
+				return err
+			}
+			expected = bytes.TrimSpace(content)
+		}
+		if len(expected) == 0 {
+			return errors.New("the expected bearer token is empty")
+		}
+		token, ok := bytes.CutPrefix([]byte(r.Header.Get("Authorization")), []byte("Bearer "))
+		if !ok || subtle.ConstantTimeCompare(token, expected) != 1 {
+			return errors.New("invalid bearer token")
+		}
+	}
+
+	return nil
+}
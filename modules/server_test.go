@@ -0,0 +1,230 @@
+/*
+ICOS Telemetruum Agent
+Copyright © 2022-2024 Engineering Ingegneria Informatica S.p.A.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+This work has received funding from the European Union's HORIZON research
+and innovation programme under grant agreement No. 101070177.
+*/
+
+package modules
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestCert writes a certificate signed by parent (self-signed if nil) and its key, returning them
+func writeTestCert(t *testing.T, dir string, name string, serial int64, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  parent == nil,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	signer, signerKey := tmpl, any(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name+".pem"), certPEM, 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name+"-key.pem"), keyPEM, 0o600))
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(t, err)
+	cert.Leaf, err = x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert
+}
+
+func testServerConfig() ServerConfig {
+	return ServerConfig{
+		ReadTimeout:  Duration(time.Second),
+		WriteTimeout: Duration(time.Second),
+		IdleTimeout:  Duration(time.Second),
+	}
+}
+
+var okHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	_, _ = w.Write([]byte("ok"))
+})
+
+func TestServerAuth(t *testing.T) {
+	dir := t.TempDir()
+	tokenFile := filepath.Join(dir, "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("s3cret\n"), 0o600))
+
+	basic := testServerConfig()
+	basic.Auth.BasicAuth = BasicAuth{Username: "prometheus", Password: "pwd"}
+	bearer := testServerConfig()
+	bearer.Auth.BearerTokenFile = tokenFile
+
+	for _, tc := range []struct {
+		name   string
+		config ServerConfig
+		auth   func(r *http.Request)
+		status int
+	}{
+		{"no auth", testServerConfig(), func(r *http.Request) {}, http.StatusOK},
+		{"basic", basic, func(r *http.Request) { r.SetBasicAuth("prometheus", "pwd") }, http.StatusOK},
+		{"basic wrong password", basic, func(r *http.Request) { r.SetBasicAuth("prometheus", "nope") }, http.StatusUnauthorized},
+		{"basic missing", basic, func(r *http.Request) {}, http.StatusUnauthorized},
+		{"bearer", bearer, func(r *http.Request) { r.Header.Set("Authorization", "Bearer s3cret") }, http.StatusOK},
+		{"bearer wrong token", bearer, func(r *http.Request) { r.Header.Set("Authorization", "Bearer s3cre") }, http.StatusUnauthorized},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			require.NoError(t, tc.config.validate())
+			s, err := NewServer(":0", tc.config, zerolog.Nop())
+			require.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			tc.auth(req)
+			rec := httptest.NewRecorder()
+			s.Protect(okHandler).ServeHTTP(rec, req)
+			assert.Equal(t, tc.status, rec.Code)
+		})
+	}
+}
+
+func TestServerAuthEmptyToken(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("\n"), 0o600))
+
+	c := testServerConfig()
+	c.Auth.BearerTokenFile = tokenFile
+	assert.ErrorContains(t, c.validate(), "is empty")
+
+	basic := testServerConfig()
+	basic.Auth.BasicAuth = BasicAuth{Username: "prometheus"}
+	assert.ErrorContains(t, basic.validate(), "requires a password")
+
+	// the file is truncated after the start, e.g. while it is rotated
+	require.NoError(t, os.WriteFile(tokenFile, []byte("s3cret\n"), 0o600))
+	require.NoError(t, c.validate())
+	s, err := NewServer(":0", c, zerolog.Nop())
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(tokenFile, nil, 0o600))
+
+	for _, header := range []string{"Bearer ", "Bearer", ""} {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		req.Header.Set("Authorization", header)
+		rec := httptest.NewRecorder()
+		s.Protect(okHandler).ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusUnauthorized, rec.Code, header)
+	}
+}
+
+func TestServerStartBindError(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer busy.Close()
+
+	s, err := NewServer(busy.Addr().String(), testServerConfig(), zerolog.Nop())
+	require.NoError(t, err)
+	assert.ErrorContains(t, s.Start(), "error listening on")
+
+	s, err = NewServer("127.0.0.1:0", testServerConfig(), zerolog.Nop())
+	require.NoError(t, err)
+	require.NoError(t, s.Start())
+	require.NoError(t, s.Close())
+}
+
+func TestServerTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := writeTestCert(t, dir, "ca", 1, nil)
+	writeTestCert(t, dir, "server", 2, &ca)
+	client := writeTestCert(t, dir, "client", 3, &ca)
+
+	cfg := testServerConfig()
+	cfg.TLS = ServerTLSConfig{
+		CertFile:     filepath.Join(dir, "server.pem"),
+		KeyFile:      filepath.Join(dir, "server-key.pem"),
+		ClientCAFile: filepath.Join(dir, "ca.pem"),
+	}
+	require.NoError(t, cfg.validate())
+
+	s, err := NewServer(":0", cfg, zerolog.Nop())
+	require.NoError(t, err)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", s.Protect(okHandler))
+	mux.Handle("/healthz", okHandler)
+	ts := httptest.NewUnstartedServer(mux)
+	ts.TLS = s.TLSConfig
+	ts.StartTLS()
+	defer ts.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	get := func(path string, certs ...tls.Certificate) (int, int64) {
+		c := &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: roots, Certificates: certs, ServerName: "localhost"},
+			DisableKeepAlives: true,
+		}}
+		resp, err := c.Get(ts.URL + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		return resp.StatusCode, resp.TLS.PeerCertificates[0].SerialNumber.Int64()
+	}
+
+	status, serial := get("/metrics")
+	assert.Equal(t, http.StatusUnauthorized, status, "a client certificate is required")
+	assert.Equal(t, int64(2), serial)
+
+	status, _ = get("/healthz")
+	assert.Equal(t, http.StatusOK, status, "the probes do not require a client certificate")
+
+	status, _ = get("/metrics", client)
+	assert.Equal(t, http.StatusOK, status)
+
+	// the certificate is reloaded when the files change
+	writeTestCert(t, dir, "server", 4, &ca)
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(cfg.TLS.CertFile, later, later))
+
+	_, serial = get("/metrics", client)
+	assert.Equal(t, int64(4), serial)
+}
@@ -0,0 +1,129 @@
+/*
+ICOS Telemetruum Agent
+Copyright © 2022-2024 Engineering Ingegneria Informatica S.p.A.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+This work has received funding from the European Union's HORIZON research
+and innovation programme under grant agreement No. 101070177.
+*/
+
+package modules
+
+import (
+	"sync"
+	"time"
+)
+
+type ProviderState string
+
+const (
+	ProviderStarting    ProviderState = "starting"
+	ProviderDisabled    ProviderState = "disabled"
+	ProviderUnavailable ProviderState = "unavailable"
+	ProviderHealthy     ProviderState = "healthy"
+	ProviderDegraded    ProviderState = "degraded"
+)
+
+// ProviderStatus reports the health of a provider. A provider is degraded when the last call of any of its
+// methods failed
+type ProviderStatus struct {
+	Name        string
+	State       ProviderState
+	LastError   string
+	LastSuccess time.Time
+	calls       map[string]*callStatus
+}
+
+type callStatus struct {
+	// nil if the last call succeeded
+	err         error
+	lastSuccess time.Time
+}
+
+var (
+	statusMu         sync.Mutex
+	providerStatuses = map[string]*ProviderStatus{}
+)
+
+// setProviderState resets the status of a provider, e.g. when it is (re)started or disabled
+func setProviderState(name string, state ProviderState, err error) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+
+	status := &ProviderStatus{Name: name, State: state, calls: map[string]*callStatus{}}
+	if err != nil {
+		status.LastError = err.Error()
+	}
+	providerStatuses[name] = status
+}
+
+// recordProviderCall updates the status of a provider with the outcome of one of its methods
+func recordProviderCall(name string, call string, err error) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+
+	status, ok := providerStatuses[name]
+	if !ok || status.State == ProviderStarting || status.State == ProviderDisabled || status.State == ProviderUnavailable {
+		return
+	}
+
+	cs, ok := status.calls[call]
+	if !ok {
+		cs = &callStatus{}
+		status.calls[call] = cs
+	}
+
+	cs.err = err
+	if err != nil {
+		status.LastError = err.Error()
+	} else {
+		cs.lastSuccess = time.Now()
+		status.LastSuccess = cs.lastSuccess
+	}
+
+	status.State = ProviderHealthy
+	for _, c := range status.calls {
+		if c.err != nil {
+			status.State = ProviderDegraded
+		}
+	}
+}
+
+// forEachProviderCall calls fn with the last success time of every provider method that succeeded at least once
+func forEachProviderCall(fn func(provider string, call string, lastSuccess time.Time)) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+
+	for name, status := range providerStatuses {
+		for call, cs := range status.calls {
+			if !cs.lastSuccess.IsZero() {
+				fn(name, call, cs.lastSuccess)
+			}
+		}
+	}
+}
+
+// ProviderStatuses returns a copy of the status of every provider
+func ProviderStatuses() []ProviderStatus {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+
+	res := []ProviderStatus{}
+	for _, name := range sortedKeys(providerStatuses) {
+		s := *providerStatuses[name]
+		s.calls = nil
+		res = append(res, s)
+	}
+	return res
+}
@@ -0,0 +1,282 @@
+/*
+ICOS Telemetruum Agent
+Copyright © 2022-2024 Engineering Ingegneria Informatica S.p.A.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+This work has received funding from the European Union's HORIZON research
+and innovation programme under grant agreement No. 101070177.
+*/
+
+package modules
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/metric"
+)
+
+type runningProvider struct {
+	reg      *ProviderRegistration
+	config   ProviderConfig
+	settings any
+	// nil if the provider failed to initialize
+	provider Provider
+	cancel   context.CancelFunc
+	wg       *sync.WaitGroup
+}
+
+func (p *runningProvider) stop() {
+	p.cancel()
+	p.wg.Wait()
+}
+
+type runningCollector struct {
+	reg      *collectorRegistration
+	settings CollectorConfig
+	runner   CollectorRunner
+	cancel   context.CancelFunc
+	wg       *sync.WaitGroup
+}
+
+func (c *runningCollector) stop() {
+	c.cancel()
+	c.wg.Wait()
+	c.runner.Close()
+}
+
+// Supervisor runs the registered providers and collectors according to a Config. Applying a new Config
+// restarts only the providers and collectors whose settings changed
+type Supervisor struct {
+	meter  metric.Meter
+	logger zerolog.Logger
+
+	mu         sync.Mutex
+	applied    bool
+	providers  map[string]*runningProvider
+	collectors map[string]*runningCollector
+}
+
+func NewSupervisor(meter metric.Meter, logger zerolog.Logger) *Supervisor {
+	return &Supervisor{
+		meter:      meter,
+		logger:     logger,
+		providers:  map[string]*runningProvider{},
+		collectors: map[string]*runningCollector{},
+	}
+}
+
+// Apply brings the running providers and collectors in line with cfg
+func (s *Supervisor) Apply(ctx context.Context, cfg *Config) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	providersChanged := false
+
+	for _, reg := range sortedProviders() {
+		enabled := cfg.ProviderEnabled(reg.Flag)
+		var settings any
+		if reg.Settings != nil {
+			settings = reg.Settings(cfg)
+		}
+
+		config := cfg.Providers[reg.Flag]
+		current, running := s.providers[reg.Flag]
+		if running && enabled && reflect.DeepEqual(current.settings, settings) && reflect.DeepEqual(current.config, config) {
+			continue
+		}
+
+		if running {
+			s.logger.Info().Msgf("Stopping %s Provider", reg.Name)
+			current.stop()
+			delete(s.providers, reg.Flag)
+			providersChanged = true
+		}
+
+		if !enabled {
+			s.logger.Debug().Msgf("%s Provider disabled", reg.Name)
+			setProviderState(reg.Name, ProviderDisabled, nil)
+			continue
+		}
+
+		s.providers[reg.Flag] = s.startProvider(ctx, reg, cfg, settings)
+		providersChanged = true
+	}
+
+	newCollectors := false
+
+	for _, reg := range registeredCollectors {
+		settings := cfg.Collector(reg.flag)
+		enabled := settings.Enabled != nil && *settings.Enabled
+
+		current, running := s.collectors[reg.flag]
+		if running && enabled && reflect.DeepEqual(current.settings, settings) {
+			continue
+		}
+
+		if running {
+			s.logger.Info().Msgf("Stopping %s Collector", reg.name)
+			current.stop()
+			delete(s.collectors, reg.flag)
+		}
+
+		if !enabled {
+			s.logger.Debug().Msgf("%s Collector disabled", reg.name)
+			continue
+		}
+
+		rc := &runningCollector{
+			reg:      reg,
+			settings: settings,
+			runner:   reg.newRunner(settings.schedule(), s.logger.With().Str("Collector", reg.name).Logger()),
+			wg:       &sync.WaitGroup{},
+		}
+		s.collectors[reg.flag] = rc
+		newCollectors = true
+	}
+
+	if providersChanged || newCollectors {
+		s.wire()
+	}
+
+	for _, rc := range s.collectors {
+		if rc.cancel != nil {
+			continue
+		}
+		var runnerCtx context.Context
+		runnerCtx, rc.cancel = context.WithCancel(ctx)
+		rc.runner.Init(s.meter)
+		rc.runner.Start(runnerCtx, rc.wg)
+	}
+
+	s.applied = true
+}
+
+// CollectorStatus reports when a collector last completed a collection
+type CollectorStatus struct {
+	Name           string
+	LastCollection time.Time
+}
+
+// AgentStatus is the status of the providers and collectors. The agent is ready when every enabled provider
+// is initialized, or marked as unavailable, and every collector completed its first collection
+type AgentStatus struct {
+	Ready      bool
+	Providers  []ProviderStatus
+	Collectors []CollectorStatus
+}
+
+// Status returns the current status of the providers and collectors
+func (s *Supervisor) Status() AgentStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := AgentStatus{Ready: s.applied, Providers: ProviderStatuses()}
+
+	for _, p := range status.Providers {
+		if p.State == ProviderStarting {
+			status.Ready = false
+		}
+	}
+
+	for _, name := range sortedKeys(s.collectors) {
+		rc := s.collectors[name]
+		cs := CollectorStatus{Name: rc.reg.name, LastCollection: rc.runner.LastCollection()}
+		if cs.LastCollection.IsZero() {
+			status.Ready = false
+		}
+		status.Collectors = append(status.Collectors, cs)
+	}
+
+	return status
+}
+
+// collectorSnapshot returns the last snapshot of the collector with the given flag name, and when it was taken
+func (s *Supervisor) collectorSnapshot(flag string) (any, time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rc, ok := s.collectors[flag]
+	if !ok {
+		return nil, time.Time{}, false
+	}
+	return rc.runner.Current(), rc.runner.LastCollection(), true
+}
+
+// Stop stops all the providers and collectors and waits for them to terminate
+func (s *Supervisor) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for k, rc := range s.collectors {
+		rc.stop()
+		delete(s.collectors, k)
+	}
+
+	for k, rp := range s.providers {
+		rp.stop()
+		delete(s.providers, k)
+	}
+}
+
+func (s *Supervisor) startProvider(ctx context.Context, reg *ProviderRegistration, cfg *Config, settings any) *runningProvider {
+	providerCtx, cancel := context.WithCancel(ctx)
+	rp := &runningProvider{reg: reg, config: cfg.Providers[reg.Flag], settings: settings, cancel: cancel, wg: &sync.WaitGroup{}}
+
+	setProviderState(reg.Name, ProviderStarting, nil)
+	provider, err := reg.Initialize(cfg, s.logger.With().Str("Provider", reg.Name).Logger())
+	if err != nil {
+		s.logger.Warn().Msgf("Error initializing %s (\"%s\"). The %s provider will not be used", reg.Name, err, reg.Name)
+		setProviderState(reg.Name, ProviderUnavailable, err)
+		return rp
+	}
+
+	setProviderState(reg.Name, ProviderHealthy, nil)
+	provider.Start(providerCtx, rp.wg)
+	s.logger.Info().Msgf("%s Provider successfully started", reg.Name)
+	rp.provider = provider
+
+	return rp
+}
+
+// wire rebuilds, in priority order, the list of providers feeding each collector
+func (s *Supervisor) wire() {
+	var feeds []any
+	for _, reg := range sortedProviders() {
+		rp, ok := s.providers[reg.Flag]
+		if !ok || rp.provider == nil {
+			continue
+		}
+		for _, f := range reg.Feeds {
+			if dp := f.bind(rp.provider, reg.Name, time.Duration(*rp.config.Timeout)); dp != nil {
+				feeds = append(feeds, dp)
+			}
+		}
+	}
+
+	for _, rc := range s.collectors {
+		rc.runner.SetAsyncDataProviders(feeds)
+	}
+}
+
+func sortedProviders() []*ProviderRegistration {
+	providers := make([]*ProviderRegistration, len(registeredProviders))
+	copy(providers, registeredProviders)
+	sort.SliceStable(providers, func(i, j int) bool { return providers[i].Priority < providers[j].Priority })
+	return providers
+}